@@ -0,0 +1,42 @@
+package caskdb
+
+import (
+	"bufio"
+	"fmt"
+	"sync"
+)
+
+// auditLog buffers the lines written to Options.AuditWriter, so that a slow
+// writer only holds up the write path once the buffer fills up. It is flushed
+// when the store is closed.
+type auditLog struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+}
+
+// log records a write of key with a value of size bytes, or its deletion, as a
+// line like
+//
+//	1700000000 SET "hamlet" 11
+//	1700000000 DELETE "hamlet"
+func (a *auditLog) log(key string, h recordHeader, size int) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if h.isTombstone() {
+		fmt.Fprintf(a.w, "%d DELETE %q\n", h.timestamp, key)
+	} else {
+		fmt.Fprintf(a.w, "%d SET %q %d\n", h.timestamp, key, size)
+	}
+}
+
+func (a *auditLog) flush() error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.w.Flush()
+}
@@ -0,0 +1,39 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_AuditWriter(t *testing.T) {
+	var audit strings.Builder
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{AuditWriter: &audit, Clock: clock.Now})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	clock.Advance(time.Second)
+	store.Put("hamlet", "bacon")
+	store.Delete("hamlet")
+	store.Delete("absent")
+	store.Set("new\nline", "")
+	store.DeleteMulti([]string{"new\nline"})
+	store.Close()
+
+	want := []string{
+		`1700000000 SET "hamlet" 11`,
+		`1700000001 SET "hamlet" 5`,
+		`1700000001 DELETE "hamlet"`,
+		`1700000001 SET "new\nline" 0`,
+		`1700000001 DELETE "new\nline"`,
+	}
+	if got := strings.TrimSuffix(audit.String(), "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("audit log = %q, want %q", got, want)
+	}
+	if strings.Contains(audit.String(), "shakespeare") {
+		t.Errorf("audit log holds a value")
+	}
+}
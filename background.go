@@ -0,0 +1,57 @@
+package caskdb
+
+import "time"
+
+// runEvery calls fn every interval in the background until Close. Background
+// jobs take mu themselves, like any other caller.
+func (d *DiskStore) runEvery(interval time.Duration, fn func()) {
+	if d.stop == nil {
+		d.stop = make(chan struct{})
+	}
+	d.background.Add(1)
+	go func() {
+		defer d.background.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+}
+
+// stopBackground stops the jobs started by runEvery, waiting for the ones in
+// progress to finish
+func (d *DiskStore) stopBackground() {
+	if d.stop != nil {
+		close(d.stop)
+		d.background.Wait()
+		d.stop = nil
+	}
+}
+
+// startBackground starts the background jobs enabled in the options
+func (d *DiskStore) startBackground() {
+	// the committer takes no locks, and is only stopped once Close holds mu
+	if d.opts.GroupCommit {
+		d.startCommitter()
+	}
+	if d.opts.ExpireInterval > 0 {
+		d.runEvery(d.opts.ExpireInterval, func() {
+			if _, err := d.ExpireExpiredKeys(); err != nil && err != ErrIndexNotBuilt {
+				d.logger().Printf("caskdb: failed to expire keys of %s: %v", d.fileName, err)
+			}
+		})
+	}
+	if d.opts.HintInterval > 0 {
+		d.runEvery(d.opts.HintInterval, func() {
+			if err := d.WriteHint(); err != nil && err != ErrIndexNotBuilt {
+				d.logger().Printf("caskdb: failed to write hint file of %s: %v", d.fileName, err)
+			}
+		})
+	}
+}
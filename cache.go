@@ -0,0 +1,126 @@
+package caskdb
+
+import "sync"
+
+// valueCache holds the value of every key in memory, see Options.CacheAllValues,
+// or only of the keys passed to Warm, see Options.WarmCache. Entries are only
+// added and removed along with the keyStore, so the keyStore still decides
+// whether a key exists and whether it has expired.
+type valueCache struct {
+	mu     sync.RWMutex
+	values map[string]cachedValue
+	// all is set when every key is cached, so that writes cache new keys too
+	all bool
+}
+
+// cachedValue is the decoded value of a key, with the header of its record
+type cachedValue struct {
+	h     recordHeader
+	value string
+}
+
+func (c *valueCache) get(key string) (cachedValue, bool) {
+	if c == nil {
+		return cachedValue{}, false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	v, ok := c.values[key]
+	return v, ok
+}
+
+func (c *valueCache) set(key string, h recordHeader, value string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = cachedValue{h, value}
+}
+
+// update sets the value of key after a write, if it is to be cached
+func (c *valueCache) update(key string, h recordHeader, value string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.values[key]; ok || c.all {
+		c.values[key] = cachedValue{h, value}
+	}
+}
+
+func (c *valueCache) delete(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.values, key)
+}
+
+// loadCache reads the value of every key into a new cache, with
+// Options.CacheAllValues, or of the keys cached so far, with Options.WarmCache.
+// The caller must hold mu exclusively, or be opening the store.
+func (d *DiskStore) loadCache() error {
+	if !d.opts.CacheAllValues && !d.opts.WarmCache {
+		return nil
+	}
+	var keys []string
+	if d.opts.CacheAllValues {
+		keys = make([]string, 0, d.keyStore.Len())
+		d.keyStore.Range(func(key string, entry KeyEntry) bool {
+			keys = append(keys, key)
+			return true
+		})
+	} else if d.cache != nil {
+		for key := range d.cache.values {
+			keys = append(keys, key)
+		}
+	}
+	// reads below go to the disk rather than the outdated cache
+	d.cache = nil
+	cache := &valueCache{values: make(map[string]cachedValue, len(keys)), all: d.opts.CacheAllValues}
+	for _, key := range keys {
+		h, value, ok, err := d.getRecord(key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			cache.values[key] = cachedValue{h, value}
+		}
+	}
+	d.cache = cache
+	return nil
+}
+
+// Warm reads the values of keys from the disk into the cache of
+// Options.WarmCache, so that reading them later does not go to the disk; missing
+// keys are skipped. Without a cache it does nothing, and with
+// Options.CacheAllValues every value is cached already.
+func (d *DiskStore) Warm(keys []string) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.cache == nil || d.cache.all {
+		return nil
+	}
+	for _, key := range keys {
+		if err := d.warmKey(d.normalizeKey(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warmKey caches the value of key. It holds the lock of the key, so that no write
+// to it can slip in between the read and caching what it read. The caller must
+// hold mu.
+func (d *DiskStore) warmKey(key string) error {
+	shard := d.lockKey(key)
+	defer shard.Unlock()
+	h, value, ok, err := d.getRecord(key)
+	if ok {
+		d.cache.set(key, h, value)
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_CacheAllValues(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{CacheAllValues: true, Codec: CodecFlate}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "bacon")
+	store.Set("dune", "frank herbert")
+	store.Set("othello", "shakespeare")
+	store.Close()
+
+	// the values written before the store was opened are cached too
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.SetWithMeta("anna karenina", "tolstoy", 7)
+	store.Delete("othello")
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	// with the data file closed and no read handles, any read of the disk fails
+	store.file.Close()
+
+	want := map[string]string{"hamlet": "shakespeare", "dune": "frank herbert", "anna karenina": "tolstoy"}
+	for key, val := range want {
+		if got, err := store.Fetch(key); err != nil || got != val {
+			t.Errorf("Fetch(%q) = %q, %v, want %q, nil", key, got, err, val)
+		}
+	}
+	if _, meta, _ := store.GetMeta2("anna karenina"); meta != 7 {
+		t.Errorf("GetMeta2() meta = %v, want %v", meta, 7)
+	}
+	if _, ok := store.Lookup("othello"); ok {
+		t.Errorf("Lookup() found a deleted key")
+	}
+
+	// the writes made it to the disk all the same
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range want {
+		if got := store.Get(key); got != val {
+			t.Errorf("Get(%q) = %q, want %q", key, got, val)
+		}
+	}
+	if _, ok := store.Lookup("othello"); ok {
+		t.Errorf("Lookup() found a deleted key")
+	}
+}
+
+func TestDiskStore_Warm(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if err := store.Warm([]string{"hamlet"}); err != nil {
+		t.Errorf("Warm() without a cache error = %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Set("othello", "shakespeare")
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, Options{WarmCache: true, ReadHandles: -1})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	if err := store.Warm([]string{"hamlet", "dune", "war and peace"}); err != nil {
+		t.Fatalf("Warm() error = %v", err)
+	}
+	store.Set("dune", "brian herbert")
+	store.Set("anna karenina", "tolstoy")
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	// with the data file closed and no read handles, any read of the disk fails
+	store.file.Close()
+
+	for key, val := range map[string]string{"hamlet": "shakespeare", "dune": "brian herbert"} {
+		if got, err := store.Fetch(key); err != nil || got != val {
+			t.Errorf("Fetch(%q) = %q, %v, want %q, nil", key, got, err, val)
+		}
+	}
+	for _, key := range []string{"othello", "anna karenina"} {
+		if _, err := store.Fetch(key); err == nil {
+			t.Errorf("Fetch(%q) of a key which was not warmed did not read the disk", key)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package caskdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Codec is a compression algorithm for values. The codec a value was compressed
+// with is kept in the flags of its record, so records compressed with different
+// codecs, or not at all, decode side by side.
+type Codec uint32
+
+const (
+	// CodecNone stores values as they are
+	CodecNone Codec = iota
+	// CodecFlate compresses values with DEFLATE at its fastest level, suited to
+	// the write path
+	CodecFlate
+	// CodecFlateBest compresses values with DEFLATE at its best level, slower but
+	// smaller, suited to compaction
+	CodecFlateBest
+)
+
+// The codec of a record is stored in bits 1 to 3 of its flags.
+const (
+	flagCodecShift = 1
+	flagCodecMask  = 0x7 << flagCodecShift
+)
+
+func (h recordHeader) codec() Codec {
+	return Codec(h.flags&flagCodecMask) >> flagCodecShift
+}
+
+func (h recordHeader) withCodec(c Codec) recordHeader {
+	h.flags = h.flags&^flagCodecMask | uint32(c)<<flagCodecShift
+	return h
+}
+
+// encode compresses value. A codec returning nothing for a value is a bug, and
+// is caught here rather than writing a record which reads back as an empty value.
+func (c Codec) encode(value string) (string, error) {
+	encoded, err := compress(c, value)
+	if err != nil {
+		return "", err
+	}
+	if encoded == "" && value != "" {
+		return "", fmt.Errorf("%w: codec %d returned no bytes for a %d byte value", ErrEmptyEncoding, c, len(value))
+	}
+	return encoded, nil
+}
+
+// compress is Codec.compress, a variable so that tests can break the codec
+var compress = Codec.compress
+
+func (c Codec) compress(value string) (string, error) {
+	level := flate.BestSpeed
+	switch c {
+	case CodecNone:
+		return value, nil
+	case CodecFlate:
+	case CodecFlateBest:
+		level = flate.BestCompression
+	default:
+		return "", fmt.Errorf("caskdb: unknown codec %d", c)
+	}
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, level)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.WriteString(w, value); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// decode decompresses a value compressed by encode
+func (c Codec) decode(value string) (string, error) {
+	if c == CodecNone {
+		return value, nil
+	}
+	r, err := c.reader(strings.NewReader(value))
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(r)
+	return string(data), err
+}
+
+// reader returns a reader decompressing r
+func (c Codec) reader(r io.Reader) (io.Reader, error) {
+	switch c {
+	case CodecNone:
+		return r, nil
+	case CodecFlate, CodecFlateBest:
+		return flate.NewReader(r), nil
+	}
+	return nil, fmt.Errorf("caskdb: unknown codec %d", c)
+}
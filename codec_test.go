@@ -0,0 +1,140 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_Codec(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{Codec: CodecFlate})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	large := strings.Repeat("all work and no play makes jack a dull boy\n", 1000)
+	store.Set("the shining", large)
+	store.Set("empty", "")
+	if info, _ := os.Stat(fileName); info.Size() >= int64(len(large)) {
+		t.Errorf("file size = %v, want the value compressed", info.Size())
+	}
+	if val := store.Get("the shining"); val != large {
+		t.Errorf("Get() returned a different value")
+	}
+	if val, ok := store.Lookup("empty"); !ok || val != "" {
+		t.Errorf("Lookup() = %v, %v, want '', true", val, ok)
+	}
+
+	r, size, _, err := store.GetReader("the shining")
+	if err != nil {
+		t.Fatalf("GetReader() error = %v", err)
+	}
+	defer r.Close()
+	if data, _ := io.ReadAll(r); string(data) != large || size != int64(len(large)) {
+		t.Errorf("GetReader() read %v bytes and size %v, want the decompressed value and its length", len(data), size)
+	}
+}
+
+func TestDiskStore_CompactionCodec(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	tests := map[string]string{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("book-%d", i)
+		tests[key] = strings.Repeat(fmt.Sprintf("chapter %d ", i), 500)
+		store.Set(key, tests[key])
+	}
+	store.Close()
+
+	// compact with a stronger codec than the one used for writes, which leaves a
+	// mix of codecs in the file
+	opts := Options{Codec: CodecFlate, CompactionCodec: CodecFlateBest}
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	before, _ := os.Stat(fileName)
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	after, _ := os.Stat(fileName)
+	if after.Size() >= before.Size()/2 {
+		t.Errorf("file size = %v, want much less than %v", after.Size(), before.Size())
+	}
+	tests["hamlet"] = "shakespeare"
+	store.Set("hamlet", "shakespeare")
+	for key, val := range tests {
+		if store.Get(key) != val {
+			t.Errorf("Get(%v) returned a different value", key)
+		}
+	}
+	it := store.RawRecords()
+	for it.Next() {
+		if record := it.Record(); record.Value != tests[record.Key] {
+			t.Errorf("RawRecords() value of %v differs", record.Key)
+		}
+	}
+}
+
+func TestDiskStore_RecordTooLarge(t *testing.T) {
+	defer func(size int64) { maxRecordSize = size }(maxRecordSize)
+	maxRecordSize = 4096
+
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{Codec: CodecFlate})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// random bytes do not compress, and flate adds its framing on top of them
+	value := make([]byte, int(maxRecordSize)-headerSize-len("random"))
+	rand.New(rand.NewSource(1)).Read(value)
+	before, _ := os.Stat(store.fileName)
+	if err := store.Set("random", string(value)); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("Set() error = %v, want ErrRecordTooLarge", err)
+	}
+	if after, _ := os.Stat(store.fileName); after.Size() != before.Size() {
+		t.Errorf("file size = %v, want %v", after.Size(), before.Size())
+	}
+	if _, ok := store.Lookup("random"); ok {
+		t.Errorf("Lookup() found a record which was too large")
+	}
+	// compressible values of the same size fit
+	if err := store.Set("zeros", string(make([]byte, len(value)))); err != nil {
+		t.Errorf("Set() error = %v", err)
+	}
+}
+
+func TestDiskStore_EmptyEncoding(t *testing.T) {
+	defer func(c func(Codec, string) (string, error)) { compress = c }(compress)
+	compress = func(Codec, string) (string, error) { return "", nil }
+
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{Codec: CodecFlate})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	before, _ := os.Stat(store.fileName)
+	if err := store.Set("hamlet", "to be or not to be"); !errors.Is(err, ErrEmptyEncoding) {
+		t.Errorf("Set() error = %v, want ErrEmptyEncoding", err)
+	}
+	if after, _ := os.Stat(store.fileName); after.Size() != before.Size() {
+		t.Errorf("file size = %v, want %v", after.Size(), before.Size())
+	}
+	if _, ok := store.Lookup("hamlet"); ok {
+		t.Errorf("Lookup() found a record with an empty encoding")
+	}
+	// an empty value has nothing to lose
+	if err := store.Set("empty", ""); err != nil {
+		t.Errorf("Set() error = %v", err)
+	}
+}
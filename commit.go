@@ -0,0 +1,108 @@
+package caskdb
+
+import (
+	"bytes"
+	"io"
+)
+
+// With Options.GroupCommit, appends are not written by the writers themselves but
+// handed over to a single committer goroutine. While the committer is busy writing
+// and syncing a batch, the appends arriving in the meantime queue up, and are then
+// written together and synced once: the more concurrent writers, the more writes
+// share every fsync. Each writer still blocks until its own record is synced.
+
+// commitRequest is an append waiting for the committer
+type commitRequest struct {
+	file appendFile
+	bufs [][]byte
+	// pos is where bufs were written, set before done receives the error
+	pos  int64
+	done chan error
+}
+
+// startCommitter starts the committer goroutine, which runs until stopCommitter
+func (d *DiskStore) startCommitter() {
+	d.commits = make(chan *commitRequest)
+	d.committer.Add(1)
+	go func() {
+		defer d.committer.Done()
+		for req := range d.commits {
+			batch := []*commitRequest{req}
+		queued:
+			for {
+				select {
+				case req, ok := <-d.commits:
+					if !ok {
+						break queued
+					}
+					batch = append(batch, req)
+				default:
+					break queued
+				}
+			}
+			d.commitBatch(batch)
+		}
+	}()
+}
+
+// stopCommitter stops the committer. The caller must hold mu exclusively, so that
+// no append is in flight; later appends are written directly.
+func (d *DiskStore) stopCommitter() {
+	if d.commits != nil {
+		close(d.commits)
+		d.committer.Wait()
+		d.commits = nil
+	}
+}
+
+// commit hands bufs over to the committer, waiting until they are written and
+// synced
+func (d *DiskStore) commit(file appendFile, bufs [][]byte) (int64, error) {
+	req := &commitRequest{file: file, bufs: bufs, done: make(chan error, 1)}
+	d.commits <- req
+	err := <-req.done
+	return req.pos, err
+}
+
+// commitBatch writes the bufs of every request to its file, in the order of the
+// requests, with one vectored write and one sync per file. A failure to write or
+// sync fails every request for that file.
+func (d *DiskStore) commitBatch(batch []*commitRequest) {
+	var files []appendFile
+	byFile := make(map[appendFile][]*commitRequest)
+	for _, req := range batch {
+		if _, ok := byFile[req.file]; !ok {
+			files = append(files, req.file)
+		}
+		byFile[req.file] = append(byFile[req.file], req)
+	}
+	for _, file := range files {
+		reqs := byFile[file]
+		var bufs [][]byte
+		for _, req := range reqs {
+			bufs = append(bufs, req.bufs...)
+		}
+		d.appendMu.Lock()
+		pos, err := d.writeBuffers(file, bufs)
+		d.appendMu.Unlock()
+		if err == nil {
+			err = d.retry(file.Sync)
+		}
+		for _, req := range reqs {
+			req.pos = pos
+			for _, buf := range req.bufs {
+				pos += int64(len(buf))
+			}
+			req.done <- err
+		}
+	}
+}
+
+// writeConcat writes bufs to file in a single write of their concatenation, for
+// files and platforms without vectored writes
+func writeConcat(file io.Writer, bufs [][]byte) (int, error) {
+	if len(bufs) == 1 {
+		return file.Write(bufs[0])
+	}
+	return file.Write(bytes.Join(bufs, nil))
+}
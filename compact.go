@@ -0,0 +1,843 @@
+package caskdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// compactFileName is the temporary file Compact and ReplaceAll write the new data
+// file to
+func compactFileName(fileName string) string {
+	return fileName + ".compact"
+}
+
+// compactTempName is the temporary file the compaction of fileName writes to, in
+// Options.TempDir if set. There it is prefixed with tempPrefix, since other
+// stores may write to the same directory.
+func (d *DiskStore) compactTempName(fileName string) string {
+	if d.opts.TempDir == "" {
+		return compactFileName(fileName)
+	}
+	return filepath.Join(d.opts.TempDir, d.tempPrefix()+filepath.Base(compactFileName(fileName)))
+}
+
+// tempPrefix tells the temporary files of the store apart from those of other
+// stores in Options.TempDir, as a hash of the path of the store
+func (d *DiskStore) tempPrefix() string {
+	h := fnv.New64a()
+	h.Write([]byte(d.storePath()))
+	return fmt.Sprintf("%016x-", h.Sum64())
+}
+
+// storePath is the absolute path of the store: its directory in directory mode,
+// and its data file otherwise
+func (d *DiskStore) storePath() string {
+	path := d.fileName
+	if d.dir != "" {
+		path = d.dir
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// stageCompacted moves tmpName, named by compactTempName, next to fileName so
+// that it can be renamed over it, returning its new name. tmpName is removed if
+// moving it fails.
+func (d *DiskStore) stageCompacted(tmpName string, fileName string) (string, error) {
+	localName := compactFileName(fileName)
+	if tmpName == localName {
+		return tmpName, nil
+	}
+	os.Remove(localName)
+	if err := moveFile(tmpName, localName); err != nil {
+		os.Remove(tmpName)
+		return "", err
+	}
+	return localName, nil
+}
+
+// removeCompactLeftovers removes the temporary files of a compaction which was
+// interrupted by a crash. The new file only takes the place of the old one once
+// it is complete, so a leftover is never needed and the data file is intact.
+//
+// The files are only removed while the store has them to itself, as they could
+// otherwise belong to a compaction running in another store: with
+// Options.NetworkFS the lock file keeps other processes out, and stores of this
+// process opened on the same path are checked for while holding the registry
+// lock, so that none opens in between.
+func (d *DiskStore) removeCompactLeftovers() error {
+	openStores.Lock()
+	defer openStores.Unlock()
+	for other := range openStores.stores {
+		if other.storePath() == d.storePath() {
+			d.logger().Printf("caskdb: not looking for leftovers of an interrupted compaction, %s is open in another store", d.storePath())
+			return nil
+		}
+	}
+	leftovers := []string{compactFileName(d.fileName), sortedFileName(compactFileName(d.fileName))}
+	if d.opts.TempDir != "" {
+		leftovers = append(leftovers, d.compactTempName(d.fileName), sortedFileName(d.compactTempName(d.fileName)))
+	}
+	if d.dir != "" {
+		patterns := []string{filepath.Join(d.dir, "*"+compactFileName(segmentExt)+"*")}
+		if d.opts.TempDir != "" {
+			patterns = append(patterns, filepath.Join(d.opts.TempDir, d.tempPrefix()+"*"+compactFileName(segmentExt)+"*"))
+		}
+		leftovers = nil
+		for _, pattern := range patterns {
+			names, err := filepath.Glob(pattern)
+			if err != nil {
+				return err
+			}
+			leftovers = append(leftovers, names...)
+		}
+	}
+	for _, name := range leftovers {
+		err := os.Remove(name)
+		if err == nil {
+			d.logger().Printf("caskdb: removed %s, left behind by an interrupted compaction", name)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact rewrites the data file keeping only the latest record of every key,
+// reclaiming the space taken by overwritten records. The new file is written next
+// to the old one, or in Options.TempDir, and renamed over it once complete, so a
+// crash at any point leaves either the old or the new file intact; the temporary
+// file of an interrupted compaction is removed when the store is next opened.
+// Writes block until compaction finishes, unless Options.ConcurrentCompaction is
+// set.
+//
+// With Options.SeparateValues, only the data file is compacted; the values file
+// keeps growing.
+//
+// Only one compaction runs at a time: calling Compact or Shrink while another one
+// is running returns ErrCompactionInProgress rather than compacting twice.
+func (d *DiskStore) Compact() error {
+	if !d.compacting.CompareAndSwap(false, true) {
+		return ErrCompactionInProgress
+	}
+	defer d.compacting.Store(false)
+	if d.opts.ConcurrentCompaction && d.dir == "" {
+		return d.compactConcurrently()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.compact()
+}
+
+// CompactIfNeeded runs Compact only when dead records take up more than threshold
+// (between 0 and 1) of the data file, or when there are at least
+// Options.MaxStaleRecords of them, reporting whether it compacted.
+func (d *DiskStore) CompactIfNeeded(threshold float64) (bool, error) {
+	stats, err := d.Stats()
+	if err != nil {
+		return false, err
+	}
+	tooMany := d.opts.MaxStaleRecords > 0 && stats.DeadRecords >= int64(d.opts.MaxStaleRecords)
+	if stats.DeadRatio() <= threshold && !tooMany {
+		return false, nil
+	}
+	return true, d.Compact()
+}
+
+// Purge rewrites the data file like Compact, but only drops the keys which were
+// deleted: the tombstones and every record written before them. The overwritten
+// versions of the keys still in the store are kept, for GetAt and RawRecords. It
+// reclaims the space of deleted keys right away, without giving up the history
+// of the others; the file is replaced just as crash safely as by Compact.
+func (d *DiskStore) Purge() error {
+	if !d.compacting.CompareAndSwap(false, true) {
+		return ErrCompactionInProgress
+	}
+	defer d.compacting.Store(false)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.rewrite(math.MaxInt)
+}
+
+// CompactRange reclaims the space of the dead records of the keys in [start, end)
+// only: for those keys only the latest live record is kept, while the records of
+// every other key, dead or not, tombstones included, are left as they are. It
+// splits the reclaiming of a large store into smaller steps, each dropping only
+// a part of the dead records, say one range per maintenance window.
+//
+// The data file is still rewritten as a whole, just as by Compact and as crash
+// safely, so every call reads and writes all of it; what is spread out is which
+// records are reclaimed, not the I/O. Versions kept by Options.KeepVersions are
+// dropped for the keys in range. CompactRange is not supported by stores opened
+// with Open.
+func (d *DiskStore) CompactRange(start, end string) error {
+	if d.dir != "" {
+		return errors.New("caskdb: CompactRange is not supported by stores opened with Open")
+	}
+	if !d.compacting.CompareAndSwap(false, true) {
+		return ErrCompactionInProgress
+	}
+	defer d.compacting.Store(false)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.deferred {
+		return ErrIndexNotBuilt
+	}
+	inRange := func(key string) bool { return key >= start && key < end }
+	tmpName := d.compactTempName(d.fileName)
+	keyStore, dead, err := d.writeRangeCompacted(tmpName, inRange)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if tmpName, err = d.stageCompacted(tmpName, d.fileName); err != nil {
+		return err
+	}
+	if err := d.installFile(tmpName, keyStore); err != nil {
+		return err
+	}
+	d.deadRecords.Add(dead)
+	return nil
+}
+
+// writeRangeCompacted writes the records of the data file to a new data file in
+// the current format version, dropping the dead records of the keys inRange
+// accepts, and returns the keyStore pointing into it along with how many dead
+// records were kept. The caller must hold mu exclusively.
+func (d *DiskStore) writeRangeCompacted(fileName string, inRange func(key string) bool) (KeyDir, int64, error) {
+	info, err := d.file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	if _, err := w.Write(encodeFileHeader(formatVersion)); err != nil {
+		return nil, 0, err
+	}
+
+	keyStore := d.newKeyDir()
+	offset := int64(fileHeaderSize)
+	now := d.now().Unix()
+	var dead int64
+	r := bufio.NewReader(io.NewSectionReader(d.file, d.dataStart, info.Size()-d.dataStart))
+	var buf []byte
+	for pos := d.dataStart; pos < info.Size(); {
+		_, record, err := readRecord(r, d.version, buf)
+		if err != nil {
+			return nil, 0, err
+		}
+		buf = record
+		size := int64(len(record))
+		h, key, value := decodeRecord(d.version, record)
+		entry, ok := d.keyStore.Get(key)
+		latest := ok && entry.segment == d.segment && int64(entry.position) == pos
+		pos += size
+		if inRange(key) && (!latest || entry.expired(now)) {
+			continue
+		}
+		if d.version != formatVersion {
+			record = encodeRecord(formatVersion, h, key, value)
+		}
+		if _, err := w.Write(record); err != nil {
+			return nil, 0, err
+		}
+		if latest {
+			keyStore.Set(key, KeyEntry{entry.timestamp, uint32(offset), uint32(len(record)), d.segment, entry.expiresAt, entry.valueSize})
+		} else {
+			dead++
+		}
+		offset += int64(len(record))
+	}
+	if err := w.Flush(); err != nil {
+		return nil, 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, 0, err
+	}
+	return keyStore, dead, file.Close()
+}
+
+// compact does the work of Compact. The caller must hold mu exclusively.
+func (d *DiskStore) compact() error {
+	return d.rewrite(d.opts.KeepVersions)
+}
+
+// rewrite does the work of Compact and Purge, keeping the keepVersions most
+// recent versions of every key. The caller must hold mu exclusively.
+func (d *DiskStore) rewrite(keepVersions int) error {
+	if d.deferred {
+		return ErrIndexNotBuilt
+	}
+	var err error
+	if d.dir != "" {
+		err = d.compactSegments(keepVersions)
+	} else {
+		tmpName := d.compactTempName(d.fileName)
+		var keyStore KeyDir
+		if keyStore, err = d.writeCompacted(tmpName, d.segment, 0, keepVersions); err != nil {
+			os.Remove(tmpName)
+			return err
+		}
+		if tmpName, err = d.stageCompacted(tmpName, d.fileName); err != nil {
+			return err
+		}
+		err = d.installFile(tmpName, keyStore)
+	}
+	// read repair may have replaced values
+	if err == nil && d.opts.ReadRepair {
+		err = d.loadValues()
+	}
+	return err
+}
+
+// compactConcurrently compacts the data file like compact while writes carry on,
+// for Options.ConcurrentCompaction. The file is compacted up to a snapshot of its
+// size, taken while no write is in flight, so every record before the snapshot is
+// already in the keyStore; the records written while compacting are then copied
+// over under the exclusive lock, and the new file installed.
+func (d *DiskStore) compactConcurrently() error {
+	d.mu.Lock()
+	if d.deferred {
+		d.mu.Unlock()
+		return ErrIndexNotBuilt
+	}
+	file, fileName, segment := d.file, d.fileName, d.segment
+	info, err := file.Stat()
+	d.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	snapshot := info.Size()
+
+	tmpName := d.compactTempName(fileName)
+	d.mu.RLock()
+	keyStore, err := d.writeCompacted(tmpName, segment, snapshot, d.opts.KeepVersions)
+	d.mu.RUnlock()
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	// ReplaceAll or MoveTo may have slipped in before the lock was taken
+	if d.file != file || d.fileName != fileName {
+		os.Remove(tmpName)
+		return errors.New("caskdb: the data file was replaced while compacting")
+	}
+	dead, err := d.copyWritten(tmpName, keyStore, snapshot)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if tmpName, err = d.stageCompacted(tmpName, d.fileName); err != nil {
+		return err
+	}
+	if err := d.installFile(tmpName, keyStore); err != nil {
+		return err
+	}
+	d.deadRecords.Add(dead)
+	if d.opts.ReadRepair {
+		return d.loadValues()
+	}
+	return nil
+}
+
+// copyWritten appends the records of the data file from offset from onwards to
+// the compacted file fileName, updating its keyStore, and returns how many of the
+// records in it are now dead. The caller must hold mu exclusively.
+func (d *DiskStore) copyWritten(fileName string, keyStore KeyDir, from int64) (int64, error) {
+	info, err := d.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := info.Size()
+	if end == from {
+		return 0, nil
+	}
+	dst, err := os.OpenFile(fileName, os.O_WRONLY|d.opts.appendFlag(), 0666)
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	// without O_APPEND, as with Options.NetworkFS, the writes land at the offset
+	// of the file, so it is moved to the end
+	offset, err := dst.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	w := bufio.NewWriter(dst)
+	r := bufio.NewReader(io.NewSectionReader(d.file, from, end-from))
+	var buf []byte
+	var dead int64
+	for pos := from; pos < end; {
+		_, record, err := readRecord(r, d.version, buf)
+		if err != nil {
+			return 0, err
+		}
+		buf = record
+		size := int64(len(record))
+		h, key, value := decodeRecord(d.version, record)
+		if d.version != formatVersion {
+			record = encodeRecord(formatVersion, h, key, value)
+		}
+		if _, err := w.Write(record); err != nil {
+			return 0, err
+		}
+		if _, ok := keyStore.Get(key); ok {
+			dead++
+		}
+		if h.isTombstone() {
+			dead++
+			keyStore.Delete(key)
+		} else {
+			valueSize, err := d.rawValueSize(h, value)
+			if err != nil {
+				return 0, err
+			}
+			keyStore.Set(key, KeyEntry{h.timestamp, uint32(offset), uint32(len(record)), d.segment, h.expiresAt, valueSize})
+		}
+		offset += int64(len(record))
+		pos += size
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := dst.Sync(); err != nil {
+		return 0, err
+	}
+	return dead, dst.Close()
+}
+
+// installFile renames the complete data file tmpName over the data file and
+// switches the store to it, along with keyStore pointing into it. The caller must
+// hold mu exclusively.
+func (d *DiskStore) installFile(tmpName string, keyStore KeyDir) error {
+	// an open file cannot be renamed over on every platform, so the old file is
+	// closed first and reopened if the rename fails
+	if err := d.file.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	renameErr := os.Rename(tmpName, d.fileName)
+	if renameErr != nil {
+		os.Remove(tmpName)
+	}
+	file, err := os.OpenFile(d.fileName, os.O_RDWR|d.opts.appendFlag(), 0666)
+	if err != nil {
+		return err
+	}
+	d.file, d.writer = file, file
+	if renameErr != nil {
+		return renameErr
+	}
+	d.keyStore = keyStore
+	d.deadRecords.Store(0)
+	d.usedBytes.Store(-1)
+	d.dataStart = fileHeaderSize
+	d.version = formatVersion
+	if err := syncDir(filepath.Dir(d.fileName)); err != nil {
+		return err
+	}
+	if err := d.reopenReaders(); err != nil {
+		return err
+	}
+	if d.opts.PreallocateBytes > 0 {
+		if err := preallocate(d.file, d.opts.PreallocateBytes); err != nil {
+			return err
+		}
+	}
+	return d.writeHint()
+}
+
+// writeCompacted writes the latest record of every key to a new data file in the
+// current format version, returning the keyStore pointing into it. The records
+// are assigned to segment.
+//
+// Rather than reading the record of every key in the keyStore, which jumps all
+// over the file, the old file is streamed from start to end and a record is copied
+// only when the keyStore still points at its offset. One buffer, as large as the
+// largest record, is reused throughout, so memory use stays bounded no matter how
+// large the database is. The read-only segments, if any, are streamed the same
+// way, oldest first.
+//
+// With keepVersions above 1, Options.KeepVersions for Compact, the files are
+// streamed twice: first to count the versions of every key since it was last
+// deleted, then to copy the most recent ones. Only the latest version is pointed
+// at by the keyStore; the older ones are left for GetAt and RawRecords.
+//
+// end is where the data file is streamed up to, 0 for its current size.
+func (d *DiskStore) writeCompacted(fileName string, segmentID uint32, end int64, keepVersions int) (KeyDir, error) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	if _, err := w.Write(encodeFileHeader(formatVersion)); err != nil {
+		return nil, err
+	}
+
+	keyStore := d.newKeyDir()
+	offset := uint32(fileHeaderSize)
+	now := d.now().Unix()
+	var buf []byte
+	// versions counts the records of every key, and seen how many of them have
+	// been streamed past so far
+	var versions map[string]*versionCount
+	var seen map[string]int
+	// intact is the location of the latest intact version of every key which
+	// is not its latest, for Options.ReadRepair
+	intact := make(map[string]KeyEntry)
+	streamRecords := func(src io.ReaderAt, dataStart int64, version uint32, end int64, fn func(pos int64, h recordHeader, key string, record []byte) error) error {
+		r := bufio.NewReader(io.NewSectionReader(src, dataStart, end-dataStart))
+		headerSize := int64(recordHeaderSize(version))
+		for pos := dataStart; pos < end; {
+			h, record, err := readRecord(r, version, buf)
+			if err != nil {
+				return err
+			}
+			buf = record
+			key := string(record[headerSize : headerSize+int64(h.keySize)])
+			if err := fn(pos, h, key, record); err != nil {
+				return err
+			}
+			pos += int64(len(record))
+		}
+		return nil
+	}
+	copyLive := func(src io.ReaderAt, id uint32, dataStart int64, version uint32, end int64) error {
+		return streamRecords(src, dataStart, version, end, func(pos int64, h recordHeader, key string, record []byte) error {
+			entry, ok := d.keyStore.Get(key)
+			// expired keys are dropped along with the overwritten records
+			if !ok || entry.expired(now) {
+				return nil
+			}
+			latest := entry.segment == id && int64(entry.position) == pos
+			recordVersion := version
+			if d.opts.ReadRepair {
+				if h.isTombstone() {
+					// versions before a delete must not come back
+					delete(intact, key)
+				} else if verifyRecord(version, record) {
+					if !latest {
+						intact[key] = KeyEntry{timestamp: h.timestamp, position: uint32(pos), totalSize: uint32(len(record)), segment: id}
+					}
+				} else if latest {
+					older, ok := intact[key]
+					if !ok {
+						d.logger().Printf("caskdb: cannot repair the corrupt record of %q at offset %d, no intact older version", key, pos)
+					} else {
+						buf := make([]byte, older.totalSize)
+						_, olderVersion, err := d.readEntry(buf, older)
+						if err != nil {
+							return err
+						}
+						d.logger().Printf("caskdb: repaired the corrupt record of %q at offset %d with the version at offset %d", key, pos, older.position)
+						record, recordVersion = buf, olderVersion
+						var value string
+						h, _, value = decodeRecord(recordVersion, record)
+						if entry.valueSize, err = d.rawValueSize(h, value); err != nil {
+							return err
+						}
+						entry.timestamp, entry.expiresAt = h.timestamp, h.expiresAt
+					}
+				}
+			}
+			if versions != nil {
+				if h.isTombstone() {
+					return nil
+				}
+				seen[key]++
+				if !versions[key].keep(seen[key]-1, keepVersions) {
+					return nil
+				}
+			} else if !latest {
+				return nil
+			}
+			if c := d.opts.CompactionCodec; c != CodecNone && c != h.codec() && d.values == nil {
+				h, _, value := decodeRecord(recordVersion, record)
+				value, err := h.codec().decode(value)
+				if err == nil {
+					value, err = c.encode(value)
+				}
+				if err != nil {
+					return err
+				}
+				record = encodeRecord(formatVersion, h.withCodec(c), key, value)
+			} else if recordVersion != formatVersion {
+				_, _, value := decodeRecord(recordVersion, record)
+				record = encodeRecord(formatVersion, h, key, value)
+			}
+			if _, err := w.Write(record); err != nil {
+				return err
+			}
+			if latest {
+				keyStore.Set(key, KeyEntry{entry.timestamp, offset, uint32(len(record)), segmentID, entry.expiresAt, entry.valueSize})
+			}
+			offset += uint32(len(record))
+			return nil
+		})
+	}
+
+	if keepVersions > 1 {
+		versions, seen = make(map[string]*versionCount), make(map[string]int)
+		count := func(src io.ReaderAt, id uint32, dataStart int64, version uint32, end int64) error {
+			return streamRecords(src, dataStart, version, end, func(pos int64, h recordHeader, key string, record []byte) error {
+				count, ok := versions[key]
+				if !ok {
+					count = &versionCount{}
+					versions[key] = count
+				}
+				if h.isTombstone() {
+					count.deleted = count.total
+				} else {
+					count.total++
+				}
+				return nil
+			})
+		}
+		if err := d.streamFiles(end, count); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.streamFiles(end, copyLive); err != nil {
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	if d.opts.SortOnCompact {
+		return d.sortCompacted(fileName, keyStore)
+	}
+	return keyStore, nil
+}
+
+// sortedFileName is the temporary file sortCompacted writes the sorted records to
+func sortedFileName(fileName string) string {
+	return fileName + ".sorted"
+}
+
+// sortCompacted rewrites the compacted file fileName with its records sorted by
+// key, for Options.SortOnCompact, returning keyStore with the new offsets. The
+// versions kept for a key by Options.KeepVersions stay together, oldest first.
+// The file is streamed once to find the records of every key, and then read in
+// key order, which jumps all over it.
+func (d *DiskStore) sortCompacted(fileName string, keyStore KeyDir) (KeyDir, error) {
+	src, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+	type location struct{ pos, size int64 }
+	records := make(map[string][]location)
+	r := bufio.NewReader(io.NewSectionReader(src, fileHeaderSize, info.Size()-fileHeaderSize))
+	headerSize := recordHeaderSize(formatVersion)
+	var buf []byte
+	for pos := int64(fileHeaderSize); pos < info.Size(); {
+		h, record, err := readRecord(r, formatVersion, buf)
+		if err != nil {
+			return nil, err
+		}
+		buf = record
+		key := string(record[headerSize : headerSize+int(h.keySize)])
+		size := int64(len(record))
+		records[key] = append(records[key], location{pos, size})
+		pos += size
+	}
+
+	sortedName := sortedFileName(fileName)
+	dst, err := os.OpenFile(sortedName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer dst.Close()
+	renamed := false
+	defer func() {
+		if !renamed {
+			os.Remove(sortedName)
+		}
+	}()
+	w := bufio.NewWriter(dst)
+	if _, err := w.Write(encodeFileHeader(formatVersion)); err != nil {
+		return nil, err
+	}
+	sorted := d.newKeyDir()
+	offset := uint32(fileHeaderSize)
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		entry, live := keyStore.Get(key)
+		for _, loc := range records[key] {
+			if int64(cap(buf)) < loc.size {
+				buf = make([]byte, loc.size)
+			}
+			record := buf[:loc.size]
+			if _, err := src.ReadAt(record, loc.pos); err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(record); err != nil {
+				return nil, err
+			}
+			if live && int64(entry.position) == loc.pos {
+				entry.position = offset
+				sorted.Set(key, entry)
+			}
+			offset += uint32(loc.size)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := dst.Sync(); err != nil {
+		return nil, err
+	}
+	if err := dst.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(sortedName, fileName); err != nil {
+		return nil, err
+	}
+	renamed = true
+	return sorted, nil
+}
+
+// versionCount counts the versions of a key, for Options.KeepVersions
+type versionCount struct {
+	// total is the number of records setting the key, and deleted how many of
+	// them came before its last tombstone
+	total, deleted int
+}
+
+// keep reports whether the version at index i, counting from the oldest, is
+// among the n most recent since the key was last deleted
+func (c *versionCount) keep(i int, n int) bool {
+	return i >= c.deleted && i >= c.total-n
+}
+
+// streamFiles calls fn with the records of every read-only segment, oldest first,
+// and then the data file up to end, 0 for its current size
+func (d *DiskStore) streamFiles(end int64, fn func(src io.ReaderAt, id uint32, dataStart int64, version uint32, end int64) error) error {
+	for _, id := range d.segmentIDs() {
+		seg := d.segments[id]
+		src, err := d.acquireSegment(seg)
+		if err != nil {
+			return err
+		}
+		err = fn(src, id, seg.dataStart, seg.version, seg.size)
+		d.releaseSegment(seg)
+		if err != nil {
+			return err
+		}
+	}
+	if end == 0 {
+		info, err := d.file.Stat()
+		if err != nil {
+			return err
+		}
+		end = info.Size()
+	}
+	return fn(d.file, d.segment, d.dataStart, d.version, end)
+}
+
+// Shrink reclaims the space taken by overwritten records by moving the live records
+// towards the front of the data file and truncating it, without needing a second
+// file. It is meant for disks too full to hold a copy of the database.
+//
+// Shrink is not crash safe: records are overwritten in place, so a crash halfway
+// through leaves the file corrupt. This is why it has to be explicitly allowed with
+// Options.AllowUnsafeInPlace.
+//
+// Shrink is not supported by stores opened with Open, whose sealed segments may
+// hold older records of keys deleted in the active one.
+func (d *DiskStore) Shrink() error {
+	if d.dir != "" {
+		return errors.New("caskdb: Shrink is not supported by stores opened with Open")
+	}
+	if !d.opts.AllowUnsafeInPlace {
+		return ErrUnsafeInPlace
+	}
+	if !d.compacting.CompareAndSwap(false, true) {
+		return ErrCompactionInProgress
+	}
+	defer d.compacting.Store(false)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.deferred {
+		return ErrIndexNotBuilt
+	}
+
+	// the store's handle is opened with O_APPEND, which makes positioned writes
+	// impossible
+	file, err := os.OpenFile(d.fileName, os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	keys := make([]string, 0, d.keyStore.Len())
+	entries := make(map[string]KeyEntry, d.keyStore.Len())
+	d.keyStore.Range(func(key string, entry KeyEntry) bool {
+		keys = append(keys, key)
+		entries[key] = entry
+		return true
+	})
+	sort.Slice(keys, func(i, j int) bool {
+		return entries[keys[i]].position < entries[keys[j]].position
+	})
+
+	// live records only ever move towards the front, so a record is always read
+	// before the space it occupies is overwritten
+	offset := uint32(d.dataStart)
+	for _, key := range keys {
+		entry := entries[key]
+		if entry.position != offset {
+			buf := make([]byte, entry.totalSize)
+			if _, err := d.file.ReadAt(buf, int64(entry.position)); err != nil {
+				return err
+			}
+			if _, err := file.WriteAt(buf, int64(offset)); err != nil {
+				return err
+			}
+			entry.position = offset
+			d.keyStore.Set(key, entry)
+		}
+		offset += entry.totalSize
+	}
+	if err := file.Truncate(int64(offset)); err != nil {
+		return err
+	}
+	d.deadRecords.Store(0)
+	d.usedBytes.Store(-1)
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	// the old hint points at offsets which no longer exist
+	return d.writeHint()
+}
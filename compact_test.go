@@ -0,0 +1,835 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+func TestDiskStore_Shrink(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{AllowUnsafeInPlace: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"hamlet":               "shakespeare",
+		"dune":                 "frank herbert",
+	}
+	for i := 0; i < 3; i++ {
+		for key, val := range tests {
+			store.Set(key, val)
+		}
+	}
+	before, _ := os.Stat(fileName)
+
+	// note that a crash during Shrink would corrupt the file, which is why the
+	// test has to opt in with AllowUnsafeInPlace
+	if err := store.Shrink(); err != nil {
+		t.Fatalf("Shrink() error = %v", err)
+	}
+	after, _ := os.Stat(fileName)
+	if after.Size() >= before.Size() {
+		t.Errorf("file size = %v, want less than %v", after.Size(), before.Size())
+	}
+	for key, val := range tests {
+		if store.Get(key) != val {
+			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		}
+	}
+	store.Set("war and peace", "tolstoy")
+	tests["war and peace"] = "tolstoy"
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range tests {
+		if store.Get(key) != val {
+			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		}
+	}
+}
+
+func TestDiskStore_ShrinkNotAllowed(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	if err := store.Shrink(); !errors.Is(err, ErrUnsafeInPlace) {
+		t.Errorf("Shrink() error = %v, want %v", err, ErrUnsafeInPlace)
+	}
+}
+
+func TestDiskStore_Compact(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"hamlet":               "shakespeare",
+		"dune":                 "frank herbert",
+	}
+	for i := 0; i < 3; i++ {
+		for key, val := range tests {
+			store.Set(key, val)
+		}
+	}
+	before, _ := os.Stat(fileName)
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	after, _ := os.Stat(fileName)
+	if after.Size() >= before.Size() {
+		t.Errorf("file size = %v, want less than %v", after.Size(), before.Size())
+	}
+	if stats, _ := store.Stats(); stats.DeadBytes != 0 {
+		t.Errorf("DeadBytes = %v, want %v", stats.DeadBytes, 0)
+	}
+	if _, err := os.Stat(compactFileName(fileName)); !os.IsNotExist(err) {
+		t.Errorf("temporary compaction file was left behind")
+	}
+	store.Set("war and peace", "tolstoy")
+	tests["war and peace"] = "tolstoy"
+	for key, val := range tests {
+		if store.Get(key) != val {
+			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		}
+	}
+	store.Close()
+
+	os.Remove(hintFileName(fileName))
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range tests {
+		if store.Get(key) != val {
+			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		}
+	}
+}
+
+func TestDiskStore_CompactTempDir(t *testing.T) {
+	defer func() { link = os.Link }()
+	for _, crossDevice := range []bool{false, true} {
+		if crossDevice {
+			link = func(from, to string) error {
+				return &os.LinkError{Op: "link", Old: from, New: to, Err: syscall.EXDEV}
+			}
+		}
+		fileName := filepath.Join(t.TempDir(), "test.db")
+		tempDir := t.TempDir()
+		store, err := NewDiskStoreWithOptions(fileName, Options{TempDir: tempDir, SortOnCompact: true})
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		store.Set("hamlet", "bacon")
+		store.Set("hamlet", "shakespeare")
+		store.Set("dune", "frank herbert")
+		if err := store.Compact(); err != nil {
+			t.Fatalf("Compact() error = %v", err)
+		}
+		if stats, _ := store.Stats(); stats.DeadBytes != 0 {
+			t.Errorf("DeadBytes = %v, want %v", stats.DeadBytes, 0)
+		}
+		for _, dir := range []string{tempDir, filepath.Dir(fileName)} {
+			if leftovers, _ := filepath.Glob(filepath.Join(dir, "*.compact*")); len(leftovers) != 0 {
+				t.Errorf("temporary compaction files %v were left behind", leftovers)
+			}
+		}
+		if err := store.ReplaceAll(map[string]string{"anna karenina": "tolstoy", "hamlet": "shakespeare"}); err != nil {
+			t.Fatalf("ReplaceAll() error = %v", err)
+		}
+		store.Close()
+
+		os.Remove(hintFileName(fileName))
+		store, err = NewDiskStore(fileName)
+		if err != nil {
+			t.Fatalf("failed to open disk store: %v", err)
+		}
+		for key, val := range map[string]string{"anna karenina": "tolstoy", "hamlet": "shakespeare", "dune": ""} {
+			if store.Get(key) != val {
+				t.Errorf("Get() = %v, want %v", store.Get(key), val)
+			}
+		}
+		store.Close()
+	}
+}
+
+func TestDiskStore_ConcurrentCompaction(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{ConcurrentCompaction: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		store.Set(fmt.Sprintf("key%d", i%100), fmt.Sprintf("old%d", i))
+	}
+
+	const writers = 4
+	stop := make(chan struct{})
+	written := make([]int, writers)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("writer%d-%d", w, i)
+				if err := store.Set(key, key); err != nil {
+					t.Errorf("Set() error = %v", err)
+					return
+				}
+				if i%2 == 1 {
+					if err := store.Delete(fmt.Sprintf("writer%d-%d", w, i-1)); err != nil {
+						t.Errorf("Delete() error = %v", err)
+						return
+					}
+				}
+				store.Set(fmt.Sprintf("key%d", i%100), key)
+				written[w] = i + 1
+			}
+		}(w)
+	}
+	for i := 0; i < 5; i++ {
+		if err := store.Compact(); err != nil {
+			t.Errorf("Compact() error = %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	check := func(store *DiskStore) {
+		for w := 0; w < writers; w++ {
+			for i := 0; i < written[w]; i++ {
+				key := fmt.Sprintf("writer%d-%d", w, i)
+				value, ok := store.Lookup(key)
+				deleted := i%2 == 0 && i+1 < written[w]
+				if deleted && ok {
+					t.Fatalf("Lookup(%q) found a deleted key", key)
+				}
+				if !deleted && value != key {
+					t.Fatalf("Lookup(%q) = %q, %v, want %q, %v", key, value, ok, key, true)
+				}
+			}
+		}
+	}
+	check(store)
+	store.Close()
+	os.Remove(hintFileName(fileName))
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	check(store)
+}
+
+func TestDiskStore_CompactIfNeeded(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Set("hamlet", "shakespeare")
+
+	stats, _ := store.Stats()
+	compacted, err := store.CompactIfNeeded(stats.DeadRatio() + 0.01)
+	if err != nil || compacted {
+		t.Errorf("CompactIfNeeded() = %v, %v, want false, nil", compacted, err)
+	}
+	if after, _ := store.Stats(); after.TotalBytes != stats.TotalBytes {
+		t.Errorf("TotalBytes = %v, want %v", after.TotalBytes, stats.TotalBytes)
+	}
+
+	compacted, err = store.CompactIfNeeded(stats.DeadRatio() - 0.01)
+	if err != nil || !compacted {
+		t.Errorf("CompactIfNeeded() = %v, %v, want true, nil", compacted, err)
+	}
+	if after, _ := store.Stats(); after.DeadBytes != 0 {
+		t.Errorf("DeadBytes = %v, want %v", after.DeadBytes, 0)
+	}
+	if store.Get("hamlet") != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", store.Get("hamlet"), "shakespeare")
+	}
+}
+
+func TestDiskStore_CompactMaxStaleRecords(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{MaxStaleRecords: 50}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	// the large value keeps the ratio of dead bytes low
+	store.Set("war and peace", strings.Repeat("tolstoy", 10000))
+	store.Set("hamlet", "shakespeare")
+	for i := range 48 {
+		store.Set("counter", fmt.Sprint(i))
+	}
+	crash(t, store)
+
+	// the scan on open counts the dead records written before
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	store.Set("counter", "48")
+	stats, _ := store.Stats()
+	if stats.DeadRecords != 48 {
+		t.Errorf("DeadRecords = %v, want %v", stats.DeadRecords, 48)
+	}
+
+	// the hint written by a clean Close carries the count over
+	store.Close()
+	store, result, err := NewDiskStoreWithResult(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if !result.HintUsed {
+		t.Errorf("OpenResult.HintUsed = false, want the hint used")
+	}
+	if stats, _ := store.Stats(); stats.DeadRecords != 48 {
+		t.Errorf("DeadRecords = %v after reopening, want %v", stats.DeadRecords, 48)
+	}
+	if compacted, err := store.CompactIfNeeded(0.5); err != nil || compacted {
+		t.Errorf("CompactIfNeeded() = %v, %v, want false, nil", compacted, err)
+	}
+
+	// the record of hamlet and its tombstone make it 50
+	store.Delete("hamlet")
+	if compacted, err := store.CompactIfNeeded(0.5); err != nil || !compacted {
+		t.Errorf("CompactIfNeeded() = %v, %v, want true, nil", compacted, err)
+	}
+	if stats, _ := store.Stats(); stats.DeadRecords != 0 || stats.DeadBytes != 0 {
+		t.Errorf("DeadRecords = %v and DeadBytes = %v after compaction, want 0", stats.DeadRecords, stats.DeadBytes)
+	}
+	if got := store.Get("counter"); got != "48" {
+		t.Errorf("Get() = %v, want %v", got, "48")
+	}
+}
+
+func TestDiskStore_CompactLargeValues(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	const keys, valueSize = 20, 64 << 10
+	for version := 0; version < 3; version++ {
+		for i := 0; i < keys; i++ {
+			store.Set(fmt.Sprintf("key-%d", i), strings.Repeat(fmt.Sprint(version), valueSize))
+		}
+	}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	// the live data alone is over a megabyte, while compaction only ever holds a
+	// single record in memory
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4*valueSize {
+		t.Errorf("Compact() allocated %v bytes, want at most %v", allocated, 4*valueSize)
+	}
+
+	for i := 0; i < keys; i++ {
+		if val := store.Get(fmt.Sprintf("key-%d", i)); val != strings.Repeat("2", valueSize) {
+			t.Errorf("Get() returned a value of the wrong version")
+		}
+	}
+	if stats, _ := store.Stats(); stats.Keys != keys || stats.DeadBytes != 0 {
+		t.Errorf("Stats() = %+v, want %v keys and no dead bytes", stats, keys)
+	}
+}
+
+func TestDiskStore_CompactOnClose(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{CompactOnClose: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"hamlet":               "shakespeare",
+	}
+	for i := 0; i < 3; i++ {
+		for key, val := range tests {
+			store.Set(key, val)
+		}
+	}
+	before, _ := os.Stat(fileName)
+	if !store.Close() {
+		t.Fatalf("Close() = false, want true")
+	}
+	after, _ := os.Stat(fileName)
+	if after.Size() >= before.Size() {
+		t.Errorf("file size = %v, want less than %v", after.Size(), before.Size())
+	}
+
+	store, result, err := NewDiskStoreWithResult(fileName, Options{})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if !result.HintUsed {
+		t.Errorf("HintUsed = false, want true")
+	}
+	for key, val := range tests {
+		if store.Get(key) != val {
+			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		}
+	}
+}
+
+func TestDiskStore_CompactOnCloseInProgress(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{CompactOnClose: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		store.Set("hamlet", "shakespeare")
+	}
+	before, _ := os.Stat(fileName)
+	// as if a Compact were still running
+	store.compacting.Store(true)
+	if !store.Close() {
+		t.Fatalf("Close() = false, want true")
+	}
+	after, _ := os.Stat(fileName)
+	if after.Size() != before.Size() {
+		t.Errorf("file size = %v, want %v", after.Size(), before.Size())
+	}
+}
+
+func TestDiskStore_CompactKeepVersions(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{KeepVersions: 2})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 1; i <= 5; i++ {
+		store.Set("hamlet", fmt.Sprintf("draft %d", i))
+	}
+	store.Set("othello", "shakespeare")
+	// a deleted key loses every version, even when set again afterwards
+	store.Set("dune", "frank herbert")
+	store.Delete("dune")
+	store.Set("dune", "brian herbert")
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	versions := map[string][]string{}
+	it := store.RawRecords()
+	for it.Next() {
+		record := it.Record()
+		versions[record.Key] = append(versions[record.Key], record.Value)
+		if key, _, err := store.GetAt(record.Position); err != nil || key != record.Key {
+			t.Errorf("GetAt(%v) = %v, %v, want %v", record.Position, key, err, record.Key)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("RawRecords() error = %v", err)
+	}
+	want := map[string][]string{
+		"hamlet":  {"draft 4", "draft 5"},
+		"othello": {"shakespeare"},
+		"dune":    {"brian herbert"},
+	}
+	if fmt.Sprint(versions) != fmt.Sprint(want) {
+		t.Errorf("versions after Compact() = %v, want %v", versions, want)
+	}
+	if val := store.Get("hamlet"); val != "draft 5" {
+		t.Errorf("Get() = %v, want draft 5", val)
+	}
+	// compacting again keeps the same versions
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if stats, _ := store.Stats(); stats.Keys != 3 {
+		t.Errorf("Stats().Keys = %v, want 3", stats.Keys)
+	}
+}
+
+func TestDiskStore_Purge(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprintf("key-%d", i), "draft")
+	}
+	for i := 0; i < 90; i++ {
+		store.Delete(fmt.Sprintf("key-%d", i))
+	}
+	store.Set("hamlet", "draft")
+	store.Set("hamlet", "shakespeare")
+	store.Delete("key-99")
+	store.Set("key-99", "again")
+
+	before, _ := os.Stat(fileName)
+	if err := store.Purge(); err != nil {
+		t.Fatalf("Purge() error = %v", err)
+	}
+	after, _ := os.Stat(fileName)
+	if after.Size() >= before.Size() {
+		t.Errorf("file size = %v, want less than %v", after.Size(), before.Size())
+	}
+	versions := map[string][]string{}
+	it := store.RawRecords()
+	for it.Next() {
+		record := it.Record()
+		if record.Deleted {
+			t.Errorf("Purge() kept the tombstone of %q", record.Key)
+		}
+		versions[record.Key] = append(versions[record.Key], record.Value)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("RawRecords() error = %v", err)
+	}
+	want := map[string][]string{"hamlet": {"draft", "shakespeare"}, "key-99": {"again"}}
+	for i := 90; i < 99; i++ {
+		want[fmt.Sprintf("key-%d", i)] = []string{"draft"}
+	}
+	if fmt.Sprint(versions) != fmt.Sprint(want) {
+		t.Errorf("records after Purge() = %v, want %v", versions, want)
+	}
+	if val := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	if _, ok := store.Lookup("key-0"); ok {
+		t.Errorf("Lookup() found a purged key")
+	}
+}
+
+func TestDiskStore_CompactRange(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for _, key := range []string{"apple", "banana", "cherry", "date"} {
+		store.Set(key, "draft")
+		store.Set(key, "final")
+	}
+	store.Set("blueberry", "draft")
+	store.Delete("blueberry")
+	store.Delete("date")
+
+	if err := store.CompactRange("b", "d"); err != nil {
+		t.Fatalf("CompactRange() error = %v", err)
+	}
+	versions := map[string][]string{}
+	it := store.RawRecords()
+	for it.Next() {
+		record := it.Record()
+		value := record.Value
+		if record.Deleted {
+			value = "<deleted>"
+		}
+		versions[record.Key] = append(versions[record.Key], value)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("RawRecords() error = %v", err)
+	}
+	want := map[string][]string{
+		"apple":  {"draft", "final"},
+		"banana": {"final"},
+		"cherry": {"final"},
+		"date":   {"draft", "final", "<deleted>"},
+	}
+	if fmt.Sprint(versions) != fmt.Sprint(want) {
+		t.Errorf("records after CompactRange() = %v, want %v", versions, want)
+	}
+	for key, want := range map[string]string{"apple": "final", "banana": "final", "cherry": "final"} {
+		if val := store.Get(key); val != want {
+			t.Errorf("Get(%q) = %v, want %v", key, val, want)
+		}
+	}
+	if _, ok := store.Lookup("date"); ok {
+		t.Errorf("Lookup() found a deleted key")
+	}
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	if stats.DeadRecords != 4 {
+		t.Errorf("DeadRecords = %v, want %v", stats.DeadRecords, 4)
+	}
+}
+
+func TestDiskStore_CompactInProgress(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{AllowUnsafeInPlace: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprintf("book-%d", i%10), fmt.Sprint(i))
+	}
+
+	// holding the lock keeps the first compaction waiting, so the second one is
+	// guaranteed to overlap it
+	store.mu.RLock()
+	first := make(chan error)
+	go func() { first <- store.Compact() }()
+	for !store.compacting.Load() {
+		runtime.Gosched()
+	}
+	if err := store.Compact(); !errors.Is(err, ErrCompactionInProgress) {
+		t.Errorf("Compact() error = %v, want %v", err, ErrCompactionInProgress)
+	}
+	if err := store.Shrink(); !errors.Is(err, ErrCompactionInProgress) {
+		t.Errorf("Shrink() error = %v, want %v", err, ErrCompactionInProgress)
+	}
+	store.mu.RUnlock()
+	if err := <-first; err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if s, _ := store.Stats(); s.Compacting || s.Keys != 10 || s.DeadBytes != 0 {
+		t.Errorf("Stats() = %+v, want 10 keys, no dead bytes and no compaction", s)
+	}
+	for i := 90; i < 100; i++ {
+		if val := store.Get(fmt.Sprintf("book-%d", i%10)); val != fmt.Sprint(i) {
+			t.Errorf("Get() = %v, want %v", val, i)
+		}
+	}
+}
+
+func TestDiskStore_CompactReadRepair(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	var logs strings.Builder
+	store, err := NewDiskStoreWithOptions(fileName, Options{ReadRepair: true, Logger: log.New(&logs, "", 0)})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("hamlet", "bacon")
+	store.Set("othello", "shakespeare")
+	store.Set("othello", "marlowe")
+	store.Delete("othello")
+	store.Set("othello", "iago")
+	store.Set("dune", "frank herbert")
+
+	// flip the last byte of the value of the latest records
+	file, err := os.OpenFile(fileName, os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"hamlet", "othello"} {
+		entry, _ := store.keyStore.Get(key)
+		file.WriteAt([]byte{'!'}, int64(entry.position+entry.totalSize-1))
+	}
+	file.Close()
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if val := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want the older intact shakespeare", val)
+	}
+	if val := store.Get("dune"); val != "frank herbert" {
+		t.Errorf("Get() = %v, want frank herbert", val)
+	}
+	// the only older version of othello was deleted, so there is nothing to
+	// repair it with
+	if val := store.Get("othello"); val != "iag!" {
+		t.Errorf("Get() = %v, want the corrupt record kept", val)
+	}
+	if !strings.Contains(logs.String(), `repaired the corrupt record of "hamlet"`) ||
+		!strings.Contains(logs.String(), `cannot repair the corrupt record of "othello"`) {
+		t.Errorf("logs = %q, want the repair of hamlet and the failure for othello", logs.String())
+	}
+}
+
+func TestDiskStore_CompactLeftover(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "bacon")
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	crash(t, store)
+	// a crash halfway through compacting leaves a partial new file behind
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("failed to read data file: %v", err)
+	}
+	tmpName := compactFileName(fileName)
+	if err := os.WriteFile(tmpName, data[:len(data)/2], 0666); err != nil {
+		t.Fatalf("failed to write compaction file: %v", err)
+	}
+
+	var logs strings.Builder
+	store, err = NewDiskStoreWithOptions(fileName, Options{Logger: log.New(&logs, "", 0)})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := os.Stat(tmpName); !os.IsNotExist(err) {
+		t.Errorf("leftover compaction file was not removed")
+	}
+	if !strings.Contains(logs.String(), "interrupted compaction") {
+		t.Errorf("log = %q, want the removal of the leftover", logs.String())
+	}
+	if got := store.Get("hamlet"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", got, "shakespeare")
+	}
+	if got := store.Get("dune"); got != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", got, "frank herbert")
+	}
+	if err := store.Compact(); err != nil {
+		t.Errorf("Compact() error = %v", err)
+	}
+}
+
+func TestOpenCompactLeftover(t *testing.T) {
+	dir := t.TempDir()
+	writeSegment(t, dir, 1, [][2]*string{setRecord("hamlet", "shakespeare")})
+	writeSegment(t, dir, 2, [][2]*string{setRecord("dune", "frank herbert")})
+	tmpName := compactFileName(segmentFileName(dir, 3))
+	if err := os.WriteFile(tmpName, []byte("partial"), 0666); err != nil {
+		t.Fatalf("failed to write compaction file: %v", err)
+	}
+	store, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer store.Close()
+	if _, err := os.Stat(tmpName); !os.IsNotExist(err) {
+		t.Errorf("leftover compaction file was not removed")
+	}
+	if got := store.Get("hamlet"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", got, "shakespeare")
+	}
+}
+
+func TestOpenCompactLeftoverSharedTempDir(t *testing.T) {
+	tempDir := t.TempDir()
+	dirs := []string{t.TempDir(), t.TempDir()}
+	var tmpNames []string
+	for _, dir := range dirs {
+		writeSegment(t, dir, 1, [][2]*string{setRecord("hamlet", "shakespeare")})
+		store := &DiskStore{dir: dir, opts: Options{TempDir: tempDir}}
+		tmpName := store.compactTempName(segmentFileName(dir, 2))
+		if err := os.WriteFile(tmpName, []byte("partial"), 0666); err != nil {
+			t.Fatalf("failed to write compaction file: %v", err)
+		}
+		tmpNames = append(tmpNames, tmpName)
+	}
+	if tmpNames[0] == tmpNames[1] {
+		t.Fatalf("stores sharing a TempDir both compact to %s", tmpNames[0])
+	}
+
+	store, err := Open(dirs[0], Options{TempDir: tempDir})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer store.Close()
+	if _, err := os.Stat(tmpNames[0]); !os.IsNotExist(err) {
+		t.Errorf("leftover compaction file was not removed")
+	}
+	if _, err := os.Stat(tmpNames[1]); err != nil {
+		t.Errorf("compaction file of another store was removed: %v", err)
+	}
+
+	// while the store is open, its temporary files may be in use
+	if err := os.WriteFile(tmpNames[0], []byte("partial"), 0666); err != nil {
+		t.Fatalf("failed to write compaction file: %v", err)
+	}
+	other, err := Open(dirs[0], Options{TempDir: tempDir})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer other.Close()
+	if _, err := os.Stat(tmpNames[0]); err != nil {
+		t.Errorf("compaction file of an open store was removed: %v", err)
+	}
+}
+
+func TestDiskStore_SortOnCompact(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{SortOnCompact: true, KeepVersions: 2}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	want := make(map[string]string)
+	for _, i := range rand.New(rand.NewSource(1)).Perm(100) {
+		key := fmt.Sprintf("key-%03d", i)
+		store.Set(key, "old")
+		want[key] = strings.Repeat("v", i)
+		store.Set(key, want[key])
+	}
+	store.Delete("key-050")
+	delete(want, "key-050")
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+
+	var keys []string
+	it := store.RawRecords()
+	for it.Next() {
+		keys = append(keys, it.Record().Key)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("RawRecords() error = %v", err)
+	}
+	if !slices.IsSorted(keys) {
+		t.Errorf("records are not sorted by key: %v", keys)
+	}
+	// both versions of every key are kept
+	if len(keys) != 2*len(want) {
+		t.Errorf("compacted file has %d records, want %d", len(keys), 2*len(want))
+	}
+	for key, value := range want {
+		if got := store.Get(key); got != value {
+			t.Errorf("Get(%q) = %q, want %q", key, got, value)
+		}
+	}
+	if _, err := os.Stat(sortedFileName(compactFileName(fileName))); !os.IsNotExist(err) {
+		t.Errorf("temporary sorted file was left behind")
+	}
+}
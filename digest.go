@@ -0,0 +1,101 @@
+package caskdb
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// Digest returns a SHA-256 hash of the live key-value pairs of the store, for
+// checking whether two replicas hold the same data. The pairs are hashed in
+// key order, each as the length of the key and the key, then the length of the
+// value and the value, so the digest only depends on the live contents: the order
+// of the writes, overwritten records, compression and timestamps make no
+// difference. Expired keys are left out.
+//
+// Every value is read from the disk, and writes block until the digest is done,
+// so that it describes a single state of the store. Reads carry on.
+func (d *DiskStore) Digest() ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.deferred {
+		return nil, ErrIndexNotBuilt
+	}
+	for i := range d.shards {
+		d.shards[i].Lock()
+		defer d.shards[i].Unlock()
+	}
+
+	keys := d.sortedKeys("")
+	hash := sha256.New()
+	var buf []byte
+	for _, key := range keys {
+		_, value, ok, err := d.getRecord(key)
+		if err != nil {
+			return nil, err
+		}
+		// the key may have expired since the keys were listed
+		if !ok {
+			continue
+		}
+		buf = binary.AppendUvarint(buf[:0], uint64(len(key)))
+		buf = append(buf, key...)
+		buf = binary.AppendUvarint(buf, uint64(len(value)))
+		hash.Write(buf)
+		hash.Write([]byte(value))
+	}
+	return hash.Sum(nil), nil
+}
+
+// Equal reports whether d and other hold the same live key-value pairs, reading
+// the values from the disk. When they differ, it returns false with an error
+// wrapping ErrNotEqual which names the first key, in sorted order, they differ on;
+// other errors are failures to read the stores. It is meant for tests of
+// replication and the like: unlike Digest, it tells what differs.
+//
+// The stores are not locked for the whole comparison, so writes running meanwhile
+// may or may not be seen.
+func (d *DiskStore) Equal(other *DiskStore) (bool, error) {
+	keys, err := d.liveKeys()
+	if err != nil {
+		return false, err
+	}
+	if d == other {
+		return true, nil
+	}
+	otherKeys, err := other.liveKeys()
+	if err != nil {
+		return false, err
+	}
+
+	for i := 0; i < len(keys) || i < len(otherKeys); i++ {
+		switch {
+		case i == len(otherKeys) || i < len(keys) && keys[i] < otherKeys[i]:
+			return false, fmt.Errorf("%w: %q is only in %s", ErrNotEqual, keys[i], d.fileName)
+		case i == len(keys) || keys[i] > otherKeys[i]:
+			return false, fmt.Errorf("%w: %q is only in %s", ErrNotEqual, otherKeys[i], other.fileName)
+		}
+		value, err := d.Fetch(keys[i])
+		if err != nil {
+			return false, err
+		}
+		otherValue, err := other.Fetch(keys[i])
+		if err != nil {
+			return false, err
+		}
+		if value != otherValue {
+			return false, fmt.Errorf("%w: the values of %q differ", ErrNotEqual, keys[i])
+		}
+	}
+	return true, nil
+}
+
+// liveKeys returns the live keys of the store for Equal, in sorted order
+func (d *DiskStore) liveKeys() ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.deferred {
+		return nil, ErrIndexNotBuilt
+	}
+	return d.sortedKeys(""), nil
+}
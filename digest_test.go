@@ -0,0 +1,104 @@
+package caskdb
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_Digest(t *testing.T) {
+	dir := t.TempDir()
+	first, err := NewDiskStore(filepath.Join(dir, "first.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer first.Close()
+	second, err := NewDiskStoreWithOptions(filepath.Join(dir, "second.db"), Options{Codec: CodecFlate})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer second.Close()
+
+	// the same final state, reached through different writes
+	first.Set("hamlet", "shakespeare")
+	first.Set("dune", "frank herbert")
+	first.Set("othello", "shakespeare")
+	first.Delete("othello")
+	second.Set("dune", "herbert")
+	second.Set("anna karenina", "tolstoy")
+	second.Set("hamlet", "shakespeare")
+	second.Set("dune", "frank herbert")
+	second.Delete("anna karenina")
+
+	digest := func(store *DiskStore) []byte {
+		t.Helper()
+		d, err := store.Digest()
+		if err != nil {
+			t.Fatalf("Digest() error = %v", err)
+		}
+		return d
+	}
+	if a, b := digest(first), digest(second); !bytes.Equal(a, b) {
+		t.Errorf("Digest() = %x and %x, want equal digests", a, b)
+	}
+	if err := second.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if a, b := digest(first), digest(second); !bytes.Equal(a, b) {
+		t.Errorf("Digest() after Compact() = %x and %x, want equal digests", a, b)
+	}
+
+	second.Set("dune", "frank herbert!")
+	if a, b := digest(first), digest(second); bytes.Equal(a, b) {
+		t.Errorf("Digest() = %x for both stores after changing a value", a)
+	}
+	second.Set("dune", "frank herbert")
+	second.Set("", "")
+	if a, b := digest(first), digest(second); bytes.Equal(a, b) {
+		t.Errorf("Digest() = %x for both stores after adding a key", a)
+	}
+}
+
+func TestDiskStore_Equal(t *testing.T) {
+	dir := t.TempDir()
+	first, err := NewDiskStore(filepath.Join(dir, "first.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer first.Close()
+	second, err := NewDiskStore(filepath.Join(dir, "second.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer second.Close()
+	first.Set("hamlet", "shakespeare")
+	first.Set("dune", "frank herbert")
+	second.Set("dune", "herbert")
+	second.Set("hamlet", "shakespeare")
+	second.Set("othello", "shakespeare")
+	second.Delete("othello")
+	second.Set("dune", "frank herbert")
+
+	if equal, err := first.Equal(second); !equal || err != nil {
+		t.Errorf("Equal() = %v, %v, want true, nil", equal, err)
+	}
+	if equal, err := first.Equal(first); !equal || err != nil {
+		t.Errorf("Equal() with itself = %v, %v, want true, nil", equal, err)
+	}
+
+	second.Set("dune", "frank herbert!")
+	equal, err := first.Equal(second)
+	if equal || !errors.Is(err, ErrNotEqual) || !strings.Contains(err.Error(), `"dune"`) {
+		t.Errorf("Equal() = %v, %v, want false and the values of dune differing", equal, err)
+	}
+	second.Set("dune", "frank herbert")
+	second.Set("anna karenina", "tolstoy")
+	for _, stores := range [][2]*DiskStore{{first, second}, {second, first}} {
+		equal, err := stores[0].Equal(stores[1])
+		if equal || !errors.Is(err, ErrNotEqual) || !strings.Contains(err.Error(), `"anna karenina" is only in `+second.fileName) {
+			t.Errorf("Equal() = %v, %v, want false and anna karenina only in the second store", equal, err)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package caskdb
+
+import "os"
+
+// syncDir fsyncs the directory dir. Creating or renaming a file only changes its
+// directory, so the directory has to be synced as well for the new name to survive
+// a crash. It is a variable so that tests can observe the calls.
+var syncDir = func(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
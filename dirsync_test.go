@@ -0,0 +1,46 @@
+//go:build !windows
+
+package caskdb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_SyncDir(t *testing.T) {
+	var synced []string
+	defer func(orig func(string) error) { syncDir = orig }(syncDir)
+	syncDir = func(dir string) error {
+		synced = append(synced, dir)
+		return nil
+	}
+
+	dir := t.TempDir()
+	store, err := NewDiskStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if len(synced) != 1 || synced[0] != dir {
+		t.Errorf("synced directories = %v, want %v after create", synced, []string{dir})
+	}
+
+	store.Set("hamlet", "shakespeare")
+	store.Set("hamlet", "shakespeare")
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if len(synced) != 2 || synced[1] != dir {
+		t.Errorf("synced directories = %v, want %v synced again after the rename", synced, dir)
+	}
+
+	// opening an existing file creates nothing
+	store.Close()
+	store, err = NewDiskStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if len(synced) != 2 {
+		t.Errorf("synced directories = %v, want no sync when opening an existing file", synced)
+	}
+}
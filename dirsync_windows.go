@@ -0,0 +1,7 @@
+package caskdb
+
+// syncDir is a no-op on Windows, where directories cannot be synced and renames are
+// made durable by the file system itself.
+var syncDir = func(dir string) error {
+	return nil
+}
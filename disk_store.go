@@ -1,11 +1,23 @@
 package caskdb
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"io"
-	"io/fs"
 	"log"
+	"maps"
+	"math"
 	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -49,120 +61,1417 @@ import (
 //		store, _ := NewDiskStore("books.db")
 //	   	store.Set("othello", "shakespeare")
 //	   	author := store.Get("othello")
+//
+// DiskStore is safe for concurrent use. Writes to keys in different lock shards
+// (see Options.LockShards) proceed in parallel, only serialising for the short
+// moment it takes to append their record to the file.
 type DiskStore struct {
-	file *os.File
-	keyStore map[string]KeyEntry
+	file     *os.File
+	fileName string
+	keyStore KeyDir
+	opts     Options
+	// values is the values file, only used with Options.SeparateValues
+	values *os.File
+	// dedup maps the size and checksum of the values written to the values file
+	// to their location, only used with Options.Dedup
+	dedup   map[dedupKey]string
+	dedupMu sync.Mutex
+	// dir is the directory of the segments when opened with Open, and segment the
+	// id of the data file, which is the active segment. segments are the older,
+	// read-only segments. In single file mode segment is 0 and there are no
+	// read-only segments.
+	dir        string
+	segment    uint32
+	segments   map[uint32]*segment
+	segmentLRU segmentLRU
+	// readers are the read handles on the data file, only used with
+	// Options.ReadHandles
+	readers *readPool
+	// dataStart is the offset of the first record, right after the file header
+	dataStart int64
+	// version is the format version of the records in the data file
+	version uint32
+	// writer is where records are appended, which is the data file except in
+	// tests injecting failures
+	writer appendFile
+
+	// mu guards the layout of the data file. Reads and writes hold it shared,
+	// while operations that move records around, like Shrink, hold it exclusively
+	mu sync.RWMutex
+	// shards serialise writes to the keys hashed to them
+	shards []sync.Mutex
+	// appendMu serialises appends, so every record gets its own range of bytes
+	appendMu sync.Mutex
+	// lastTimestamp is the latest timestamp of the records in the files of the
+	// store when it was opened, tombstones included, or given to a record since,
+	// see Options.MonotonicTimestamps
+	lastTimestamp atomic.Uint32
+	// unsynced counts the writes since the last sync, only used with
+	// Options.SyncEveryN
+	unsynced atomic.Int64
+	// usedBytes is the size of the files of the store for Options.MaxTotalSize,
+	// counted up by every append and -1 once anything else changes the files,
+	// until it is counted afresh. It only changes under appendMu.
+	usedBytes atomic.Int64
+
+	cleanShutdown bool
+	compacting    atomic.Bool
+	// deadRecords counts the records overwritten or deleted, and the tombstones,
+	// see Stats.DeadRecords
+	deadRecords atomic.Int64
+	// deferred is set while the keyStore has not been built, see
+	// Options.DeferIndex
+	deferred bool
+	// stop stops the background jobs, such as the purge of
+	// Options.ExpireInterval, and background waits for them to return
+	stop       chan struct{}
+	background sync.WaitGroup
+	// audit receives every write, only used with Options.AuditWriter
+	audit *auditLog
+	// hot counts the writes to each key, only used with Options.TrackHotKeys
+	hot *hotKeys
+	// loads are the loads of GetOrLoad in flight
+	loads loadCalls
+	// commits queues the appends for the committer, only used with
+	// Options.GroupCommit
+	commits   chan *commitRequest
+	committer sync.WaitGroup
+	// cache holds every value, only used with Options.CacheAllValues once the
+	// keyStore is built
+	cache *valueCache
+	// index is the secondary index of Options.IndexFunc, once the keyStore is
+	// built
+	index *secondaryIndex
 }
 
-func isFileExists(fileName string) bool {
-	// https://stackoverflow.com/a/12518877
-	if _, err := os.Stat(fileName); err == nil || errors.Is(err, fs.ErrExist) {
-		return true
-	}
-	return false
+// OpenResult describes what happened while loading an existing file during open.
+type OpenResult struct {
+	// Loaded is the number of complete records read from the data file. When a
+	// hint file was used, only the records appended after it are counted.
+	Loaded int
+	// Recovered is the number of torn records discarded from the end of the
+	// file, left behind by a crash in the middle of a write.
+	Recovered int
+	// RecoveryOffset is the byte offset the file was truncated to when records
+	// were recovered.
+	RecoveryOffset int64
+	// Skipped is the number of corrupt stretches of the data file skipped over
+	// by OpenLenient, resuming the scan at the next valid record, and
+	// SkippedBytes their total length. The records in them are lost.
+	Skipped      int
+	SkippedBytes int64
+	// HintUsed reports whether the keyStore was loaded from the hint file.
+	HintUsed bool
+	// LoadDuration is how long building the keyStore took, from the hint file
+	// and the records after it, or the scan of every record.
+	LoadDuration time.Duration
+	// Keys is the number of live keys in the keyStore once it is built, 0 with
+	// Options.DeferIndex.
+	Keys int
+	// Created reports whether the data file did not exist and was created. An
+	// empty file created ahead of time is opened, not created.
+	Created bool
+}
+
+func (r *OpenResult) markSkipped(size int64) {
+	r.Skipped++
+	r.SkippedBytes += size
+}
+
+func (r *OpenResult) markRecovered(offset int64) {
+	r.Recovered++
+	r.RecoveryOffset = offset
 }
 
 // Creates a new disk store, opening an existing one if the file already exists
 func NewDiskStore(fileName string) (*DiskStore, error) {
-	ds := &DiskStore{keyStore: make(map[string]KeyEntry)}
-	if isFileExists(fileName) {
-		err := ds.createKeyStore(fileName)
-		if err != nil {
-			log.Fatalln("Error creating keyStore", err)
+	return NewDiskStoreWithOptions(fileName, Options{})
+}
+
+// Creates a new disk store configured by opts, opening an existing one if the file
+// already exists
+func NewDiskStoreWithOptions(fileName string, opts Options) (*DiskStore, error) {
+	ds, _, err := NewDiskStoreWithResult(fileName, opts)
+	return ds, err
+}
+
+// Creates a new disk store configured by opts like NewDiskStoreWithOptions, and
+// also reports what happened while loading the existing file
+func NewDiskStoreWithResult(fileName string, opts Options) (*DiskStore, OpenResult, error) {
+	return openDiskStore(context.Background(), &DiskStore{fileName: fileName, opts: opts})
+}
+
+// OpenOrCreate opens a disk store like NewDiskStoreWithOptions, also reporting
+// whether the data file was created rather than opened, say to run first time
+// initialization. The file is created exclusively, so two processes racing to
+// create it cannot both see created.
+func OpenOrCreate(path string, opts Options) (ds *DiskStore, created bool, err error) {
+	ds, result, err := NewDiskStoreWithResult(path, opts)
+	return ds, result.Created, err
+}
+
+// OpenWithContext opens a disk store like NewDiskStoreWithOptions, giving up with
+// ctx.Err() once ctx is done while the data file is still being scanned. This
+// bounds how long opening a huge file without a usable hint can take. Nothing is
+// left open when it gives up, but the part of the index built so far is saved to
+// the hint file, so that the next open resumes the scan where this one stopped:
+// a file too large to index within one deadline gets indexed over several opens.
+func OpenWithContext(ctx context.Context, fileName string, opts Options) (*DiskStore, error) {
+	ds, _, err := openDiskStore(ctx, &DiskStore{fileName: fileName, opts: opts})
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return ds, err
+}
+
+// openDiskStore opens the data file of ds, which has its fileName and opts set,
+// along with its segments when opened with Open. The scan of existing records is
+// abandoned once ctx is done.
+func openDiskStore(ctx context.Context, ds *DiskStore) (*DiskStore, OpenResult, error) {
+	var result OpenResult
+	fileName, opts := ds.fileName, ds.opts
+	if opts.Dedup && !opts.SeparateValues {
+		return nil, result, errors.New("caskdb: Options.Dedup requires Options.SeparateValues")
+	}
+	opened := false
+	if opts.NetworkFS {
+		if err := ds.acquireLock(); err != nil {
+			return nil, result, err
 		}
+		defer func() {
+			if !opened {
+				ds.releaseLock()
+			}
+		}()
+		if opts.WriteRetries == 0 {
+			ds.opts.WriteRetries = networkFSWriteRetries
+		}
+	}
+	if err := ds.removeCompactLeftovers(); err != nil {
+		return nil, result, err
 	}
+	ds.keyStore = ds.newKeyDir()
+	shards := opts.LockShards
+	if shards < 1 {
+		shards = defaultLockShards
+	}
+	ds.shards = make([]sync.Mutex, shards)
+	ds.cleanShutdown = true
+	ds.usedBytes.Store(-1)
+	ds.dataStart = fileHeaderSize
+	ds.version = formatVersion
+	// whether the file is new is told from opening it, creating it exclusively
+	// first, so that it cannot appear or vanish between checking for it and
+	// opening it
 	var err error
-	ds.file, err = os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	ds.file, err = os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_EXCL|opts.appendFlag(), 0666)
+	created := err == nil
+	if os.IsExist(err) {
+		ds.file, err = os.OpenFile(fileName, os.O_RDWR|opts.appendFlag(), 0666)
+	}
+	if err != nil {
+		return nil, result, fmt.Errorf("error creating/opening file: %w", err)
+	}
+	ds.writer = ds.file
+	info, err := ds.file.Stat()
 	if err != nil {
-		log.Fatalln("Error creating/opening file", err)
+		ds.file.Close()
+		return nil, result, fmt.Errorf("error creating/opening file: %w", err)
+	}
+	// an empty file is a fresh store, say one created by the caller ahead of time,
+	// so it gets a file header just like a new file
+	exists := info.Size() > 0
+	// the values file is opened ahead of building the keyStore, which reads the
+	// length of compressed values from it
+	if opts.SeparateValues {
+		ds.values, err = openValuesFile(fileName, opts)
+		if err != nil {
+			ds.file.Close()
+			return nil, result, fmt.Errorf("error creating/opening values file: %w", err)
+		}
+	}
+	loadStart := time.Now()
+	if exists && opts.DeferIndex {
+		if result, err = ds.checkTail(ctx); err != nil {
+			ds.closeFiles()
+			return nil, result, err
+		}
+		if result.Recovered > 0 {
+			ds.logger().Printf("caskdb: checked the tail of %s, recovered from %d torn record(s) at offset %d",
+				fileName, result.Recovered, result.RecoveryOffset)
+		}
+		ds.deferred = true
+	} else if exists {
+		result, err = ds.createKeyStore(ctx, ds.file)
+		if err != nil {
+			ds.closeFiles()
+			return nil, result, fmt.Errorf("error creating keyStore: %w", err)
+		}
+		if result.Recovered > 0 {
+			ds.logger().Printf("caskdb: loaded %d records from %s, recovered from %d torn record(s) at offset %d",
+				result.Loaded, fileName, result.Recovered, result.RecoveryOffset)
+		}
+		if result.Skipped > 0 {
+			ds.logger().Printf("caskdb: loaded %d records from %s, skipped %d corrupt stretch(es) of %d bytes in total",
+				result.Loaded, fileName, result.Skipped, result.SkippedBytes)
+		}
+		// a clean Close leaves a hint which accounts for the whole data file
+		ds.cleanShutdown = result.HintUsed && result.Loaded == 0 && result.Recovered == 0 && result.Skipped == 0
+	} else if err := ds.loadSegments(ctx, &result); err != nil {
+		ds.closeFiles()
+		return nil, result, fmt.Errorf("error creating keyStore: %w", err)
+	}
+	result.LoadDuration = time.Since(loadStart)
+	result.Created = created
+	if !ds.deferred {
+		result.Keys = ds.keyStore.Len()
+	}
+	if !exists {
+		if err := ds.appendHeader(ds.writer); err != nil {
+			ds.closeFiles()
+			return nil, result, fmt.Errorf("error writing file header: %w", err)
+		}
+		if err := syncDir(filepath.Dir(fileName)); err != nil {
+			ds.closeFiles()
+			return nil, result, fmt.Errorf("error syncing directory: %w", err)
+		}
+	}
+	if opts.PreallocateBytes > 0 {
+		if err := preallocate(ds.file, opts.PreallocateBytes); err != nil {
+			ds.closeFiles()
+			return nil, result, fmt.Errorf("error preallocating file: %w", err)
+		}
+	}
+	if n := opts.readHandles(); n > 0 {
+		ds.readers, err = openReadPool(fileName, n)
+		if err != nil {
+			ds.file.Close()
+			if ds.values != nil {
+				ds.values.Close()
+			}
+			return nil, result, fmt.Errorf("error opening read handles: %w", err)
+		}
+	}
+	if !ds.deferred {
+		if err := ds.loadValues(); err != nil {
+			ds.closeFiles()
+			return nil, result, fmt.Errorf("error loading values: %w", err)
+		}
+	}
+	if opts.AuditWriter != nil {
+		ds.audit = &auditLog{w: bufio.NewWriter(opts.AuditWriter)}
+	}
+	if opts.TrackHotKeys {
+		ds.hot = &hotKeys{counts: make(map[string]uint64)}
+	}
+	ds.startBackground()
+	registerStore(ds)
+	opened = true
+	return ds, result, nil
+}
+
+func (d *DiskStore) newKeyDir() KeyDir {
+	if d.opts.NewKeyDir != nil {
+		return d.opts.NewKeyDir()
+	}
+	return NewMapKeyDir()
+}
+
+// normalizeKey returns key as it is stored, see Options.KeyNormalizer
+func (d *DiskStore) normalizeKey(key string) string {
+	if d.opts.KeyNormalizer == nil {
+		return key
 	}
-	return ds, nil
+	return d.opts.KeyNormalizer(key)
+}
+
+// timestamp returns the timestamp of a record written now, which with
+// Options.MonotonicTimestamps is always later than the last one
+func (d *DiskStore) timestamp() uint32 {
+	ts := uint32(d.now().Unix())
+	for {
+		last := d.lastTimestamp.Load()
+		if d.opts.MonotonicTimestamps && ts <= last {
+			ts = last + 1
+		}
+		if ts <= last || d.lastTimestamp.CompareAndSwap(last, ts) {
+			return ts
+		}
+	}
+}
+
+// noteTimestamp raises the latest timestamp to ts, that of a record found in
+// the files of the store
+func (d *DiskStore) noteTimestamp(ts uint32) {
+	for {
+		last := d.lastTimestamp.Load()
+		if ts <= last || d.lastTimestamp.CompareAndSwap(last, ts) {
+			return
+		}
+	}
+}
+
+// now returns the current time from Options.Clock
+func (d *DiskStore) now() time.Time {
+	if d.opts.Clock != nil {
+		return d.opts.Clock()
+	}
+	return time.Now()
+}
+
+func (d *DiskStore) logger() *log.Logger {
+	if d.opts.Logger != nil {
+		return d.opts.Logger
+	}
+	return log.Default()
 }
 
 // Gets a value from the store.
 func (d *DiskStore) Get(key string) string {
-	keyEntry, ok := d.keyStore[key]
-	if !ok {
-		return ""
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	value, _, err := d.get(key)
+	if err != nil && !errors.Is(err, ErrIndexNotBuilt) {
+		log.Fatal("Error reading file", err)
+	}
+	return value
+}
+
+// Lookup gets a value from the store, also reporting whether the key exists. This
+// tells an absent key apart from one set to the empty string.
+func (d *DiskStore) Lookup(key string) (string, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	value, ok, err := d.get(key)
+	if err != nil && !errors.Is(err, ErrIndexNotBuilt) {
+		log.Fatal("Error reading file", err)
+	}
+	return value, ok
+}
+
+// GetOr gets a value from the store, returning def if the key does not exist. A
+// key set to the empty string returns the empty string.
+func (d *DiskStore) GetOr(key, def string) string {
+	if value, ok := d.Lookup(key); ok {
+		return value
 	}
+	return def
+}
 
-	_, err := d.file.Seek(int64(keyEntry.position), io.SeekStart)
+// Fetch gets a value from the store, returning ErrKeyNotFound when the key does
+// not exist, and any error reading the file instead of giving up.
+func (d *DiskStore) Fetch(key string) (string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	value, ok, err := d.get(key)
 	if err != nil {
-		log.Fatal("Error seeking to value", err)
+		return "", err
+	}
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return value, nil
+}
+
+// GetMeta2 gets a value from the store along with the metadata it was set with by
+// SetWithMeta, also reporting whether the key exists. Records set without
+// metadata report 0.
+func (d *DiskStore) GetMeta2(key string) (value string, meta uint32, ok bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	h, value, ok, err := d.readRecord(key)
+	if err != nil && !errors.Is(err, ErrIndexNotBuilt) {
+		log.Fatal("Error reading file", err)
 	}
+	return value, h.meta, ok
+}
+
+// GetWithTimestamp gets a value from the store along with the time it was
+// written, also reporting whether the key exists. Timestamps are stored in whole
+// seconds, so the time has no fractional part.
+func (d *DiskStore) GetWithTimestamp(key string) (value string, ts time.Time, ok bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	h, value, ok, err := d.readRecord(key)
+	if err != nil && !errors.Is(err, ErrIndexNotBuilt) {
+		log.Fatal("Error reading file", err)
+	}
+	if !ok {
+		return "", time.Time{}, false
+	}
+	return value, time.Unix(int64(h.timestamp), 0), true
+}
+
+// get reads the value of key from the disk, reporting whether the key exists,
+// like readRecord. The caller must hold mu.
+func (d *DiskStore) get(key string) (string, bool, error) {
+	_, value, ok, err := d.readRecord(key)
+	return value, ok, err
+}
+
+// readRecord is getRecord for the reads of the API, which with
+// Options.ExpireOnAccess also purge the key when it has expired. The caller must
+// hold mu, but not the lock of the key. Failing to purge the key is only logged,
+// as the read itself succeeded.
+func (d *DiskStore) readRecord(key string) (recordHeader, string, bool, error) {
+	h, value, ok, err := d.getRecord(key)
+	if !ok && err == nil && d.opts.ExpireOnAccess {
+		key = d.normalizeKey(key)
+		if _, err := d.expireKey(key, d.now().Unix()); err != nil {
+			d.logger().Printf("caskdb: failed to expire %q on access: %v", key, err)
+		}
+	}
+	return h, value, ok, err
+}
+
+// getRecord reads the latest record of key from the disk, reporting whether the
+// key exists. The caller must hold mu.
+func (d *DiskStore) getRecord(key string) (recordHeader, string, bool, error) {
+	if d.deferred {
+		return recordHeader{}, "", false, ErrIndexNotBuilt
+	}
+	key = d.normalizeKey(key)
+	keyEntry, ok := d.keyStore.Get(key)
+	if !ok || keyEntry.expired(d.now().Unix()) {
+		return recordHeader{}, "", false, nil
+	}
+	if cached, ok := d.cache.get(key); ok {
+		return cached.h, cached.value, true, nil
+	}
+
 	buf := make([]byte, keyEntry.totalSize)
-	_, err = io.ReadFull(d.file, buf)
+	version, err := d.readKeyRecord(key, keyEntry, buf)
 	if err != nil {
-		log.Fatal("Error reading file", err)
+		return recordHeader{}, "", false, err
+	}
+	h, recordKey, value := decodeRecord(version, buf)
+	if d.opts.VerifyOnRead && recordKey != key {
+		return recordHeader{}, "", false, fmt.Errorf("%w: %q", ErrIndexCorrupt, key)
+	}
+	value, err = d.resolveValue(value)
+	if err != nil {
+		return recordHeader{}, "", false, err
+	}
+	value, err = h.codec().decode(value)
+	if err != nil {
+		return recordHeader{}, "", false, err
 	}
 
-	_, _, value := decodeKV(buf)
+	return h, value, true, nil
+}
 
-	return value
+// readKeyRecord reads the record of key at keyEntry into buf, which is as long as
+// the record, returning the format version of the file it is in.
+func (d *DiskStore) readKeyRecord(key string, keyEntry KeyEntry, buf []byte) (uint32, error) {
+	// ReadAt does not move the file offset, so reads never disturb where Set
+	// thinks the end of the file is
+	n, version, err := d.readEntry(buf, keyEntry)
+	if err != nil {
+		// nothing at all is read when the record would start past the end
+		if err == io.EOF && n == 0 {
+			err = fmt.Errorf("%w: %q at offset %d", ErrOffsetOutOfRange, key, keyEntry.position)
+		} else if err == io.EOF {
+			err = &ShortRecordError{Key: key, Expected: int64(len(buf)), Actual: int64(n)}
+		}
+		return 0, err
+	}
+	// a record whose sizes disagree with the keyStore means the entry is corrupt,
+	// and is caught before decoding slices the buffer by those sizes
+	headerSize := recordHeaderSize(version)
+	if len(buf) < headerSize || decodeRecordHeader(version, buf[:headerSize]).size(version) != int64(len(buf)) {
+		return 0, fmt.Errorf("%w: %q at offset %d", ErrRecordMismatch, key, keyEntry.position)
+	}
+	return version, nil
 }
 
 // Sets a value in the store overwriting the key if it already existed
-func (d *DiskStore) Set(key string, value string) {
-	timestamp := uint32(time.Now().Unix())
-	size, bytes := encodeKV(timestamp, key, value)
-	pos, err := d.file.Seek(0, io.SeekCurrent) // Get the current pos in the file
+func (d *DiskStore) Set(key string, value string) error {
+	return d.set(key, value, recordHeader{timestamp: d.timestamp()})
+}
+
+// SetWithMeta sets a value like Set, tagging the record with application defined
+// metadata, say a content type, which GetMeta2 returns along with the value.
+func (d *DiskStore) SetWithMeta(key string, value string, meta uint32) error {
+	return d.set(key, value, recordHeader{timestamp: d.timestamp(), meta: meta})
+}
+
+// SetWithTimestamp sets a value like Set, stamping the record with ts (seconds
+// since the epoch) instead of the current time. It makes tests reproducible and
+// lets replication keep the timestamps of the primary; Apply uses the timestamp
+// to decide which write is the newest.
+func (d *DiskStore) SetWithTimestamp(key string, value string, ts uint32) error {
+	return d.set(key, value, recordHeader{timestamp: ts})
+}
+
+// Put sets a value like Set, returning the value it replaced and whether the key
+// existed before. The old value is read under the same lock as the write, so no
+// other write to the key can slip in between.
+func (d *DiskStore) Put(key string, value string) (prev string, existed bool, err error) {
+	prev, existed, err = d.tryPut(key, value)
+	if errors.Is(err, ErrStoreFull) && d.reclaim() {
+		prev, existed, err = d.tryPut(key, value)
+	}
+	return prev, existed, err
+}
+
+// tryPut does the work of Put, without reclaiming space when the store is full
+func (d *DiskStore) tryPut(key string, value string) (prev string, existed bool, err error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	key = d.normalizeKey(key)
+	shard := d.lockKey(key)
+	defer shard.Unlock()
+
+	if err := d.checkQuota(key, value); err != nil {
+		return "", false, err
+	}
+	// the lock of the key is held, so reading must not purge it
+	current, prev, existed, err := d.getRecord(key)
+	if err != nil {
+		return "", false, err
+	}
+	h := recordHeader{timestamp: d.timestamp()}
+	if d.opts.SkipIdenticalWrites && existed && prev == value && current.meta == h.meta && current.expiresAt == h.expiresAt {
+		return prev, existed, nil
+	}
+	if err := d.writeRecord(key, value, h); err != nil {
+		return "", false, err
+	}
+	return prev, existed, nil
+}
+
+// set writes a record for key with the timestamp, meta and expiry of h
+func (d *DiskStore) set(key string, value string, h recordHeader) error {
+	err := d.trySet(key, value, h)
+	if errors.Is(err, ErrStoreFull) && d.reclaim() {
+		err = d.trySet(key, value, h)
+	}
+	return err
+}
+
+// reclaim compacts the store to make room under Options.MaxTotalSize, reporting
+// whether it did. A full values file is not made any smaller by compacting, so
+// nothing is done without the option. It must not be called with mu held.
+func (d *DiskStore) reclaim() bool {
+	if d.opts.MaxTotalSize <= 0 {
+		return false
+	}
+	stats, err := d.Stats()
+	if err != nil || stats.DeadBytes == 0 {
+		return false
+	}
+	if err := d.Compact(); err != nil {
+		d.logger().Printf("caskdb: failed to compact to make room for a write: %v", err)
+		return false
+	}
+	return true
+}
+
+// trySet does the work of set, without reclaiming space when the store is full
+func (d *DiskStore) trySet(key string, value string, h recordHeader) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	key = d.normalizeKey(key)
+	shard := d.lockKey(key)
+	defer shard.Unlock()
+
+	if (h.meta != 0 || h.expiresAt != 0) && d.version < 2 {
+		return ErrOldFormat
+	}
+	if err := d.checkQuota(key, value); err != nil {
+		return err
+	}
+	if d.opts.SkipIdenticalWrites && !d.deferred {
+		current, currentValue, ok, err := d.getRecord(key)
+		if err != nil {
+			return err
+		}
+		if ok && currentValue == value && current.meta == h.meta && current.expiresAt == h.expiresAt {
+			return nil
+		}
+	}
+
+	return d.writeRecord(key, value, h)
+}
+
+// checkQuota returns ErrQuotaExceeded when value is larger than the quota of key
+func (d *DiskStore) checkQuota(key string, value string) error {
+	if d.opts.KeyQuota == nil {
+		return nil
+	}
+	if limit := d.opts.KeyQuota(key); limit > 0 && int64(len(value)) > limit {
+		return fmt.Errorf("%w: %d bytes for %q, limit is %d", ErrQuotaExceeded, len(value), key, limit)
+	}
+	return nil
+}
+
+// checkTotalSize returns ErrStoreFull when writing size more bytes would take the
+// files of the store past Options.MaxTotalSize. The caller must hold mu.
+func (d *DiskStore) checkTotalSize(size int64) error {
+	total := d.usedBytes.Load()
+	if total < 0 {
+		var err error
+		if total, err = d.countUsedBytes(); err != nil {
+			return err
+		}
+	}
+	if total+size > d.opts.MaxTotalSize {
+		return fmt.Errorf("%w: %d bytes used, limit is %d", ErrStoreFull, total, d.opts.MaxTotalSize)
+	}
+	return nil
+}
+
+// countUsedBytes sets usedBytes to the size of the files of the store, as they
+// are on the disk. The caller must hold mu.
+func (d *DiskStore) countUsedBytes() (int64, error) {
+	d.appendMu.Lock()
+	defer d.appendMu.Unlock()
+	info, err := d.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	total := info.Size()
+	for _, seg := range d.segments {
+		total += seg.size
+	}
+	if d.values != nil {
+		if info, err = d.values.Stat(); err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+	d.usedBytes.Store(total)
+	return total, nil
+}
+
+// writeRecord appends a record for key and points the keyStore at it, or removes
+// the key for a tombstone. The caller must hold mu and the lock of the key.
+func (d *DiskStore) writeRecord(key string, value string, h recordHeader) error {
+	return d.writeRecords([]pendingRecord{{key, value, h}})
+}
+
+// pendingRecord is a record for writeRecords to append
+type pendingRecord struct {
+	key   string
+	value string
+	h     recordHeader
+}
+
+// writeRecords appends records like writeRecord does one at a time, but in a
+// single vectored write, synced once. Every record is checked before any is
+// appended to the data file, so either all of them are or none is. The caller
+// must hold mu and the locks of the keys.
+func (d *DiskStore) writeRecords(records []pendingRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	bufs := make([][]byte, len(records))
+	for i, record := range records {
+		buf, err := d.prepareRecord(record.key, record.value, record.h)
+		if err != nil {
+			return err
+		}
+		bufs[i] = buf
+	}
+	pos, err := d.appendBuffers(d.writer, bufs)
+	if err != nil {
+		return err
+	}
+	for i, record := range records {
+		if err := d.recordWritten(record.key, record.value, record.h, bufs[i], pos); err != nil {
+			return err
+		}
+		pos += int64(len(bufs[i]))
+	}
+	return nil
+}
+
+// prepareRecord encodes the record of key to append, checking it against the
+// size limits, compressing its value and writing it to the values file as
+// configured.
+func (d *DiskStore) prepareRecord(key string, value string, h recordHeader) ([]byte, error) {
+	if d.opts.Codec != CodecNone && d.version > 1 && !h.isTombstone() {
+		var err error
+		if value, err = d.opts.Codec.encode(value); err != nil {
+			return nil, err
+		}
+		h = h.withCodec(d.opts.Codec)
+	}
+	// the sizes are stored in 4 bytes, and the cast would silently truncate them
+	size := int64(recordHeaderSize(d.version)) + int64(len(key)) + int64(len(value))
+	if h.expiresAt != 0 {
+		size += expirySize
+	}
+	if size > maxRecordSize {
+		return nil, fmt.Errorf("%w: %d bytes for %q", ErrRecordTooLarge, size, key)
+	}
+	if d.opts.MaxTotalSize > 0 && !h.isTombstone() {
+		if err := d.checkTotalSize(size); err != nil {
+			return nil, err
+		}
+	}
+	if d.values != nil && !h.isTombstone() {
+		location, err := d.appendValue(value)
+		if err != nil {
+			return nil, err
+		}
+		value = location
+	}
+	return encodeRecord(d.version, h, key, value), nil
+}
+
+// recordWritten updates the keyStore and everything else kept about the keys
+// after the record of key, encoded as bytes from value and h, was appended at pos.
+func (d *DiskStore) recordWritten(key string, value string, h recordHeader, bytes []byte, pos int64) error {
+	d.noteTimestamp(h.timestamp)
+	if d.opts.DebugAsserts {
+		if err := d.assertRecord(key, bytes, pos); err != nil {
+			return err
+		}
+	}
+	d.audit.log(key, h, len(value))
+	d.hot.observe(key)
+	if d.deferred {
+		return nil
+	}
+	if _, ok := d.keyStore.Get(key); ok {
+		d.deadRecords.Add(1)
+	}
+	if h.isTombstone() {
+		d.deadRecords.Add(1)
+		d.keyStore.Delete(key)
+		d.cache.delete(key)
+	} else {
+		d.keyStore.Set(key, KeyEntry{h.timestamp, uint32(pos), uint32(len(bytes)), d.segment, h.expiresAt, uint32(len(value))})
+		d.cache.update(key, h, value)
+	}
+	d.indexValue(key, value, h.isTombstone())
+	return nil
+}
+
+// assertRecord reads back the record just appended for key at pos, returning
+// ErrAssertion unless it is exactly record. See Options.DebugAsserts.
+func (d *DiskStore) assertRecord(key string, record []byte, pos int64) error {
+	buf := make([]byte, len(record))
+	if _, err := d.readAt(buf, pos); err != nil {
+		return fmt.Errorf("%w: reading back %q at offset %d: %v", ErrAssertion, key, pos, err)
+	}
+	if !bytes.Equal(buf, record) {
+		return fmt.Errorf("%w: the record of %q is not at offset %d", ErrAssertion, key, pos)
+	}
+	return nil
+}
+
+// Delete removes a key from the store. Like every other write, this appends a
+// record to the file, a tombstone, which keeps the key deleted when the store is
+// reopened. Deleting a key which does not exist does nothing.
+func (d *DiskStore) Delete(key string) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	key = d.normalizeKey(key)
+	shard := d.lockKey(key)
+	defer shard.Unlock()
+
+	if d.version < 2 {
+		return ErrOldFormat
+	}
+	// without a keyStore there is no telling whether the key exists
+	if _, ok := d.keyStore.Get(key); !ok && !d.deferred {
+		return nil
+	}
+	timestamp := d.timestamp()
+	return d.writeRecord(key, "", recordHeader{timestamp: timestamp, flags: flagTombstone})
+}
+
+// scanCheckInterval is how many records scanRecords reads between checks of its
+// context
+const scanCheckInterval = 1024
+
+// maxRecordSize is the largest record the format can describe, as KeyEntry keeps
+// its size in 4 bytes. It is a variable so that tests need not write 4GB.
+var maxRecordSize int64 = math.MaxUint32
+
+// DeleteMulti removes several keys from the store, like calling Delete for each
+// of them but much faster: the tombstones are appended in a single write, synced
+// once. Keys which do not exist are skipped.
+func (d *DiskStore) DeleteMulti(keys []string) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.version < 2 {
+		return ErrOldFormat
+	}
+	unique := make(map[string]bool, len(keys))
+	shards := make(map[int]bool)
+	for _, key := range keys {
+		key = d.normalizeKey(key)
+		unique[key] = true
+		shards[d.shardOf(key)] = true
+	}
+	// shards are locked in order, so concurrent calls cannot deadlock
+	for _, shard := range slices.Sorted(maps.Keys(shards)) {
+		d.shards[shard].Lock()
+		defer d.shards[shard].Unlock()
+	}
+
+	var records []pendingRecord
+	timestamp := d.timestamp()
+	for key := range unique {
+		// without a keyStore there is no telling whether the key exists
+		if _, ok := d.keyStore.Get(key); !ok && !d.deferred {
+			continue
+		}
+		records = append(records, pendingRecord{key: key, h: recordHeader{timestamp: timestamp, flags: flagTombstone}})
+	}
+	return d.writeRecords(records)
+}
+
+// appendFile is the part of *os.File used to append records.
+type appendFile interface {
+	io.WriteSeeker
+	Sync() error
+	Truncate(size int64) error
+}
+
+// lockKey locks and returns the write lock of the shard key belongs to. Writes to
+// the same key are serialised, so the keyStore always ends up pointing at the
+// record appended last.
+func (d *DiskStore) lockKey(key string) *sync.Mutex {
+	shard := &d.shards[d.shardOf(key)]
+	shard.Lock()
+	return shard
+}
+
+// shardOf returns the index of the write lock shard key belongs to
+func (d *DiskStore) shardOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(d.shards)))
+}
+
+// append writes data to the end of file and syncs it, returning the offset it was
+// written at. Failed writes are retried as configured by Options.WriteRetries.
+//
+// Only the write itself happens under appendMu, which reserves the range of bytes
+// for the record. The much slower sync runs outside of it, so concurrent writers
+// overlap their syncs. With Options.GroupCommit, the committer does the writing
+// and syncing instead, see commit.go.
+func (d *DiskStore) append(file appendFile, data []byte) (int64, error) {
+	return d.appendBuffers(file, [][]byte{data})
+}
+
+// appendBuffers is append for bufs written one after the other, in a single write
+// and sync, returning the offset of the first of them.
+func (d *DiskStore) appendBuffers(file appendFile, bufs [][]byte) (int64, error) {
+	if d.commits != nil {
+		return d.commit(file, bufs)
+	}
+	d.appendMu.Lock()
+	pos, err := d.writeBuffers(file, bufs)
+	d.appendMu.Unlock()
 	if err != nil {
-		log.Fatal("Failed to seek 0 positions, this should never happen", err)
+		return 0, err
 	}
-	_, err = d.file.Write(bytes)
+	return pos, d.syncAppend(file)
+}
+
+// appendHeader writes the file header to the new, empty file and syncs it. It is
+// not a write of the store, so not counted by Options.SyncEveryN.
+func (d *DiskStore) appendHeader(file appendFile) error {
+	d.appendMu.Lock()
+	_, err := d.write(file, encodeFileHeader(formatVersion))
+	d.appendMu.Unlock()
 	if err != nil {
-		log.Fatal("Failed to write to file", err)
+		return err
 	}
-	if err := d.file.Sync(); err != nil {
-		log.Fatal("Failed to write to file", err)
+	return d.retry(file.Sync)
+}
+
+// syncAppend syncs file after an append, or with Options.SyncEveryN only counts
+// the write and syncs once every N of them. The values of Options.SeparateValues
+// are appended ahead of their record, so they are not counted as writes of their
+// own and get synced along with the data file. The caller must hold mu.
+func (d *DiskStore) syncAppend(file appendFile) error {
+	n := int64(d.opts.SyncEveryN)
+	if n <= 0 {
+		return d.retry(file.Sync)
 	}
-	d.keyStore[key] = KeyEntry{timestamp, uint32(pos), uint32(size)}
+	if file == d.values || d.unsynced.Add(1) < n {
+		return nil
+	}
+	return d.syncFiles(file)
 }
 
-// Closes the file
+// Sync syncs the writes not yet synced to disk, which with Options.SyncEveryN are
+// the writes since the last Nth one. Without it every write is already synced by
+// the time it returns.
+func (d *DiskStore) Sync() error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.syncFiles(d.writer)
+}
+
+// syncFiles syncs the values file and then file, the file records are appended
+// to, so that no synced record points at a value which is not. The caller must
+// hold mu.
+func (d *DiskStore) syncFiles(file appendFile) error {
+	d.unsynced.Store(0)
+	if d.values != nil {
+		if err := d.retry(d.values.Sync); err != nil {
+			return err
+		}
+	}
+	return d.retry(file.Sync)
+}
+
+// write appends data to file, retrying failed writes. The caller must hold
+// appendMu.
+func (d *DiskStore) write(file appendFile, data []byte) (int64, error) {
+	return d.writeBuffers(file, [][]byte{data})
+}
+
+// writeBuffers appends bufs to file one after the other like write, in a single
+// vectored write where the platform supports it rather than concatenating them
+// first. The caller must hold appendMu.
+func (d *DiskStore) writeBuffers(file appendFile, bufs [][]byte) (int64, error) {
+	pos, err := file.Seek(0, io.SeekEnd) // Get the current end of the file
+	if err != nil {
+		return 0, err
+	}
+	var size int
+	for _, buf := range bufs {
+		size += len(buf)
+	}
+	if d.values != nil && file == d.values && pos+int64(size) > maxValuesSize {
+		return 0, fmt.Errorf("%w: the values file is limited to %d bytes", ErrStoreFull, maxValuesSize)
+	}
+	defer func() {
+		if err != nil {
+			// part of the write may have made it to the file
+			d.usedBytes.Store(-1)
+		} else if d.usedBytes.Load() >= 0 {
+			d.usedBytes.Add(int64(size))
+		}
+	}()
+	err = d.retry(func() error {
+		n, err := writeVectored(file, bufs)
+		if err == nil && n < size {
+			err = io.ErrShortWrite
+		}
+		if errors.Is(err, io.ErrShortWrite) || errors.Is(err, syscall.ENOSPC) {
+			err = fmt.Errorf("%w: %v", ErrDiskFull, err)
+		}
+		if err != nil {
+			// drop whatever part of the record made it to the file, otherwise
+			// the retry would leave a torn record in the middle of the log
+			if err := file.Truncate(pos); err != nil {
+				return err
+			}
+		}
+		return err
+	})
+	return pos, err
+}
+
+// retry calls fn until it succeeds or Options.WriteRetries is exhausted,
+// returning the last error. A full disk is not retried, as it is not going to
+// clear up within the backoff.
+func (d *DiskStore) retry(fn func() error) error {
+	backoff := d.opts.RetryBackoff
+	if backoff == 0 {
+		backoff = defaultRetryBackoff
+	}
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= d.opts.WriteRetries || errors.Is(err, ErrDiskFull) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Closes the file, writing a hint file so the next open does not need to scan the
+// data file
 func (d *DiskStore) Close() bool {
-	if err := d.file.Sync(); err != nil {
+	// background jobs take mu themselves, so they have to stop before Close takes it
+	d.stopBackground()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer unregisterStore(d)
+	ok := true
+	if !d.opts.CompactOnClose {
+		// nothing to compact
+	} else if !d.compacting.CompareAndSwap(false, true) {
+		// a Compact still running would swap the files under the final one
+		log.Print("Skipping compaction on close: ", ErrCompactionInProgress)
+	} else {
+		err := d.compact()
+		d.compacting.Store(false)
+		if err != nil {
+			log.Print("Failed to compact file", err)
+			ok = false
+		}
+	}
+	d.stopCommitter()
+	// the hint must not account for records that are not on disk yet, in the
+	// data file or the values file
+	if err := d.syncFiles(d.writer); err != nil {
 		log.Print("Failed to close file", err)
 		return false
 	}
-	
+	if d.deferred {
+		// leave the previous hint, which still accounts for the start of the file
+	} else if err := d.writeHint(); err != nil {
+		log.Print("Failed to write hint file", err)
+	}
+	if err := d.audit.flush(); err != nil {
+		log.Print("Failed to flush audit log", err)
+	}
+
 	if err := d.file.Close(); err != nil {
 		log.Print("Failed to close file", err)
 		return false
 	}
-	return true
+	if d.values != nil {
+		if err := d.values.Close(); err != nil {
+			log.Print("Failed to close values file", err)
+			return false
+		}
+	}
+	if d.readers != nil {
+		if err := d.readers.close(); err != nil {
+			log.Print("Failed to close read handles", err)
+			return false
+		}
+	}
+	if err := d.closeSegments(); err != nil {
+		log.Print("Failed to close segment", err)
+		return false
+	}
+	if err := d.releaseLock(); err != nil {
+		log.Print("Failed to remove lock file", err)
+		return false
+	}
+	return ok
 }
 
-// Creates the key store from an existing file.
-func (d *DiskStore) createKeyStore(fileName string) error {
-	file, _ := os.Open(fileName)
-	defer file.Close()
+// readFileHeader validates the file header, returning the offset of the first
+// record and the format version of the records. Files without a header are only
+// accepted when legacy is set.
+func readFileHeader(file *os.File, legacy bool) (int64, uint32, error) {
+	header := make([]byte, fileHeaderSize)
+	_, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	version, ok := decodeFileHeader(header)
+	if !ok {
+		if legacy {
+			version, err := legacyVersion(file)
+			return 0, version, err
+		}
+		return 0, 0, ErrNotACaskDB
+	}
+	if version < 1 || version > formatVersion {
+		return 0, 0, fmt.Errorf("%w: unsupported format version %d", ErrNotACaskDB, version)
+	}
+	return fileHeaderSize, version, nil
+}
 
-	for {
-		buf := make([]byte, headerSize)
-		pos, _ := file.Seek(0, io.SeekCurrent)
+// legacyVersion returns the format version of a file without a file header: 1
+// when its first record is a version 1 record with a matching checksum, and 0,
+// the original format, otherwise.
+func legacyVersion(file *os.File) (uint32, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, headerSizeV1)
+	if info.Size() < headerSizeV1 {
+		return 0, nil
+	}
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return 0, err
+	}
+	size := decodeRecordHeader(1, header).size(1)
+	if size > info.Size() {
+		return 0, nil
+	}
+	record := make([]byte, size)
+	if _, err := file.ReadAt(record, 0); err != nil {
+		return 0, err
+	}
+	if verifyRecord(1, record) {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// Creates the key store from an existing file. When a hint file is present, the
+// keyStore is loaded from it and only the records appended after the hint was
+// written are scanned.
+//
+// A crash in the middle of Set can leave a partially written record at the end
+// of the file. Such a torn tail is not an error: the file is truncated back to
+// the last complete record so that new records are appended to a valid log.
+func (d *DiskStore) createKeyStore(ctx context.Context, file *os.File) (OpenResult, error) {
+	var result OpenResult
+	info, err := file.Stat()
+	if err != nil {
+		return result, err
+	}
+	fileSize := info.Size()
+	if d.dataStart, d.version, err = readFileHeader(file, d.opts.LegacyFormat); err != nil {
+		return result, err
+	}
+	offset, hintUsed := d.loadHint(fileSize)
+	result.HintUsed = hintUsed
+	// the hint of the active file covers the segments too
+	if !hintUsed {
+		if err := d.loadSegments(ctx, &result); err != nil {
+			return result, err
+		}
+	}
+	offset = max(offset, d.dataStart)
+	if err := d.scanRecords(ctx, file, d.segment, d.version, offset, fileSize, &result); err != nil {
+		var interrupted *scanInterrupted
+		if errors.As(err, &interrupted) && interrupted.offset > offset {
+			d.saveCheckpoint(interrupted.offset)
+		}
+		return result, err
+	}
+
+	return result, d.truncateTornTail(file, result)
+}
+
+// truncateTornTail truncates the torn record the scan of file found at its end,
+// if any. Legacy files are never truncated: without a file header, there may be
+// no checksum to tell a torn record from a corrupt one.
+func (d *DiskStore) truncateTornTail(file *os.File, result OpenResult) error {
+	if result.Recovered == 0 {
+		return nil
+	}
+	if d.dataStart == 0 {
+		return fmt.Errorf("%w: torn record at offset %d of a legacy file", ErrCorruptRecord, result.RecoveryOffset)
+	}
+	if err := file.Truncate(result.RecoveryOffset); err != nil {
+		return fmt.Errorf("could not truncate torn tail: %w", err)
+	}
+	d.usedBytes.Store(-1)
+	return nil
+}
+
+// scanInterrupted is the error scanRecords returns when its context is done,
+// recording the offset of the first record it did not read
+type scanInterrupted struct {
+	offset int64
+	err    error
+}
+
+func (e *scanInterrupted) Error() string {
+	return fmt.Sprintf("scan interrupted at offset %d: %v", e.offset, e.err)
+}
+
+func (e *scanInterrupted) Unwrap() error {
+	return e.err
+}
+
+// saveCheckpoint writes a hint file for the keyStore built by a scan of the data
+// file interrupted at offset, so that the next open resumes the scan from there
+// rather than from the start. Failing to write it only costs the next open time.
+func (d *DiskStore) saveCheckpoint(offset int64) {
+	if err := writeHintFile(hintFileName(d.fileName), encodeHint(hintHeader{offset, d.deadRecords.Load(), d.lastTimestamp.Load()}, d.keyStore)); err != nil {
+		d.logger().Printf("caskdb: failed to save the progress of scanning %s: %v", d.fileName, err)
+		return
+	}
+	d.logger().Printf("caskdb: scanning %s was interrupted at offset %d, the next open resumes from there", d.fileName, offset)
+}
+
+// nextValidRecord returns the offset of the first record starting between from
+// and end whose checksum matches, reporting whether there is one. Records of
+// version 0 have no checksum, so none of them is ever found.
+func nextValidRecord(file io.ReaderAt, version uint32, from int64, end int64) (int64, bool, error) {
+	if version == 0 {
+		return 0, false, nil
+	}
+	headerSize := recordHeaderSize(version)
+	window := make([]byte, 64<<10)
+	for start := from; start+int64(headerSize) <= end; {
+		n, err := file.ReadAt(window[:min(int64(len(window)), end-start)], start)
+		if err != nil && err != io.EOF {
+			return 0, false, err
+		}
+		if n < headerSize {
+			break
+		}
+		for i := 0; i+headerSize <= n; i++ {
+			pos := start + int64(i)
+			size := decodeRecordHeader(version, window[i:i+headerSize]).size(version)
+			if size > maxRecordSize || pos+size > end {
+				continue
+			}
+			record := make([]byte, size)
+			if _, err := file.ReadAt(record, pos); err != nil {
+				return 0, false, err
+			}
+			if verifyRecord(version, record) {
+				return pos, true, nil
+			}
+		}
+		start += int64(n - headerSize + 1)
+	}
+	return 0, false, nil
+}
+
+// verifyScanned reads the rest bytes left of the record at pos from r and checks
+// the checksum of the whole record, read holding the bytes of it read already.
+func verifyScanned(r io.Reader, version uint32, read []byte, rest int64, pos int64) error {
+	record := append(read, make([]byte, rest)...)
+	if _, err := io.ReadFull(r, record[len(read):]); err != nil {
+		return err
+	}
+	if !verifyRecord(version, record) {
+		return fmt.Errorf("%w: checksum mismatch at offset %d", ErrCorruptRecord, pos)
+	}
+	return nil
+}
+
+// scanRecords reads the records of file from offset to fileSize into the
+// keyStore, counting them in result. A torn record at the end is marked as
+// recovered in result and ends the scan, unless opts.OpenMode is OpenStrict,
+// which returns ErrCorruptRecord for it and for a record failing its checksum. ctx is checked every scanCheckInterval
+// records, returning its error once it is done.
+func (d *DiskStore) scanRecords(ctx context.Context, file *os.File, segment uint32, version uint32, offset int64, fileSize int64, result *OpenResult) error {
+	section := io.NewSectionReader(file, offset, fileSize-offset)
+	var r io.Reader = section
+	var buffered *bufio.Reader
+	if size := d.opts.ScanBufferSize; size >= 0 {
+		if size == 0 {
+			size = defaultScanBufferSize
+		}
+		buffered = bufio.NewReaderSize(section, size)
+		r = buffered
+	}
+	buf := make([]byte, recordHeaderSize(version))
+	expiry := make([]byte, expirySize)
+	var lastTimestamp uint32
+	defer func() { d.noteTimestamp(lastTimestamp) }()
+	for i, pos := 0, offset; ; i++ {
+		if i%scanCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return &scanInterrupted{offset: pos, err: err}
+			}
+		}
 		// Read header
-		_, err := io.ReadFull(file, buf)
+		_, err := io.ReadFull(r, buf)
 		if err == io.EOF {
 			break
 		}
+		if err == io.ErrUnexpectedEOF {
+			if d.opts.OpenMode == OpenStrict {
+				return fmt.Errorf("%w: torn record at offset %d", ErrCorruptRecord, pos)
+			}
+			result.markRecovered(pos)
+			break
+		}
 		if err != nil {
-			log.Fatal("Could not read header ", err)
+			return fmt.Errorf("could not read header: %w", err)
+		}
+		h := decodeRecordHeader(version, buf)
+		totalSize := h.size(version)
+		if pos+totalSize > fileSize {
+			// a corrupt size in the middle of the file looks just like a torn
+			// record, except that valid records follow it, which must not be
+			// truncated away
+			next, found, err := nextValidRecord(file, version, pos+1, fileSize)
+			if err != nil {
+				return err
+			}
+			if found && d.opts.OpenMode == OpenStrict {
+				return fmt.Errorf("%w: record at offset %d runs past the end of the file, yet a valid record follows at offset %d",
+					ErrCorruptRecord, pos, next)
+			}
+			if found {
+				result.markSkipped(next - pos)
+				if _, err := section.Seek(next-offset, io.SeekStart); err != nil {
+					return fmt.Errorf("could not skip corrupt record: %w", err)
+				}
+				if buffered != nil {
+					buffered.Reset(section)
+				}
+				pos = next
+				continue
+			}
+			if d.opts.OpenMode == OpenStrict {
+				return fmt.Errorf("%w: torn record at offset %d", ErrCorruptRecord, pos)
+			}
+			result.markRecovered(pos)
+			break
 		}
-		timestamp, keySize, valueSize := decodeHeader(buf)
 		// Read key
-		keyBuf := make([]byte, keySize)
-		_, err = io.ReadFull(file, keyBuf)
+		keyBuf := make([]byte, h.keySize)
+		_, err = io.ReadFull(r, keyBuf)
 		if err != nil {
-			log.Fatal("Could not read key from file ", err)
+			return fmt.Errorf("could not read key from file: %w", err)
 		}
-		// Skip value (not used)
-		_, err = file.Seek(int64(valueSize), io.SeekCurrent)
-		if err != nil && err != io.EOF {
-			log.Fatalln("Could not skip value in file", err)
+		// Skip value (not used), except for the expiry time ahead of it
+		skip := int64(h.valueSize)
+		var expiresAt uint32
+		hasExpiry := h.flags&flagExpires != 0 && h.valueSize >= expirySize
+		if hasExpiry {
+			if _, err := io.ReadFull(r, expiry); err != nil {
+				return fmt.Errorf("could not read expiry from file: %w", err)
+			}
+			expiresAt = binary.LittleEndian.Uint32(expiry)
+			skip -= expirySize
+		}
+		// the length of a compressed value, or of one in the values file, is
+		// only known from the value itself
+		valueSize := uint32(skip)
+		var value []byte
+		if !h.isTombstone() && (h.codec() != CodecNone || d.values != nil) {
+			value = make([]byte, skip)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return fmt.Errorf("could not read value from file: %w", err)
+			}
+			skip = 0
+		}
+		if d.opts.OpenMode == OpenStrict {
+			read := append(append([]byte{}, buf...), keyBuf...)
+			if hasExpiry {
+				read = append(read, expiry...)
+			}
+			err = verifyScanned(r, version, append(read, value...), skip, pos)
+		} else if buffered != nil && skip <= int64(buffered.Buffered()) {
+			_, err = buffered.Discard(int(skip))
+		} else if _, err = section.Seek(pos+totalSize-offset, io.SeekStart); err == nil && buffered != nil {
+			buffered.Reset(section)
+		}
+		if errors.Is(err, ErrCorruptRecord) {
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("could not skip value in file: %w", err)
+		}
+		if value != nil {
+			// a value which does not decode is reported by reading it, the
+			// scan keeps its stored length
+			if size, err := d.rawValueSize(h, string(value)); err == nil {
+				valueSize = size
+			}
+		}
+		if _, ok := d.keyStore.Get(string(keyBuf)); ok {
+			d.deadRecords.Add(1)
+		}
+		if h.isTombstone() {
+			d.deadRecords.Add(1)
+			d.keyStore.Delete(string(keyBuf))
+		} else {
+			d.keyStore.Set(string(keyBuf), KeyEntry{h.timestamp, uint32(pos), uint32(totalSize), segment, expiresAt, valueSize})
 		}
-		totalSize := headerSize + keySize + valueSize
-		d.keyStore[string(keyBuf)] = KeyEntry{timestamp, uint32(pos), totalSize}
+		lastTimestamp = max(lastTimestamp, h.timestamp)
+		result.Loaded++
+		pos += totalSize
 	}
 	return nil
 }
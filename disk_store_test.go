@@ -1,8 +1,20 @@
 package caskdb
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestDiskStore_Get(t *testing.T) {
@@ -11,6 +23,7 @@ func TestDiskStore_Get(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	defer os.Remove("test.db")
+	defer os.Remove("test.db.hint")
 	store.Set("name", "jojo")
 	if val := store.Get("name"); val != "jojo" {
 		t.Errorf("Get() = %v, want %v", val, "jojo")
@@ -23,6 +36,7 @@ func TestDiskStore_GetInvalid(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	defer os.Remove("test.db")
+	defer os.Remove("test.db.hint")
 	if val := store.Get("some key"); val != "" {
 		t.Errorf("Get() = %v, want %v", val, "")
 	}
@@ -34,6 +48,7 @@ func TestDiskStore_SetWithPersistence(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	defer os.Remove("test.db")
+	defer os.Remove("test.db.hint")
 
 	tests := map[string]string{
 		"crime and punishment": "dostoevsky",
@@ -69,6 +84,7 @@ func TestDiskStore_Delete(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	defer os.Remove("test.db")
+	defer os.Remove("test.db.hint")
 
 	tests := map[string]string{
 		"crime and punishment": "dostoevsky",
@@ -102,3 +118,1565 @@ func TestDiskStore_Delete(t *testing.T) {
 	}
 	store.Close()
 }
+
+func TestDiskStore_SkipIdenticalWrites(t *testing.T) {
+	store, err := NewDiskStoreWithOptions("test.db", Options{SkipIdenticalWrites: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer os.Remove("test.db.hint")
+	defer store.Close()
+
+	if err := store.Set("othello", "shakespeare"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	info, _ := os.Stat("test.db")
+	size := info.Size()
+	if err := store.Set("othello", "shakespeare"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if info, _ = os.Stat("test.db"); info.Size() != size {
+		t.Errorf("file size = %v, want %v", info.Size(), size)
+	}
+	if err := store.Set("othello", "william shakespeare"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if info, _ = os.Stat("test.db"); info.Size() <= size {
+		t.Errorf("file size = %v, want more than %v", info.Size(), size)
+	}
+	if val := store.Get("othello"); val != "william shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "william shakespeare")
+	}
+
+	// the same value with another expiry or meta is not an identical write
+	store.SetWithTTL("hamlet", "shakespeare", time.Hour)
+	store.SetWithMeta("dune", "frank herbert", 7)
+	store.Put("hamlet", "shakespeare")
+	store.Put("dune", "frank herbert")
+	if entry, _ := store.keyStore.Get("hamlet"); entry.expiresAt != 0 {
+		t.Errorf("Put() kept the expiry of the replaced value")
+	}
+	if _, meta, _ := store.GetMeta2("dune"); meta != 0 {
+		t.Errorf("Put() kept the meta %v of the replaced value", meta)
+	}
+}
+
+func TestNewDiskStoreWithResult(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, result, err := NewDiskStoreWithResult(fileName, Options{})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if result.Loaded != 0 || result.Keys != 0 || result.HintUsed {
+		t.Errorf("result of a new store = %+v, want nothing loaded", result)
+	}
+	store.Set("hamlet", "bacon")
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Set("othello", "shakespeare")
+	store.Delete("othello")
+	crash(t, store)
+
+	store, result, err = NewDiskStoreWithResult(fileName, Options{})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	if result.HintUsed || result.Loaded != 5 || result.Keys != 2 {
+		t.Errorf("result of a scan = %+v, want 5 records loaded and 2 keys", result)
+	}
+	if result.LoadDuration <= 0 {
+		t.Errorf("LoadDuration = %v, want more than 0", result.LoadDuration)
+	}
+	store.Close()
+
+	store, result, err = NewDiskStoreWithResult(fileName, Options{})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if !result.HintUsed || result.Loaded != 0 || result.Keys != 2 {
+		t.Errorf("result of a hint load = %+v, want the hint used and 2 keys", result)
+	}
+	if result.LoadDuration <= 0 {
+		t.Errorf("LoadDuration = %v, want more than 0", result.LoadDuration)
+	}
+}
+
+func TestDiskStore_RecoverTornTail(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	crash(t, store)
+	info, _ := os.Stat(fileName)
+	validSize := info.Size()
+
+	// simulate a crash halfway through writing a record
+	_, torn := encodeKV(0, "anna karenina", "tolstoy")
+	file, _ := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0666)
+	file.Write(torn[:len(torn)/2])
+	file.Close()
+
+	var logs bytes.Buffer
+	store, result, err := NewDiskStoreWithResult(fileName, Options{Logger: log.New(&logs, "", 0)})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if result.Loaded != 2 {
+		t.Errorf("Loaded = %v, want %v", result.Loaded, 2)
+	}
+	if result.Recovered != 1 {
+		t.Errorf("Recovered = %v, want %v", result.Recovered, 1)
+	}
+	if result.RecoveryOffset != validSize {
+		t.Errorf("RecoveryOffset = %v, want %v", result.RecoveryOffset, validSize)
+	}
+	if !strings.Contains(logs.String(), "torn") {
+		t.Errorf("log = %q, want a recovery summary", logs.String())
+	}
+	if info, _ = os.Stat(fileName); info.Size() != validSize {
+		t.Errorf("file size = %v, want %v", info.Size(), validSize)
+	}
+	store.Set("anna karenina", "tolstoy")
+	for key, val := range map[string]string{"hamlet": "shakespeare", "dune": "frank herbert", "anna karenina": "tolstoy"} {
+		if store.Get(key) != val {
+			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		}
+	}
+}
+
+func TestDiskStore_CorruptSizeMidFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	data := encodeFileHeader(formatVersion)
+	data = append(data, encodeRecord(formatVersion, recordHeader{}, "hamlet", "shakespeare")...)
+	corrupt := len(data)
+	data = append(data, encodeRecord(formatVersion, recordHeader{}, "dune", "frank herbert")...)
+	data = append(data, encodeRecord(formatVersion, recordHeader{}, "emma", "austen")...)
+	// the value size of dune now runs past the end of the file
+	binary.LittleEndian.PutUint32(data[corrupt+12:corrupt+16], 1<<20)
+	os.WriteFile(fileName, data, 0666)
+
+	if _, err := NewDiskStoreWithOptions(fileName, Options{OpenMode: OpenStrict}); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("NewDiskStoreWithOptions(OpenStrict) error = %v, want %v", err, ErrCorruptRecord)
+	}
+	// lenient skips over it to the next valid record
+	store, result, err := NewDiskStoreWithResult(fileName, Options{OpenMode: OpenLenient})
+	if err != nil {
+		t.Fatalf("NewDiskStoreWithResult(OpenLenient) error = %v", err)
+	}
+	defer store.Close()
+	if result.Skipped != 1 || result.SkippedBytes != int64(len(encodeRecord(formatVersion, recordHeader{}, "dune", "frank herbert"))) || result.Recovered != 0 {
+		t.Errorf("OpenResult = %+v, want the record of dune skipped", result)
+	}
+	if info, _ := os.Stat(fileName); info.Size() != int64(len(data)) {
+		t.Errorf("file size = %v, want the records after the corrupt one kept at %v", info.Size(), len(data))
+	}
+	for key, val := range map[string]string{"hamlet": "shakespeare", "emma": "austen"} {
+		if got := store.Get(key); got != val {
+			t.Errorf("Get(%q) = %v, want %v", key, got, val)
+		}
+	}
+	if _, ok := store.Lookup("dune"); ok {
+		t.Errorf("Lookup() found the key of the corrupt record")
+	}
+}
+
+func TestDiskStore_OpenMode(t *testing.T) {
+	for name, corrupt := range map[string]func(fileName string){
+		"torn": func(fileName string) {
+			_, torn := encodeKV(0, "anna karenina", "tolstoy")
+			file, _ := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0666)
+			file.Write(torn[:len(torn)/2])
+			file.Close()
+		},
+		"checksum": func(fileName string) {
+			info, _ := os.Stat(fileName)
+			file, _ := os.OpenFile(fileName, os.O_WRONLY, 0666)
+			file.WriteAt([]byte("X"), info.Size()-1) // last byte of the value of dune
+			file.Close()
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "test.db")
+			store, err := NewDiskStore(fileName)
+			if err != nil {
+				t.Fatalf("failed to create disk store: %v", err)
+			}
+			store.Set("hamlet", "shakespeare")
+			store.Set("dune", "frank herbert")
+			crash(t, store)
+			corrupt(fileName)
+
+			if _, err := NewDiskStoreWithOptions(fileName, Options{OpenMode: OpenStrict}); !errors.Is(err, ErrCorruptRecord) {
+				t.Fatalf("NewDiskStoreWithOptions(OpenStrict) error = %v, want %v", err, ErrCorruptRecord)
+			}
+			store, err = NewDiskStoreWithOptions(fileName, Options{OpenMode: OpenLenient})
+			if err != nil {
+				t.Fatalf("NewDiskStoreWithOptions(OpenLenient) error = %v", err)
+			}
+			defer store.Close()
+			if store.Get("hamlet") != "shakespeare" {
+				t.Errorf("Get() = %v, want %v", store.Get("hamlet"), "shakespeare")
+			}
+		})
+	}
+}
+
+// flakyFile fails the first failures writes, after writing half of the data
+type flakyFile struct {
+	*os.File
+	failures int
+}
+
+func (f *flakyFile) Write(data []byte) (int, error) {
+	if f.failures > 0 {
+		f.failures--
+		n, _ := f.File.Write(data[:len(data)/2])
+		return n, errors.New("transient write error")
+	}
+	return f.File.Write(data)
+}
+
+func TestDiskStore_WriteRetries(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{WriteRetries: 2, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.writer = &flakyFile{File: store.file, failures: 1}
+	if err := store.Set("hamlet", "shakespeare"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	store.Set("dune", "frank herbert")
+	if store.Get("hamlet") != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", store.Get("hamlet"), "shakespeare")
+	}
+	store.Close()
+
+	// the retry must not leave the torn first attempt in the file
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	count := 0
+	it := store.RawRecords()
+	for it.Next() {
+		count++
+	}
+	if it.Err() != nil || count != 2 {
+		t.Errorf("file has %v records (error %v), want 2", count, it.Err())
+	}
+	if store.Get("dune") != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", store.Get("dune"), "frank herbert")
+	}
+}
+
+func TestDiskStore_WriteRetriesExhausted(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{WriteRetries: 1, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.writer = &flakyFile{File: store.file, failures: 2}
+	if err := store.Set("hamlet", "shakespeare"); err == nil {
+		t.Errorf("Set() error = nil, want the last write error")
+	}
+	if _, ok := store.keyStore.Get("hamlet"); ok {
+		t.Errorf("failed Set() must not update the keyStore")
+	}
+}
+
+// fullDiskFile writes only half of the data, without reporting an error
+type fullDiskFile struct {
+	*os.File
+}
+
+func (f *fullDiskFile) Write(data []byte) (int, error) {
+	return f.File.Write(data[:len(data)/2])
+}
+
+func TestDiskStore_DiskFull(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{WriteRetries: 3, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	before, _ := os.Stat(fileName)
+
+	store.writer = &fullDiskFile{File: store.file}
+	if err := store.Set("hamlet", "bacon"); !errors.Is(err, ErrDiskFull) {
+		t.Errorf("Set() error = %v, want %v", err, ErrDiskFull)
+	}
+	if after, _ := os.Stat(fileName); after.Size() != before.Size() {
+		t.Errorf("file size = %v, want it rolled back to %v", after.Size(), before.Size())
+	}
+	if val := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+
+	// once space is freed, writes go through again
+	store.writer = store.file
+	if err := store.Set("hamlet", "bacon"); err != nil {
+		t.Errorf("Set() error = %v", err)
+	}
+	if val := store.Get("hamlet"); val != "bacon" {
+		t.Errorf("Get() = %v, want %v", val, "bacon")
+	}
+}
+
+// syncCountingFile counts the syncs of the data file
+type syncCountingFile struct {
+	*os.File
+	syncs int
+}
+
+func (f *syncCountingFile) Sync() error {
+	f.syncs++
+	return f.File.Sync()
+}
+
+func TestDiskStore_SyncEveryN(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{SyncEveryN: 3})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	file := &syncCountingFile{File: store.file}
+	store.writer = file
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	if file.syncs != 0 {
+		t.Errorf("synced %d times after 2 writes, want 0", file.syncs)
+	}
+	store.Delete("dune")
+	if file.syncs != 1 {
+		t.Errorf("synced %d times after 3 writes, want 1", file.syncs)
+	}
+	store.Set("othello", "shakespeare")
+	if err := store.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	store.Set("macbeth", "shakespeare")
+	store.Set("emma", "austen")
+	if file.syncs != 2 {
+		t.Errorf("synced %d times, want the counter reset by Sync", file.syncs)
+	}
+	store.Set("ulysses", "joyce")
+	if file.syncs != 3 {
+		t.Errorf("synced %d times after 3 more writes, want 3", file.syncs)
+	}
+
+	// simulate a crash: the synced writes are all there on the next open
+	crash(t, store)
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	for key, want := range map[string]string{"hamlet": "shakespeare", "othello": "shakespeare", "ulysses": "joyce"} {
+		if val := store.Get(key); val != want {
+			t.Errorf("Get(%q) = %v, want %v", key, val, want)
+		}
+	}
+	if _, ok := store.Lookup("dune"); ok {
+		t.Errorf("Lookup() found a deleted key")
+	}
+}
+
+func TestDiskStore_ConcurrentSet(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	const writers, keys = 8, 50
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keys; i++ {
+				key := fmt.Sprintf("key-%d-%d", w, i)
+				if err := store.Set(key, "draft"); err != nil {
+					t.Errorf("Set() error = %v", err)
+				}
+				if err := store.Set(key, key); err != nil {
+					t.Errorf("Set() error = %v", err)
+				}
+				if val := store.Get(key); val != key {
+					t.Errorf("Get() = %v, want %v", val, key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("key-%d-%d", w, i)
+			if val := store.Get(key); val != key {
+				t.Errorf("Get() = %v, want %v", val, key)
+			}
+		}
+	}
+	it := store.RawRecords()
+	count := 0
+	for it.Next() {
+		count++
+	}
+	if it.Err() != nil || count != 2*writers*keys {
+		t.Errorf("file has %v records (error %v), want %v", count, it.Err(), 2*writers*keys)
+	}
+}
+
+func BenchmarkDiskStore_SetParallel(b *testing.B) {
+	for _, shards := range []int{1, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			store, err := NewDiskStoreWithOptions(filepath.Join(b.TempDir(), "test.db"), Options{LockShards: shards})
+			if err != nil {
+				b.Fatalf("failed to create disk store: %v", err)
+			}
+			defer store.Close()
+			var n atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					store.Set(fmt.Sprintf("key-%d", n.Add(1)), "value")
+				}
+			})
+		})
+	}
+}
+
+func TestDiskStore_GroupCommit(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{GroupCommit: true, SeparateValues: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	const writers, keys = 16, 50
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range keys {
+				key := fmt.Sprintf("key-%d-%d", w, k)
+				if err := store.Set(key, strings.Repeat(key, k)); err != nil {
+					t.Errorf("Set() error = %v", err)
+				}
+				if k%10 == 0 {
+					if err := store.Delete(key); err != nil {
+						t.Errorf("Delete() error = %v", err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	check := func(store *DiskStore) {
+		t.Helper()
+		for w := range writers {
+			for k := range keys {
+				key := fmt.Sprintf("key-%d-%d", w, k)
+				value, ok := store.Lookup(key)
+				if k%10 == 0 {
+					if ok {
+						t.Errorf("Lookup(%q) found a deleted key", key)
+					}
+				} else if want := strings.Repeat(key, k); value != want {
+					t.Errorf("Get(%q) = %q, want %q", key, value, want)
+				}
+			}
+		}
+	}
+	check(store)
+	store.Close()
+	if err := store.Set("closed", "value"); err == nil {
+		t.Errorf("Set() after Close() succeeded")
+	}
+	store, err = NewDiskStoreWithOptions(fileName, Options{SeparateValues: true})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	check(store)
+}
+
+func BenchmarkDiskStore_GroupCommit(b *testing.B) {
+	for _, groupCommit := range []bool{false, true} {
+		b.Run(fmt.Sprintf("group=%v", groupCommit), func(b *testing.B) {
+			store, err := NewDiskStoreWithOptions(filepath.Join(b.TempDir(), "test.db"), Options{GroupCommit: groupCommit})
+			if err != nil {
+				b.Fatalf("failed to create disk store: %v", err)
+			}
+			defer store.Close()
+			var n atomic.Int64
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					store.Set(fmt.Sprintf("key-%d", n.Add(1)), "value")
+				}
+			})
+		})
+	}
+}
+
+func TestDiskStore_Fetch(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("name", "jojo")
+	store.Set("empty", "")
+
+	if val, err := store.Fetch("name"); err != nil || val != "jojo" {
+		t.Errorf("Fetch() = %v, %v, want %v, nil", val, err, "jojo")
+	}
+	if val, err := store.Fetch("empty"); err != nil || val != "" {
+		t.Errorf("Fetch() = %v, %v, want '', nil", val, err)
+	}
+	if _, err := store.Fetch("some key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Fetch() error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestDiskStore_Lookup(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("empty", "")
+
+	if val, ok := store.Lookup("empty"); !ok || val != "" {
+		t.Errorf("Lookup() = %v, %v, want '', true", val, ok)
+	}
+	if _, ok := store.Lookup("some key"); ok {
+		t.Errorf("Lookup() ok = true, want false")
+	}
+}
+
+func TestDiskStore_GetOr(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("empty", "")
+	store.Set("hamlet", "shakespeare")
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"empty", ""},
+		{"hamlet", "shakespeare"},
+		{"some key", "default"},
+	}
+	for _, tt := range tests {
+		if val := store.GetOr(tt.key, "default"); val != tt.want {
+			t.Errorf("GetOr(%q) = %v, want %v", tt.key, val, tt.want)
+		}
+	}
+}
+
+func TestDiskStore_Put(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+
+	prev, existed, err := store.Put("hamlet", "bacon")
+	if err != nil || existed || prev != "" {
+		t.Errorf("Put() = %v, %v, %v, want '', false, nil", prev, existed, err)
+	}
+	prev, existed, err = store.Put("hamlet", "shakespeare")
+	if err != nil || !existed || prev != "bacon" {
+		t.Errorf("Put() = %v, %v, %v, want %v, true, nil", prev, existed, err, "bacon")
+	}
+	if val := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+}
+
+func TestDiskStore_VerifyOnRead(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{VerifyOnRead: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("othello", "shakespeare")
+	if _, err := store.Fetch("hamlet"); err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+
+	// point hamlet at the record of othello, which is just as long
+	entry, _ := store.keyStore.Get("othello")
+	store.keyStore.Set("hamlet", entry)
+	if _, err := store.Fetch("hamlet"); !errors.Is(err, ErrIndexCorrupt) {
+		t.Errorf("Fetch() error = %v, want %v", err, ErrIndexCorrupt)
+	}
+}
+
+func TestDiskStore_ShortRecord(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+
+	// truncate the file behind the store's back, in the middle of the last record
+	info, _ := os.Stat(fileName)
+	os.Truncate(fileName, info.Size()-5)
+	entry, _ := store.keyStore.Get("dune")
+
+	_, err = store.Fetch("dune")
+	var short *ShortRecordError
+	if !errors.Is(err, ErrShortRecord) || !errors.As(err, &short) {
+		t.Fatalf("Fetch() error = %v, want %v", err, ErrShortRecord)
+	}
+	if short.Key != "dune" || short.Expected != int64(entry.totalSize) || short.Actual != int64(entry.totalSize)-5 {
+		t.Errorf("ShortRecordError = %+v, want key dune with %d of %d bytes", short, entry.totalSize-5, entry.totalSize)
+	}
+	if val, err := store.Fetch("hamlet"); err != nil || val != "shakespeare" {
+		t.Errorf("Fetch() = %v, %v, want %v, nil", val, err, "shakespeare")
+	}
+}
+
+func TestDiskStore_OffsetOutOfRange(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	info, _ := os.Stat(fileName)
+	// the keyStore of a stale hint can point at records which are gone
+	store.keyStore.Set("dune", KeyEntry{timestamp: 1, position: uint32(info.Size()) + 100, totalSize: 40})
+
+	if _, err := store.Fetch("dune"); !errors.Is(err, ErrOffsetOutOfRange) {
+		t.Errorf("Fetch() error = %v, want %v", err, ErrOffsetOutOfRange)
+	}
+	if val, err := store.Fetch("hamlet"); err != nil || val != "shakespeare" {
+		t.Errorf("Fetch() = %v, %v, want %v, nil", val, err, "shakespeare")
+	}
+}
+
+func TestDiskStore_RecordMismatch(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Set("othello", "shakespeare")
+	for key, delta := range map[string]int{"hamlet": 5, "dune": -1, "othello": -100} {
+		entry, _ := store.keyStore.Get(key)
+		entry.totalSize = uint32(max(int(entry.totalSize)+delta, 0))
+		store.keyStore.Set(key, entry)
+		if _, err := store.Fetch(key); !errors.Is(err, ErrRecordMismatch) {
+			t.Errorf("Fetch(%q) with a totalSize off by %d: error = %v, want %v", key, delta, err, ErrRecordMismatch)
+		}
+	}
+}
+
+func TestDiskStore_KeyQuota(t *testing.T) {
+	quota := func(key string) int64 {
+		if strings.HasPrefix(key, "free:") {
+			return 8
+		}
+		return 0
+	}
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{KeyQuota: quota})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+
+	if err := store.Set("free:hamlet", "bard"); err != nil {
+		t.Errorf("Set() error = %v", err)
+	}
+	if err := store.Set("free:hamlet", "shakespeare"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Set() error = %v, want %v", err, ErrQuotaExceeded)
+	}
+	if _, _, err := store.Put("free:dune", "frank herbert"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Put() error = %v, want %v", err, ErrQuotaExceeded)
+	}
+	if err := store.Set("paid:hamlet", "shakespeare"); err != nil {
+		t.Errorf("Set() error = %v", err)
+	}
+	if val := store.Get("free:hamlet"); val != "bard" {
+		t.Errorf("Get() = %v, want %v", val, "bard")
+	}
+	if _, ok := store.Lookup("free:dune"); ok {
+		t.Errorf("Lookup() found a value rejected by the quota")
+	}
+}
+
+func TestDiskStore_MaxTotalSize(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxTotalSize: 1024})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// overwrites are reclaimed by compaction, so they never fill the store
+	for i := 0; i < 100; i++ {
+		if err := store.Set("hamlet", fmt.Sprintf("draft %d", i)); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if _, _, err := store.Put("hamlet", fmt.Sprintf("draft %d", i)); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	var i int
+	for ; i < 100; i++ {
+		if err = store.Set(fmt.Sprintf("key-%d", i), "value"); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrStoreFull) {
+		t.Fatalf("Set() error = %v, want %v", err, ErrStoreFull)
+	}
+	if info, _ := os.Stat(fileName); info.Size() > 1024 {
+		t.Errorf("file size = %v, want at most %v", info.Size(), 1024)
+	}
+	if _, ok := store.Lookup(fmt.Sprintf("key-%d", i)); ok {
+		t.Errorf("failed Set() must not update the keyStore")
+	}
+	// deleting frees space once compacted
+	if err := store.Delete("key-0"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := store.Set(fmt.Sprintf("key-%d", i), "value"); err != nil {
+		t.Errorf("Set() after Delete() error = %v", err)
+	}
+	if val := store.Get("hamlet"); val != "draft 99" {
+		t.Errorf("Get() = %v, want %v", val, "draft 99")
+	}
+}
+
+func TestDiskStore_OpenNotACaskDB(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "photo.jpg")
+	garbage := make([]byte, 1024)
+	rand.New(rand.NewSource(1)).Read(garbage)
+	os.WriteFile(fileName, garbage, 0666)
+
+	if _, err := NewDiskStore(fileName); !errors.Is(err, ErrNotACaskDB) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrNotACaskDB)
+	}
+	if data, _ := os.ReadFile(fileName); !bytes.Equal(data, garbage) {
+		t.Errorf("NewDiskStore() modified a file which is not a caskdb file")
+	}
+}
+
+func TestDiskStore_OpenUnsupportedVersion(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	os.WriteFile(fileName, encodeFileHeader(formatVersion+1), 0666)
+
+	if _, err := NewDiskStore(fileName); !errors.Is(err, ErrNotACaskDB) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrNotACaskDB)
+	}
+}
+
+// baselineRecord encodes a record like the original encodeKV did, with a 12 byte
+// header and no crc
+func baselineRecord(timestamp uint32, key string, value string) []byte {
+	var result [12]byte
+	binary.LittleEndian.PutUint32(result[:4], timestamp)
+	binary.LittleEndian.PutUint32(result[4:8], uint32(len(key)))
+	binary.LittleEndian.PutUint32(result[8:12], uint32(len(value)))
+	return append(append(result[:], key...), value...)
+}
+
+func TestDiskStore_OpenBaselineFormat(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	var baseline []byte
+	baseline = append(baseline, baselineRecord(1700000000, "hamlet", "bacon")...)
+	baseline = append(baseline, baselineRecord(1700000001, "hamlet", "shakespeare")...)
+	baseline = append(baseline, baselineRecord(1700000002, "dune", "frank herbert")...)
+	os.WriteFile(fileName, baseline, 0666)
+
+	store, err := NewDiskStoreWithOptions(fileName, Options{LegacyFormat: true})
+	if err != nil {
+		t.Fatalf("failed to open baseline disk store: %v", err)
+	}
+	if store.version != 0 {
+		t.Errorf("version = %v, want %v", store.version, 0)
+	}
+	if info, _ := os.Stat(fileName); info.Size() != int64(len(baseline)) {
+		t.Errorf("file size = %v, want the baseline file untouched at %v", info.Size(), len(baseline))
+	}
+	store.Set("anna karenina", "tolstoy")
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, Options{LegacyFormat: true})
+	if err != nil {
+		t.Fatalf("failed to reopen baseline disk store: %v", err)
+	}
+	tests := map[string]string{"hamlet": "shakespeare", "dune": "frank herbert", "anna karenina": "tolstoy"}
+	for key, val := range tests {
+		if got := store.Get(key); got != val {
+			t.Errorf("Get(%q) = %v, want %v", key, got, val)
+		}
+	}
+	if _, ts, _ := store.GetWithTimestamp("dune"); ts.Unix() != 1700000002 {
+		t.Errorf("GetWithTimestamp() ts = %v, want %v", ts.Unix(), 1700000002)
+	}
+	store.Close()
+
+	// a torn record at the end is not truncated away, as there is no crc to tell
+	// it from a corrupt one
+	os.Remove(hintFileName(fileName))
+	torn := append(append([]byte{}, baseline...), baselineRecord(1700000003, "emma", "austen")[:15]...)
+	os.WriteFile(fileName, torn, 0666)
+	if _, err := NewDiskStoreWithOptions(fileName, Options{LegacyFormat: true}); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrCorruptRecord)
+	}
+	if info, _ := os.Stat(fileName); info.Size() != int64(len(torn)) {
+		t.Errorf("file size = %v, want the legacy file untouched at %v", info.Size(), len(torn))
+	}
+}
+
+func TestDiskStore_OpenLegacyFormat(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	var legacy []byte
+	for _, kv := range [][2]string{{"hamlet", "shakespeare"}, {"dune", "frank herbert"}} {
+		legacy = append(legacy, encodeRecord(1, recordHeader{}, kv[0], kv[1])...)
+	}
+	os.WriteFile(fileName, legacy, 0666)
+
+	if _, err := NewDiskStore(fileName); !errors.Is(err, ErrNotACaskDB) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrNotACaskDB)
+	}
+	store, err := NewDiskStoreWithOptions(fileName, Options{LegacyFormat: true})
+	if err != nil {
+		t.Fatalf("failed to open legacy disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("anna karenina", "tolstoy")
+	tests := map[string]string{"hamlet": "shakespeare", "dune": "frank herbert", "anna karenina": "tolstoy"}
+	for key, val := range tests {
+		if store.Get(key) != val {
+			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		}
+	}
+}
+
+func TestDiskStore_OpenExistingAndFresh(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	fds, fdErr := os.ReadDir("/proc/self/fd")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if fdErr == nil {
+		if after, _ := os.ReadDir("/proc/self/fd"); len(after) != len(fds)+2 {
+			t.Errorf("open file descriptors = %v, want only the data file and its read handle on top of %v", len(after), len(fds))
+		}
+	}
+	if store.keyStore.Len() != 0 {
+		t.Errorf("keyStore.Len() = %v of a fresh file, want 0", store.keyStore.Len())
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Close()
+
+	// without the hint, the existing records have to be scanned
+	os.Remove(hintFileName(fileName))
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if store.keyStore.Len() != 2 || store.Get("dune") != "frank herbert" {
+		t.Errorf("keyStore.Len() = %v, want the existing file indexed", store.keyStore.Len())
+	}
+}
+
+func TestOpenOrCreate(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, created, err := OpenOrCreate(fileName, Options{})
+	if err != nil {
+		t.Fatalf("OpenOrCreate() error = %v", err)
+	}
+	if !created {
+		t.Errorf("OpenOrCreate() created = %v of a new file, want %v", created, true)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+
+	store, created, err = OpenOrCreate(fileName, Options{})
+	if err != nil {
+		t.Fatalf("OpenOrCreate() error = %v", err)
+	}
+	if created {
+		t.Errorf("OpenOrCreate() created = %v of an existing file, want %v", created, false)
+	}
+	if got := store.Get("hamlet"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", got, "shakespeare")
+	}
+	store.Close()
+
+	// an empty file created ahead of time already exists
+	emptyName := filepath.Join(t.TempDir(), "empty.db")
+	os.WriteFile(emptyName, nil, 0666)
+	store, created, err = OpenOrCreate(emptyName, Options{})
+	if err != nil {
+		t.Fatalf("OpenOrCreate() error = %v", err)
+	}
+	defer store.Close()
+	if created {
+		t.Errorf("OpenOrCreate() created = %v of an empty file, want %v", created, false)
+	}
+}
+
+func TestDiskStore_OpenEmptyFile(t *testing.T) {
+	tests := map[string][]byte{
+		"zero bytes":  nil,
+		"header only": encodeFileHeader(formatVersion),
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "test.db")
+			os.WriteFile(fileName, data, 0666)
+
+			store, err := NewDiskStore(fileName)
+			if err != nil {
+				t.Fatalf("failed to open disk store: %v", err)
+			}
+			if stats, _ := store.Stats(); stats.Keys != 0 {
+				t.Errorf("Keys = %v, want %v", stats.Keys, 0)
+			}
+			if _, ok := store.Lookup("hamlet"); ok {
+				t.Errorf("Lookup() ok = true, want false")
+			}
+			if err := store.Set("hamlet", "shakespeare"); err != nil {
+				t.Fatalf("Set() error = %v", err)
+			}
+			store.Close()
+
+			store, err = NewDiskStore(fileName)
+			if err != nil {
+				t.Fatalf("failed to open disk store: %v", err)
+			}
+			defer store.Close()
+			if store.Get("hamlet") != "shakespeare" {
+				t.Errorf("Get() = %v, want %v", store.Get("hamlet"), "shakespeare")
+			}
+		})
+	}
+}
+
+func TestDiskStore_SetWithMeta(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if err := store.SetWithMeta("logo", "<svg/>", 42); err != nil {
+		t.Fatalf("SetWithMeta() error = %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if val, meta, ok := store.GetMeta2("logo"); !ok || val != "<svg/>" || meta != 42 {
+		t.Errorf("GetMeta2() = %v, %v, %v, want %v, %v, true", val, meta, ok, "<svg/>", 42)
+	}
+	if val, meta, ok := store.GetMeta2("hamlet"); !ok || val != "shakespeare" || meta != 0 {
+		t.Errorf("GetMeta2() = %v, %v, %v, want %v, 0, true", val, meta, ok, "shakespeare")
+	}
+	if _, _, ok := store.GetMeta2("some key"); ok {
+		t.Errorf("GetMeta2() ok = true, want false")
+	}
+}
+
+func TestDiskStore_SetWithTimestamp(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if err := store.SetWithTimestamp("hamlet", "shakespeare", 1000); err != nil {
+		t.Fatalf("SetWithTimestamp() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if entry, _ := store.keyStore.Get("hamlet"); entry.timestamp != 1000 {
+		t.Errorf("timestamp = %v, want %v", entry.timestamp, 1000)
+	}
+
+	// an older write loses against the stored timestamp, a newer one wins
+	store.Apply(ChangeEvent{Op: ChangeSet, Key: "hamlet", Value: "bacon", Timestamp: 999})
+	if val := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	store.Apply(ChangeEvent{Op: ChangeSet, Key: "hamlet", Value: "marlowe", Timestamp: 1001})
+	if val := store.Get("hamlet"); val != "marlowe" {
+		t.Errorf("Get() = %v, want %v", val, "marlowe")
+	}
+}
+
+func TestDiskStore_GetWithTimestamp(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	before := time.Now().Truncate(time.Second)
+	store.Set("hamlet", "shakespeare")
+	after := time.Now()
+	store.SetWithTimestamp("dune", "frank herbert", 1700000000)
+
+	val, ts, ok := store.GetWithTimestamp("hamlet")
+	if !ok || val != "shakespeare" {
+		t.Errorf("GetWithTimestamp() = %v, %v, want shakespeare, true", val, ok)
+	}
+	if ts.Before(before) || ts.After(after) {
+		t.Errorf("GetWithTimestamp() time = %v, want between %v and %v", ts, before, after)
+	}
+	if _, ts, _ := store.GetWithTimestamp("dune"); !ts.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("GetWithTimestamp() time = %v, want %v", ts, time.Unix(1700000000, 0))
+	}
+	if val, ts, ok := store.GetWithTimestamp("othello"); ok || val != "" || !ts.IsZero() {
+		t.Errorf("GetWithTimestamp() = %v, %v, %v, want an absent key", val, ts, ok)
+	}
+}
+
+func TestDiskStore_MonotonicTimestamps(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+	store, err := NewDiskStoreWithOptions(fileName, Options{Clock: clock, MonotonicTimestamps: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "draft")
+	// the clock is stepped back, then slowly catches up
+	for _, step := range []time.Duration{-time.Hour, time.Minute, 2 * time.Hour} {
+		now = now.Add(step)
+		store.Set("hamlet", now.String())
+		store.Set("dune", "frank herbert")
+		store.Delete("dune")
+		store.SetWithMeta("othello", "shakespeare", 1)
+	}
+	// the last record is a tombstone, which the keyStore does not hold
+	store.Delete("othello")
+	store.Close()
+	// 4 records past the catch up at +1h1m, then the tombstone
+	latest := uint32(time.Unix(1700000000, 0).Add(time.Hour+time.Minute).Unix()) + 4
+
+	// the latest timestamp survives reopening
+	now = time.Unix(1600000000, 0)
+	store, err = NewDiskStoreWithOptions(fileName, Options{Clock: clock, MonotonicTimestamps: true})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("macbeth", "shakespeare")
+	store.SetWithTTL("emma", "austen", time.Second)
+	now = now.Add(2 * time.Second)
+	if n, err := store.ExpireExpiredKeys(); err != nil || n != 1 {
+		t.Fatalf("ExpireExpiredKeys() = %v, %v, want 1, nil", n, err)
+	}
+
+	var timestamps []uint32
+	it := store.RawRecords()
+	for it.Next() {
+		timestamps = append(timestamps, it.Record().Timestamp)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("RawRecords() error = %v", err)
+	}
+	for i := 1; i < len(timestamps); i++ {
+		if timestamps[i] <= timestamps[i-1] {
+			t.Fatalf("timestamps = %v, want every one later than the one before", timestamps)
+		}
+	}
+	// macbeth, emma and the tombstone expiring emma follow the tombstone of othello
+	if last := timestamps[len(timestamps)-1]; last != latest+3 {
+		t.Errorf("last timestamp = %v, want %v", last, latest+3)
+	}
+}
+
+func TestDiskStore_MetaVersion1(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	data := encodeFileHeader(1)
+	data = append(data, encodeRecord(1, recordHeader{}, "hamlet", "shakespeare")...)
+	os.WriteFile(fileName, data, 0666)
+
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if val, meta, ok := store.GetMeta2("hamlet"); !ok || val != "shakespeare" || meta != 0 {
+		t.Errorf("GetMeta2() = %v, %v, %v, want %v, 0, true", val, meta, ok, "shakespeare")
+	}
+	if err := store.SetWithMeta("logo", "<svg/>", 42); !errors.Is(err, ErrOldFormat) {
+		t.Errorf("SetWithMeta() error = %v, want %v", err, ErrOldFormat)
+	}
+	store.Set("dune", "frank herbert")
+
+	// compaction upgrades the file to the current version
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if err := store.SetWithMeta("logo", "<svg/>", 42); err != nil {
+		t.Fatalf("SetWithMeta() error = %v", err)
+	}
+	for key, val := range map[string]string{"hamlet": "shakespeare", "dune": "frank herbert", "logo": "<svg/>"} {
+		if store.Get(key) != val {
+			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		}
+	}
+}
+
+func TestDiskStore_DeleteKey(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	if err := store.Delete("hamlet"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := store.Delete("some key"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, ok := store.Lookup("hamlet"); ok {
+		t.Errorf("Lookup() found a deleted key")
+	}
+	store.Close()
+
+	// the tombstone must survive reopening both from the hint and by scanning
+	for _, removeHint := range []bool{false, true} {
+		if removeHint {
+			os.Remove(hintFileName(fileName))
+		}
+		store, err = NewDiskStore(fileName)
+		if err != nil {
+			t.Fatalf("failed to open disk store: %v", err)
+		}
+		if _, ok := store.Lookup("hamlet"); ok {
+			t.Errorf("Lookup() found a deleted key after reopening")
+		}
+		if store.Get("dune") != "frank herbert" {
+			t.Errorf("Get() = %v, want %v", store.Get("dune"), "frank herbert")
+		}
+		store.Close()
+	}
+}
+
+// skewedFile reports the end of the file one byte further than it is, like an
+// append path which lost track of the offsets
+type skewedFile struct {
+	*os.File
+}
+
+func (f *skewedFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.File.Seek(offset, whence)
+	return pos + 1, err
+}
+
+func TestDiskStore_DebugAsserts(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{DebugAsserts: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if err := store.Set("hamlet", "shakespeare"); err != nil {
+		t.Errorf("Set() error = %v", err)
+	}
+	if err := store.Delete("hamlet"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+
+	store.writer = &skewedFile{File: store.file}
+	if err := store.Set("othello", "shakespeare"); !errors.Is(err, ErrAssertion) {
+		t.Errorf("Set() error = %v, want %v", err, ErrAssertion)
+	}
+	if _, ok := store.keyStore.Get("othello"); ok {
+		t.Errorf("keyStore points at a misplaced record")
+	}
+}
+
+func TestOpenWithContext(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	loader, err := NewLoader(fileName)
+	if err != nil {
+		t.Fatalf("NewLoader() error = %v", err)
+	}
+	for i := 0; i < 100000; i++ {
+		loader.Add(fmt.Sprintf("key-%d", i), "value")
+	}
+	loaded, err := loader.Finish()
+	if err != nil {
+		t.Fatalf("Finish() error = %v", err)
+	}
+	loaded.Close()
+	// without the hint, opening has to scan the whole file
+	os.Remove(hintFileName(fileName))
+
+	fds, fdErr := os.ReadDir("/proc/self/fd")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	store, err := OpenWithContext(ctx, fileName, Options{})
+	if !errors.Is(err, context.DeadlineExceeded) || store != nil {
+		t.Errorf("OpenWithContext() = %v, %v, want %v", store, err, context.DeadlineExceeded)
+	}
+	if fdErr == nil {
+		if after, _ := os.ReadDir("/proc/self/fd"); len(after) != len(fds) {
+			t.Errorf("open file descriptors = %v, want %v", len(after), len(fds))
+		}
+	}
+
+	store, err = OpenWithContext(context.Background(), fileName, Options{})
+	if err != nil {
+		t.Fatalf("OpenWithContext() error = %v", err)
+	}
+	defer store.Close()
+	if val := store.Get("key-99999"); val != "value" {
+		t.Errorf("Get() = %v, want value", val)
+	}
+}
+
+// countdownContext is done once its Err has been checked checks times
+type countdownContext struct {
+	context.Context
+	checks int
+}
+
+func (c *countdownContext) Err() error {
+	if c.checks <= 0 {
+		return context.DeadlineExceeded
+	}
+	c.checks--
+	return nil
+}
+
+func TestOpenWithContextResume(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	loader, err := NewLoader(fileName)
+	if err != nil {
+		t.Fatalf("NewLoader() error = %v", err)
+	}
+	for i := 0; i < 10*scanCheckInterval; i++ {
+		loader.Add(fmt.Sprintf("key-%d", i%(3*scanCheckInterval)), fmt.Sprintf("value-%d", i))
+	}
+	store, err := loader.Finish()
+	if err != nil {
+		t.Fatalf("Finish() error = %v", err)
+	}
+	store.Delete("key-7")
+	store.Close()
+	os.Remove(hintFileName(fileName))
+	full, err := NewDiskStoreWithOptions(fileName, Options{})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	want, _ := full.Digest()
+	full.Close()
+	os.Remove(hintFileName(fileName))
+
+	// every open gets a little further, saving its progress in the hint file
+	var resumed int
+	for checks := 3; ; checks += 3 {
+		ctx := &countdownContext{Context: context.Background(), checks: checks}
+		store, err = OpenWithContext(ctx, fileName, Options{})
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("OpenWithContext() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+		if _, err := os.Stat(hintFileName(fileName)); err != nil {
+			t.Fatalf("interrupted OpenWithContext() saved no checkpoint: %v", err)
+		}
+		resumed++
+	}
+	defer store.Close()
+	if resumed < 2 {
+		t.Errorf("OpenWithContext() was interrupted %v times, want at least 2", resumed)
+	}
+	if got, _ := store.Digest(); !bytes.Equal(got, want) {
+		t.Errorf("Digest() after resuming = %x, want %x of a full scan", got, want)
+	}
+	if _, ok := store.Lookup("key-7"); ok {
+		t.Errorf("Lookup() found a deleted key")
+	}
+}
+
+func TestDiskStore_KeyNormalizer(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{KeyNormalizer: strings.ToLower}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("foo", "bar")
+	if val := store.Get("FOO"); val != "bar" {
+		t.Errorf("Get() = %v, want bar", val)
+	}
+	store.Set("Hamlet", "shakespeare")
+	store.Set("HAMLET", "bacon")
+	if val, ok := store.Lookup("hamlet"); !ok || val != "bacon" {
+		t.Errorf("Lookup() = %v, %v, want bacon, true", val, ok)
+	}
+	if store.keyStore.Len() != 2 {
+		t.Errorf("keyStore.Len() = %v, want 2", store.keyStore.Len())
+	}
+	if err := store.Delete("Foo"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if _, ok := store.Lookup("foo"); ok {
+		t.Errorf("Lookup() found a deleted key")
+	}
+	if val := store.Get("hamlet"); val != "bacon" {
+		t.Errorf("Get() = %v, want bacon", val)
+	}
+}
+
+func TestDiskStore_DeleteMulti(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	var keys []string
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("book-%d", i)
+		store.Set(key, "author")
+		keys = append(keys, key)
+	}
+	store.Set("hamlet", "shakespeare")
+	// absent and repeated keys are fine
+	if err := store.DeleteMulti(append(keys, "book-1", "absent")); err != nil {
+		t.Fatalf("DeleteMulti() error = %v", err)
+	}
+	if err := store.DeleteMulti(nil); err != nil {
+		t.Fatalf("DeleteMulti() error = %v", err)
+	}
+	check := func() {
+		t.Helper()
+		for _, key := range keys {
+			if _, ok := store.Lookup(key); ok {
+				t.Errorf("Lookup(%v) found a deleted key", key)
+			}
+		}
+		if val := store.Get("hamlet"); val != "shakespeare" {
+			t.Errorf("Get() = %v, want shakespeare", val)
+		}
+	}
+	check()
+	store.Close()
+
+	os.Remove(hintFileName(fileName))
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	check()
+}
+
+func TestDiskStore_DeleteMultiChecks(t *testing.T) {
+	defer func(size int64) { maxRecordSize = size }(maxRecordSize)
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{DebugAsserts: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	long := strings.Repeat("k", 100)
+	store.Set("hamlet", "shakespeare")
+	store.Set(long, "value")
+	before, _ := os.Stat(fileName)
+
+	// the tombstone of the long key is too large, so none is written
+	maxRecordSize = 64
+	if err := store.DeleteMulti([]string{"hamlet", long}); !errors.Is(err, ErrRecordTooLarge) {
+		t.Fatalf("DeleteMulti() error = %v, want %v", err, ErrRecordTooLarge)
+	}
+	if after, _ := os.Stat(fileName); after.Size() != before.Size() {
+		t.Errorf("file size = %v, want %v", after.Size(), before.Size())
+	}
+	if _, ok := store.Lookup("hamlet"); !ok {
+		t.Errorf("Lookup() did not find a key whose delete failed")
+	}
+	if err := store.DeleteMulti([]string{"hamlet"}); err != nil {
+		t.Fatalf("DeleteMulti() error = %v", err)
+	}
+	if _, ok := store.Lookup("hamlet"); ok {
+		t.Errorf("Lookup() found a deleted key")
+	}
+}
+
+func TestDiskStore_KeyBytes(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	keys := []string{"new\nline", "null\x00byte", "tab\tand:colon", "CASK", "HINT", "\xff\xfe", string(all), ""}
+	layouts := map[string]func(dir string) (*DiskStore, error){
+		"single file": func(dir string) (*DiskStore, error) {
+			return NewDiskStore(filepath.Join(dir, "test.db"))
+		},
+		"separate values": func(dir string) (*DiskStore, error) {
+			return NewDiskStoreWithOptions(filepath.Join(dir, "test.db"), Options{SeparateValues: true})
+		},
+		"segments": func(dir string) (*DiskStore, error) {
+			return Open(dir, Options{})
+		},
+	}
+	for name, open := range layouts {
+		dir := t.TempDir()
+		store, err := open(dir)
+		if err != nil {
+			t.Fatalf("%v: failed to create disk store: %v", name, err)
+		}
+		for i, key := range keys {
+			store.Set(key, fmt.Sprint(i))
+		}
+		check := func(when string) {
+			t.Helper()
+			for i, key := range keys {
+				if val, ok := store.Lookup(key); !ok || val != fmt.Sprint(i) {
+					t.Errorf("%v, %v: Lookup(%q) = %v, %v, want %v", name, when, key, val, ok, i)
+				}
+			}
+			if store.keyStore.Len() != len(keys) {
+				t.Errorf("%v, %v: keyStore.Len() = %v, want %v", name, when, store.keyStore.Len(), len(keys))
+			}
+		}
+		check("before reopening")
+		store.Close()
+
+		// reopen through the hint, then by scanning the data file
+		for _, when := range []string{"after reopening", "after scanning"} {
+			store, err = open(dir)
+			if err != nil {
+				t.Fatalf("%v: failed to open disk store: %v", name, err)
+			}
+			check(when)
+			hint := hintFileName(store.fileName)
+			store.Close()
+			os.Remove(hint)
+		}
+	}
+}
+
+func TestDiskStore_ScanBufferSize(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	want := make(map[string]string)
+	for i := range 200 {
+		key := fmt.Sprintf("key-%d", i)
+		// values from a few bytes to well past the buffer sizes below
+		want[key] = strings.Repeat("v", i*i)
+		store.Set(key, want[key])
+	}
+	for i := 0; i < 200; i += 7 {
+		key := fmt.Sprintf("key-%d", i)
+		store.Delete(key)
+		delete(want, key)
+	}
+	store.SetWithTTL("ttl", "expires", time.Hour)
+	want["ttl"] = "expires"
+	store.Close()
+	// without the hint, opening scans the whole file
+	os.Remove(hintFileName(fileName))
+
+	for _, size := range []int{-1, 0, 16, 1000} {
+		store, err := NewDiskStoreWithOptions(fileName, Options{ScanBufferSize: size})
+		if err != nil {
+			t.Fatalf("failed to open disk store with ScanBufferSize %d: %v", size, err)
+		}
+		if got := store.keyStore.Len(); got != len(want) {
+			t.Errorf("ScanBufferSize %d: loaded %d keys, want %d", size, got, len(want))
+		}
+		for key, value := range want {
+			if got := store.Get(key); got != value {
+				t.Errorf("ScanBufferSize %d: Get(%q) = %d bytes, want %d", size, key, len(got), len(value))
+			}
+		}
+		if entry, _ := store.keyStore.Get("ttl"); entry.expiresAt == 0 {
+			t.Errorf("ScanBufferSize %d: expiry of the key was not loaded", size)
+		}
+		crash(t, store)
+	}
+}
+
+func BenchmarkDiskStore_Open(b *testing.B) {
+	fileName := filepath.Join(b.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		b.Fatalf("failed to create disk store: %v", err)
+	}
+	for i := range 100000 {
+		store.Set(fmt.Sprintf("key-%d", i), "value")
+	}
+	crash(b, store)
+
+	for _, bench := range []struct {
+		name string
+		size int
+	}{{"Unbuffered", -1}, {"Buffered", 0}} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				store, err := NewDiskStoreWithOptions(fileName, Options{ScanBufferSize: bench.size})
+				if err != nil {
+					b.Fatalf("failed to open disk store: %v", err)
+				}
+				crash(b, store)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package caskdb
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// dumpValueLimit is the longest value Dump prints, longer values only get their
+// length printed
+const dumpValueLimit = 64
+
+// Dump writes a human readable table of every live key to w, ordered by offset,
+// with the length, timestamp and offset of its record. Values up to 64 bytes are
+// printed too. It is meant for debugging; use RawRecords to process the data.
+func (d *DiskStore) Dump(w io.Writer) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	type row struct {
+		key   string
+		entry KeyEntry
+	}
+	var rows []row
+	now := d.now().Unix()
+	d.keyStore.Range(func(key string, entry KeyEntry) bool {
+		if !entry.expired(now) {
+			rows = append(rows, row{key, entry})
+		}
+		return true
+	})
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].entry.position < rows[j].entry.position
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "OFFSET\tTIMESTAMP\tKEY\tLENGTH\tVALUE")
+	for _, r := range rows {
+		// the length is in the keyStore, only values short enough to show are read
+		shown := "..."
+		if r.entry.ValueSize() <= dumpValueLimit {
+			if _, value, _, err := d.getRecord(r.key); err != nil {
+				shown = "error: " + err.Error()
+			} else {
+				shown = fmt.Sprintf("%q", value)
+			}
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%q\t%d\t%s\n", r.entry.position, r.entry.timestamp, r.key, r.entry.ValueSize(), shown)
+	}
+	tw.Flush()
+}
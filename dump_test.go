@@ -0,0 +1,48 @@
+package caskdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Dump(t *testing.T) {
+	now := time.Unix(1_000_000, 0)
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{Clock: func() time.Time { return now }})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", strings.Repeat("spice", 100))
+	store.SetWithTTL("emma", "austen", time.Minute)
+	now = now.Add(time.Hour)
+
+	var b strings.Builder
+	store.Dump(&b)
+	out := b.String()
+	for _, key := range []string{"hamlet", "dune"} {
+		entry, _ := store.keyStore.Get(key)
+		found := false
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 2 && fields[0] == fmt.Sprint(entry.position) && fields[2] == fmt.Sprintf("%q", key) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Dump() = %q, want key %v at offset %v", out, key, entry.position)
+		}
+	}
+	if !strings.Contains(out, `"shakespeare"`) {
+		t.Errorf("Dump() = %q, want the short value printed", out)
+	}
+	if strings.Contains(out, "spicespice") || !strings.Contains(out, "500") {
+		t.Errorf("Dump() = %q, want only the length of the long value", out)
+	}
+	if strings.Contains(out, "emma") {
+		t.Errorf("Dump() = %q, want the expired key left out", out)
+	}
+}
@@ -0,0 +1,110 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrKeyNotFound is returned when a key does not exist in the store.
+var ErrKeyNotFound = errors.New("caskdb: key not found")
+
+// ErrNotACaskDB is returned when opening a file which does not start with the
+// caskdb file header, or was written in an unsupported version of the format.
+var ErrNotACaskDB = errors.New("caskdb: not a caskdb file")
+
+// ErrOldFormat is returned when setting metadata or deleting keys in a data file
+// written in version 0 or 1 of the format, which have no room for them. Compacting the
+// store upgrades the file to the current version.
+var ErrOldFormat = errors.New("caskdb: the data file format is too old for this operation")
+
+// ErrInvalidOffset is returned when a file offset does not point to the start of
+// a valid record.
+var ErrInvalidOffset = errors.New("caskdb: offset is not the start of a valid record")
+
+// ErrIndexCorrupt is returned with Options.VerifyOnRead when the record a key
+// points at belongs to a different key.
+var ErrIndexCorrupt = errors.New("caskdb: keyStore points at the record of another key")
+
+// ErrShortRecord is returned, wrapped in a ShortRecordError, when the data file
+// ends before the record of a key does, say because the file was truncated outside
+// of caskdb.
+var ErrShortRecord = errors.New("caskdb: record is cut short by the end of the file")
+
+// ShortRecordError describes a record cut short by the end of the data file.
+type ShortRecordError struct {
+	// Key is the key whose record is cut short.
+	Key string
+	// Expected is the size of the record.
+	Expected int64
+	// Actual is how many bytes of the record are in the file.
+	Actual int64
+}
+
+func (e *ShortRecordError) Error() string {
+	return fmt.Sprintf("%v: key %q has %d of %d bytes", ErrShortRecord, e.Key, e.Actual, e.Expected)
+}
+
+func (e *ShortRecordError) Unwrap() error {
+	return ErrShortRecord
+}
+
+// ErrRecordMismatch is returned by reads when the size of the record found at the
+// offset in the keyStore is not the size the keyStore has for it.
+var ErrRecordMismatch = errors.New("caskdb: record size does not match the keyStore")
+
+// ErrOffsetOutOfRange is returned by reads when the keyStore points past the end
+// of the file, say because it was loaded from a stale hint file.
+var ErrOffsetOutOfRange = errors.New("caskdb: keyStore points past the end of the file")
+
+// ErrIndexNotBuilt is returned by reads, and other operations which need the
+// keyStore, of a store opened with Options.DeferIndex until BuildIndex is called.
+var ErrIndexNotBuilt = errors.New("caskdb: the keyStore has not been built, call BuildIndex")
+
+// ErrDiskFull is returned when a write fails because the disk is out of space, or
+// only part of the record could be written. The partial record is truncated away,
+// so the store stays consistent and writes succeed again once space is freed.
+var ErrDiskFull = errors.New("caskdb: disk full")
+
+// ErrQuotaExceeded is returned when setting a value larger than Options.KeyQuota
+// allows for the key.
+var ErrQuotaExceeded = errors.New("caskdb: value exceeds the quota of the key")
+
+// ErrRecordTooLarge is returned when a record, after its value is compressed,
+// does not fit the 4 byte sizes of the format.
+var ErrRecordTooLarge = errors.New("caskdb: record too large")
+
+// ErrAssertion is returned by writes when Options.DebugAsserts finds the record
+// just written is not where the store thinks it is.
+var ErrAssertion = errors.New("caskdb: debug assertion failed")
+
+// ErrCompactionInProgress is returned by Compact and Shrink while another
+// compaction of the store is running.
+var ErrCompactionInProgress = errors.New("caskdb: compaction already in progress")
+
+// ErrUnsafeInPlace is returned by Shrink unless Options.AllowUnsafeInPlace is set.
+var ErrUnsafeInPlace = errors.New("caskdb: in-place shrink is not crash safe and requires Options.AllowUnsafeInPlace")
+
+// ErrInvalidCursor is returned by ScanPage when the cursor was not returned by
+// an earlier call.
+var ErrInvalidCursor = errors.New("caskdb: invalid scan cursor")
+
+// ErrEmptyEncoding is returned by writes when the codec compressed a value to
+// nothing, which is a bug in the codec.
+var ErrEmptyEncoding = errors.New("caskdb: codec returned an empty encoding")
+
+// ErrNotEqual is returned by Equal along with false, describing the first
+// difference it found.
+var ErrNotEqual = errors.New("caskdb: stores differ")
+
+// ErrStoreFull is returned by writes which would take the files of the store past
+// Options.MaxTotalSize, or the values file of Options.SeparateValues past the 4 GiB
+// its offsets can address.
+var ErrStoreFull = errors.New("caskdb: store is full")
+
+// ErrCorruptRecord is returned when opening a store with OpenStrict finds a
+// record which is torn or whose checksum does not match.
+var ErrCorruptRecord = errors.New("caskdb: corrupt record")
+
+// ErrLoaderPanicked is returned by GetOrLoad to the calls which waited on the
+// loader of another call when that loader panicked.
+var ErrLoaderPanicked = errors.New("caskdb: loader panicked")
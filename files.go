@@ -0,0 +1,24 @@
+package caskdb
+
+import "os"
+
+// Files returns the paths of the files currently making up the store: the
+// read-only segments oldest first, then the data file and, when they exist, its
+// hint file and values file. Copying them while no write, Rotate or compaction is
+// in progress gives a consistent backup.
+func (d *DiskStore) Files() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var files []string
+	for _, id := range d.segmentIDs() {
+		files = append(files, d.segments[id].fileName)
+	}
+	files = append(files, d.fileName)
+	if _, err := os.Stat(hintFileName(d.fileName)); err == nil {
+		files = append(files, hintFileName(d.fileName))
+	}
+	if d.values != nil {
+		files = append(files, valuesFileName(d.fileName))
+	}
+	return files
+}
@@ -0,0 +1,81 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDiskStore_Files(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	onDisk := func() []string {
+		t.Helper()
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, entry := range entries {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+		return files
+	}
+	check := func(want []string) {
+		t.Helper()
+		files := store.Files()
+		if !slices.Equal(files, want) {
+			t.Errorf("Files() = %v, want %v", files, want)
+		}
+		if disk := onDisk(); !slices.Equal(slices.Sorted(slices.Values(files)), disk) {
+			t.Errorf("Files() = %v, but the directory holds %v", files, disk)
+		}
+	}
+
+	store.Set("hamlet", "shakespeare")
+	check([]string{segmentFileName(dir, 1)})
+	if err := store.Rotate(); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	store.Set("dune", "frank herbert")
+	if err := store.Rotate(); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	store.Set("hamlet", "bacon")
+	if err := store.WriteHint(); err != nil {
+		t.Fatalf("WriteHint() error = %v", err)
+	}
+	check([]string{segmentFileName(dir, 1), segmentFileName(dir, 2), segmentFileName(dir, 3), hintFileName(segmentFileName(dir, 3))})
+	for key, val := range map[string]string{"hamlet": "bacon", "dune": "frank herbert"} {
+		if got := store.Get(key); got != val {
+			t.Errorf("Get(%v) = %v, want %v", key, got, val)
+		}
+	}
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	check([]string{segmentFileName(dir, 4), hintFileName(segmentFileName(dir, 4))})
+}
+
+func TestDiskStore_FilesSingleFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{SeparateValues: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	want := []string{fileName, valuesFileName(fileName)}
+	if files := store.Files(); !slices.Equal(files, want) {
+		t.Errorf("Files() = %v, want %v", files, want)
+	}
+	if err := store.Rotate(); err == nil {
+		t.Errorf("Rotate() on a single file store succeeded")
+	}
+}
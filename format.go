@@ -1,7 +1,12 @@
 package caskdb
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
 )
 
 // format file provides encode/decode functions for serialisation and deserialisation
@@ -43,78 +48,317 @@ import (
 // headerSize specifies the total header size. Our key value pair, when stored on disk
 // looks like this:
 //
-//	┌───────────┬──────────┬────────────┬─────┬───────┐
-//	│ timestamp │ key_size │ value_size │ key │ value │
-//	└───────────┴──────────┴────────────┴─────┴───────┘
+//	┌────────┬─────┬───────┐
+//	│ header │ key │ value │
+//	└────────┴─────┴───────┘
 //
 // This is analogous to a typical database's row (or a record). The total length of
 // the row is variable, depending on the contents of the key and value.
 //
-// The first three fields form the header:
+// The header is made of six fields:
 //
-//	┌───────────────┬──────────────┬────────────────┐
-//	│ timestamp(4B) │ key_size(4B) │ value_size(4B) │
-//	└───────────────┴──────────────┴────────────────┘
+//	┌─────────┬───────────────┬──────────────┬────────────────┬───────────┬──────────┐
+//	│ crc(4B) │ timestamp(4B) │ key_size(4B) │ value_size(4B) │ flags(4B) │ meta(4B) │
+//	└─────────┴───────────────┴──────────────┴────────────────┴───────────┴──────────┘
 //
-// These three fields store unsigned integers of size 4 bytes, giving our header a
-// fixed length of 12 bytes. Timestamp field stores the time the record we
+// These six fields store unsigned integers of size 4 bytes, giving our header a
+// fixed length of 24 bytes. The crc field stores the CRC-32 (IEEE) checksum of
+// everything that follows it in the record, which lets us tell a real record apart
+// from garbage or a partially written one. Timestamp field stores the time the record we
 // inserted in unix epoch seconds. Key size and value size fields store the length of
 // bytes occupied by the key and value. The maximum integer
 // stored by 4 bytes is 4,294,967,295 (2 ** 32 - 1), roughly ~4.2GB. So, the size of
 // each key or value cannot exceed this. Theoretically, a single row can be as large
-// as ~8.4GB.
-const headerSize = 12
+// as ~8.4GB. Flags describe how the record is stored, and meta is free for
+// applications to tag records with (see SetWithMeta).
+//
+// Version 1 of the format had neither flags nor meta, so its header is only 16
+// bytes long. Its records decode with both fields set to zero. Version 0, the
+// original format, had no crc either: its 12 byte header is just the timestamp
+// and the sizes, and there is nothing to check its records against.
+const headerSize = 24
+
+// headerSizeV1 is the header size of version 1 of the format
+const headerSizeV1 = 16
+
+// headerSizeV0 is the header size of version 0 of the format
+const headerSizeV0 = 12
+
+// flagTombstone marks a record deleting its key. Tombstones have an empty value.
+const flagTombstone = 1 << 0
+
+// Bits 1 to 3 of the flags hold the Codec the value is compressed with.
+
+// flagExpires marks a record set with a TTL. Its value starts with the time the
+// key expires, in unix epoch seconds (4B), followed by the value itself.
+const flagExpires = 1 << 4
+
+// expirySize is the length of the expiry time stored ahead of the value
+const expirySize = 4
+
+// crcSize is the length of the checksum stored at the start of every record
+const crcSize = 4
+
+// Every data file starts with a small file header, which tells a caskdb file apart
+// from anything else (say, a JPEG someone renamed) and records the version of the
+// format the file was written in:
+//
+//	┌───────────┬─────────────┐
+//	│ magic(4B) │ version(4B) │
+//	└───────────┴─────────────┘
+//
+// The records follow right after it. Files written before the header was
+// introduced start straight with the first record, in version 0 or 1 of the
+// format; they can still be opened with Options.LegacyFormat.
+const fileHeaderSize = 8
+
+// formatVersion is the version of the format written to new files
+const formatVersion = 2
+
+var fileMagic = []byte("CASK")
+
+func encodeFileHeader(version uint32) []byte {
+	result := append([]byte{}, fileMagic...)
+	return binary.LittleEndian.AppendUint32(result, version)
+}
+
+// decodeFileHeader returns the format version stored in header, reporting whether
+// header starts with the magic at all.
+func decodeFileHeader(header []byte) (uint32, bool) {
+	if len(header) != fileHeaderSize || !bytes.Equal(header[:len(fileMagic)], fileMagic) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(header[len(fileMagic):]), true
+}
 
 // KeyEntry keeps the metadata about the KV, specially the position of
 // the byte offset in the file. Whenever we insert/update a key, we create a new
 // KeyEntry object and insert that into keyDir.
 type KeyEntry struct {
 	timestamp uint32
-	position uint32
+	position  uint32
 	totalSize uint32
+	// segment is the id of the segment file holding the record when the store
+	// was opened with Open, 0 for a single data file
+	segment uint32
+	// expiresAt is when the key expires in unix epoch seconds, 0 if never
+	expiresAt uint32
+	// valueSize is the length of the value, once decompressed
+	valueSize uint32
+}
+
+// expired reports whether the key of e has expired at now, in unix epoch seconds
+func (e KeyEntry) expired(now int64) bool {
+	return e.expiresAt != 0 && int64(e.expiresAt) <= now
+}
+
+// Timestamp returns when the record of e was written, in whole seconds
+func (e KeyEntry) Timestamp() time.Time {
+	return time.Unix(int64(e.timestamp), 0)
+}
+
+// Size returns the size of the record of e in the data file, header and key
+// included
+func (e KeyEntry) Size() int64 {
+	return int64(e.totalSize)
+}
+
+// ValueSize returns the length of the value of e, once decompressed, which is
+// what Get returns
+func (e KeyEntry) ValueSize() int64 {
+	return int64(e.valueSize)
+}
+
+// ExpiresAt returns when the key of e expires, the zero time if it never does
+func (e KeyEntry) ExpiresAt() time.Time {
+	if e.expiresAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(e.expiresAt), 0)
 }
 
 // Creates a KeyEntry object
 func NewKeyEntry(timestamp uint32, position uint32, totalSize uint32) KeyEntry {
-	return KeyEntry{timestamp, position, totalSize}
+	return KeyEntry{timestamp: timestamp, position: position, totalSize: totalSize}
 }
 
-func encodeHeader(timestamp uint32, keySize uint32, valueSize uint32) []byte {
-	var result [12]byte
+// recordHeader holds the decoded header fields of a record, minus the crc
+type recordHeader struct {
+	timestamp uint32
+	keySize   uint32
+	valueSize uint32
+	flags     uint32
+	meta      uint32
+	// expiresAt is not stored in the header but ahead of the value, in records
+	// with flagExpires. encodeRecord and decodeRecord take care of it.
+	expiresAt uint32
+}
 
-	binary.LittleEndian.PutUint32(result[:4], timestamp)
-	binary.LittleEndian.PutUint32(result[4:8], keySize)
-	binary.LittleEndian.PutUint32(result[8:12], valueSize)
+func (h recordHeader) isTombstone() bool {
+	return h.flags&flagTombstone != 0
+}
 
-	return result[:]
+// size returns the length of the whole record described by h
+func (h recordHeader) size(version uint32) int64 {
+	return int64(recordHeaderSize(version)) + int64(h.keySize) + int64(h.valueSize)
 }
 
-func decodeHeader(header []byte) (uint32, uint32, uint32) {
-	if len(header) != headerSize {
-		panic("header size is not equal to 12")
+// recordHeaderSize returns the header size of records in the given format version
+func recordHeaderSize(version uint32) int {
+	switch version {
+	case 0:
+		return headerSizeV0
+	case 1:
+		return headerSizeV1
 	}
-	timestamp := binary.LittleEndian.Uint32(header[0:4])
-	keySize := binary.LittleEndian.Uint32(header[4:8])
-	valueSize := binary.LittleEndian.Uint32(header[8:12])
-	return timestamp, keySize, valueSize
+	return headerSize
 }
 
-func encodeKV(timestamp uint32, key string, value string) (int, []byte) {
-	result := encodeHeader(timestamp, uint32(len(key)), uint32(len(value)))
+// fieldsOffset returns the offset of the timestamp in the record headers of the
+// given format version, which comes right after the crc, if there is one
+func fieldsOffset(version uint32) int {
+	if version == 0 {
+		return 0
+	}
+	return crcSize
+}
+
+// encodeRecordHeader encodes h in the given format version, leaving the crc
+// zeroed. The checksum covers the key and value too, so it is filled in by
+// encodeRecord.
+func encodeRecordHeader(version uint32, h recordHeader) []byte {
+	result := make([]byte, recordHeaderSize(version))
+
+	off := fieldsOffset(version)
+	binary.LittleEndian.PutUint32(result[off:off+4], h.timestamp)
+	binary.LittleEndian.PutUint32(result[off+4:off+8], h.keySize)
+	binary.LittleEndian.PutUint32(result[off+8:off+12], h.valueSize)
+	if version > 1 {
+		binary.LittleEndian.PutUint32(result[16:20], h.flags)
+		binary.LittleEndian.PutUint32(result[20:24], h.meta)
+	}
+
+	return result
+}
+
+func decodeRecordHeader(version uint32, header []byte) recordHeader {
+	if len(header) != recordHeaderSize(version) {
+		panic("header size does not match the format version")
+	}
+	off := fieldsOffset(version)
+	h := recordHeader{
+		timestamp: binary.LittleEndian.Uint32(header[off : off+4]),
+		keySize:   binary.LittleEndian.Uint32(header[off+4 : off+8]),
+		valueSize: binary.LittleEndian.Uint32(header[off+8 : off+12]),
+	}
+	if version > 1 {
+		h.flags = binary.LittleEndian.Uint32(header[16:20])
+		h.meta = binary.LittleEndian.Uint32(header[20:24])
+	}
+	return h
+}
+
+// encodeRecord encodes a whole record in the given format version. The sizes in
+// h are filled in from key and value.
+func encodeRecord(version uint32, h recordHeader, key string, value string) []byte {
+	if h.expiresAt != 0 {
+		h.flags |= flagExpires
+		value = string(binary.LittleEndian.AppendUint32(nil, h.expiresAt)) + value
+	}
+	h.keySize, h.valueSize = uint32(len(key)), uint32(len(value))
+	result := encodeRecordHeader(version, h)
 
 	result = append(result, []byte(key)...)
 	result = append(result, []byte(value)...)
+	if version > 0 {
+		binary.LittleEndian.PutUint32(result[:crcSize], crc32.ChecksumIEEE(result[crcSize:]))
+	}
 
-	size := len(key) + len(value) + headerSize
-	return size, result[:]
+	return result
 }
 
-func decodeKV(data []byte) (uint32, string, string) {
-	timestamp, keySize, valueSize := decodeHeader(data[:headerSize])
+// verifyRecord reports whether data holds exactly one record of the given format
+// version whose checksum matches its contents. Records of version 0 have no
+// checksum, so only their sizes are checked.
+func verifyRecord(version uint32, data []byte) bool {
+	size := recordHeaderSize(version)
+	if len(data) < size {
+		return false
+	}
+	h := decodeRecordHeader(version, data[:size])
+	if int64(len(data)) != h.size(version) {
+		return false
+	}
+	if version == 0 {
+		return true
+	}
+	return binary.LittleEndian.Uint32(data[:crcSize]) == crc32.ChecksumIEEE(data[crcSize:])
+}
+
+// readRecord reads the next record in format version from r into buf, growing it
+// as needed, and returns its header and bytes, which share the memory of buf, so
+// passing them back as buf reuses it. It returns io.EOF when r ends right before
+// the record, and io.ErrUnexpectedEOF when it ends within it. A size past
+// maxRecordSize is reported as ErrCorruptRecord before any memory is allocated for
+// it.
+func readRecord(r io.Reader, version uint32, buf []byte) (recordHeader, []byte, error) {
+	headerSize := int64(recordHeaderSize(version))
+	if int64(cap(buf)) < headerSize {
+		buf = make([]byte, headerSize)
+	}
+	if _, err := io.ReadFull(r, buf[:headerSize]); err != nil {
+		return recordHeader{}, nil, err
+	}
+	h := decodeRecordHeader(version, buf[:headerSize])
+	size := h.size(version)
+	if size > maxRecordSize {
+		return recordHeader{}, nil, fmt.Errorf("%w: record of %d bytes, limit is %d", ErrCorruptRecord, size, maxRecordSize)
+	}
+	if int64(cap(buf)) < size {
+		buf = append(buf[:headerSize], make([]byte, size-headerSize)...)
+	}
+	record := buf[:size]
+	if _, err := io.ReadFull(r, record[headerSize:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return recordHeader{}, nil, err
+	}
+	return h, record, nil
+}
 
-	key := string(data[headerSize:headerSize+keySize])
-	valueOffset := headerSize + keySize
-	value := string(data[valueOffset:valueOffset+valueSize])
+func decodeRecord(version uint32, data []byte) (recordHeader, string, string) {
+	size := uint32(recordHeaderSize(version))
+	h := decodeRecordHeader(version, data[:size])
 
-	return timestamp, key, value
+	key := string(data[size : size+h.keySize])
+	valueOffset := size + h.keySize
+	value := string(data[valueOffset : valueOffset+h.valueSize])
+	if h.flags&flagExpires != 0 && len(value) >= expirySize {
+		h.expiresAt = binary.LittleEndian.Uint32([]byte(value[:expirySize]))
+		value = value[expirySize:]
+	}
+
+	return h, key, value
+}
+
+// encodeHeader encodes a header of the current format version with no flags or
+// meta, leaving the crc zeroed.
+func encodeHeader(timestamp uint32, keySize uint32, valueSize uint32) []byte {
+	return encodeRecordHeader(formatVersion, recordHeader{timestamp: timestamp, keySize: keySize, valueSize: valueSize})
+}
+
+func decodeHeader(header []byte) (uint32, uint32, uint32) {
+	h := decodeRecordHeader(formatVersion, header)
+	return h.timestamp, h.keySize, h.valueSize
+}
+
+func encodeKV(timestamp uint32, key string, value string) (int, []byte) {
+	result := encodeRecord(formatVersion, recordHeader{timestamp: timestamp}, key, value)
+	return len(result), result
+}
+
+func decodeKV(data []byte) (uint32, string, string) {
+	h, key, value := decodeRecord(formatVersion, data)
+	return h.timestamp, key, value
 }
@@ -0,0 +1,82 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// loadCall is a call of the loader of GetOrLoad in flight, which the other
+// GetOrLoad calls missing the same key wait for instead of loading it again
+type loadCall struct {
+	done  chan struct{}
+	value string
+	err   error
+}
+
+// loadCalls tracks the loads of GetOrLoad in flight by key.
+type loadCalls struct {
+	mu    sync.Mutex
+	calls map[string]*loadCall
+}
+
+// join returns the call loading key, reporting whether it was started by the
+// caller, which must then run it and call finish.
+func (l *loadCalls) join(key string) (*loadCall, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if call, ok := l.calls[key]; ok {
+		return call, false
+	}
+	if l.calls == nil {
+		l.calls = make(map[string]*loadCall)
+	}
+	call := &loadCall{done: make(chan struct{})}
+	l.calls[key] = call
+	return call, true
+}
+
+func (l *loadCalls) finish(key string, call *loadCall) {
+	l.mu.Lock()
+	delete(l.calls, key)
+	l.mu.Unlock()
+	close(call.done)
+}
+
+// GetOrLoad gets a value from the store, or when the key does not exist calls
+// loader for it, sets the key to the value loaded and returns it, for using the
+// store as a cache in front of a slower source. Concurrent calls missing the same
+// key share a single call of loader, all returning its value or error; an error
+// of loader is returned as is and nothing is set. Should loader panic, the
+// panic carries on in the call which ran it and the others return
+// ErrLoaderPanicked.
+func (d *DiskStore) GetOrLoad(key string, loader func(key string) (string, error)) (string, error) {
+	value, err := d.Fetch(key)
+	if !errors.Is(err, ErrKeyNotFound) {
+		return value, err
+	}
+	normalized := d.normalizeKey(key)
+	call, started := d.loads.join(normalized)
+	if !started {
+		<-call.done
+		return call.value, call.err
+	}
+	defer d.loads.finish(normalized, call)
+	// a load which finished between the miss and join has set the key already
+	call.value, call.err = d.Fetch(key)
+	if !errors.Is(call.err, ErrKeyNotFound) {
+		return call.value, call.err
+	}
+	// runs ahead of finish, so that the waiters do not take the miss above for
+	// the result of the load
+	defer func() {
+		if r := recover(); r != nil {
+			call.value, call.err = "", fmt.Errorf("%w: %v", ErrLoaderPanicked, r)
+			panic(r)
+		}
+	}()
+	if call.value, call.err = loader(key); call.err == nil {
+		call.err = d.Set(key, call.value)
+	}
+	return call.value, call.err
+}
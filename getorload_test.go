@@ -0,0 +1,108 @@
+package caskdb
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_GetOrLoad(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+
+	var calls atomic.Int32
+	loader := func(key string) (string, error) {
+		calls.Add(1)
+		// give the other callers time to miss too
+		time.Sleep(20 * time.Millisecond)
+		return "loaded " + key, nil
+	}
+	var wg sync.WaitGroup
+	values := make([]string, 50)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			value, err := store.GetOrLoad("hamlet", loader)
+			if err != nil {
+				t.Errorf("GetOrLoad() error = %v", err)
+			}
+			values[i] = value
+		}(i)
+	}
+	wg.Wait()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("loader called %d times, want 1", n)
+	}
+	for _, value := range values {
+		if value != "loaded hamlet" {
+			t.Errorf("GetOrLoad() = %q, want %q", value, "loaded hamlet")
+		}
+	}
+	if val := store.Get("hamlet"); val != "loaded hamlet" {
+		t.Errorf("Get() = %v, want %v", val, "loaded hamlet")
+	}
+
+	if value, err := store.GetOrLoad("othello", loader); err != nil || value != "shakespeare" {
+		t.Errorf("GetOrLoad() = %q, %v, want %q", value, err, "shakespeare")
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("loader called for a stored key")
+	}
+
+	errSource := errors.New("source unavailable")
+	if _, err := store.GetOrLoad("macbeth", func(string) (string, error) { return "", errSource }); !errors.Is(err, errSource) {
+		t.Errorf("GetOrLoad() error = %v, want %v", err, errSource)
+	}
+	if _, ok := store.Lookup("macbeth"); ok {
+		t.Errorf("GetOrLoad() set the key after the loader failed")
+	}
+}
+
+func TestDiskStore_GetOrLoadPanic(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+
+	loading := make(chan struct{})
+	release := make(chan struct{})
+	loader := func(string) (string, error) {
+		close(loading)
+		<-release
+		panic("source exploded")
+	}
+	panicked := make(chan any)
+	go func() {
+		defer func() { panicked <- recover() }()
+		store.GetOrLoad("hamlet", loader)
+	}()
+	<-loading
+	waited := make(chan error)
+	go func() {
+		_, err := store.GetOrLoad("hamlet", func(string) (string, error) {
+			return "", errors.New("loader called again")
+		})
+		waited <- err
+	}()
+	// give the second call time to join the first
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if r := <-panicked; r != "source exploded" {
+		t.Errorf("GetOrLoad() panicked with %v, want %v", r, "source exploded")
+	}
+	if err := <-waited; !errors.Is(err, ErrLoaderPanicked) {
+		t.Errorf("GetOrLoad() error = %v, want %v", err, ErrLoaderPanicked)
+	}
+	if _, ok := store.Lookup("hamlet"); ok {
+		t.Errorf("GetOrLoad() set the key after the loader panicked")
+	}
+}
@@ -0,0 +1,221 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+)
+
+// A hint file stores a snapshot of the keyStore next to the data file, so that
+// opening a store does not need to scan the whole data file. It is written when the
+// store is closed, or periodically with Options.HintInterval, and looks like this:
+//
+//	┌──────────────┬─────────────┬───────────────┬──────────────────┬────────────────────┬─────────┬─────┬─────────┬─────────┐
+//	│ magic "HINT" │ version(4B) │ data_size(8B) │ dead_records(8B) │ last_timestamp(4B) │ entry 1 │ ... │ entry n │ crc(4B) │
+//	└──────────────┴─────────────┴───────────────┴──────────────────┴────────────────────┴─────────┴─────┴─────────┴─────────┘
+//
+// Every entry is a KeyEntry followed by its key:
+//
+//	┌───────────────┬──────────────┬────────────────┬─────────────┬────────────────┬────────────────┬──────────────┬─────┐
+//	│ timestamp(4B) │ position(4B) │ total_size(4B) │ segment(4B) │ expires_at(4B) │ value_size(4B) │ key_size(4B) │ key │
+//	└───────────────┴──────────────┴────────────────┴─────────────┴────────────────┴────────────────┴──────────────┴─────┘
+//
+// dead_records is the Stats.DeadRecords of the records up to data_size, and
+// last_timestamp the latest timestamp of those records, tombstones included.
+// value_size is the length of the value once decompressed.
+//
+// data_size is the size of the data file the hint accounts for. The data file may
+// have been appended to after the hint was written (say, the process crashed before
+// the next Close), so records past data_size are scanned from the data file and win
+// over the hint.
+//
+// Positions are offsets within the data file, so a data file copied along with its
+// hint, say with cp or rsync, still opens through the hint. A data file shorter than
+// data_size was truncated, for instance by an interrupted copy, and its hint is
+// ignored.
+
+const (
+	hintMagic   = "HINT"
+	hintVersion = 1
+	// hintHeaderSize is the size of the magic, version and fields ahead of the
+	// entries
+	hintHeaderSize = 28
+	hintEntrySize  = 28
+)
+
+var errInvalidHint = errors.New("caskdb: invalid hint file")
+
+func hintFileName(fileName string) string {
+	return fileName + ".hint"
+}
+
+// hintHeader holds the fields of a hint file ahead of its entries
+type hintHeader struct {
+	// dataSize is the size of the data file the hint accounts for
+	dataSize int64
+	// deadRecords is Stats.DeadRecords of the records up to dataSize
+	deadRecords int64
+	// lastTimestamp is the latest timestamp of the records up to dataSize
+	lastTimestamp uint32
+}
+
+func encodeHint(header hintHeader, keyStore KeyDir) []byte {
+	result := []byte(hintMagic)
+	result = binary.LittleEndian.AppendUint32(result, hintVersion)
+	result = binary.LittleEndian.AppendUint64(result, uint64(header.dataSize))
+	result = binary.LittleEndian.AppendUint64(result, uint64(header.deadRecords))
+	result = binary.LittleEndian.AppendUint32(result, header.lastTimestamp)
+	keyStore.Range(func(key string, entry KeyEntry) bool {
+		result = binary.LittleEndian.AppendUint32(result, entry.timestamp)
+		result = binary.LittleEndian.AppendUint32(result, entry.position)
+		result = binary.LittleEndian.AppendUint32(result, entry.totalSize)
+		result = binary.LittleEndian.AppendUint32(result, entry.segment)
+		result = binary.LittleEndian.AppendUint32(result, entry.expiresAt)
+		result = binary.LittleEndian.AppendUint32(result, entry.valueSize)
+		result = binary.LittleEndian.AppendUint32(result, uint32(len(key)))
+		result = append(result, key...)
+		return true
+	})
+	return binary.LittleEndian.AppendUint32(result, crc32.ChecksumIEEE(result))
+}
+
+// decodeHint decodes a hint file into keyStore, returning its header.
+func decodeHint(data []byte, keyStore KeyDir) (hintHeader, error) {
+	header, entries, err := decodeHintHeader(data)
+	if err != nil {
+		return hintHeader{}, err
+	}
+	for rest := entries; len(rest) > 0; {
+		if len(rest) < hintEntrySize {
+			return hintHeader{}, errInvalidHint
+		}
+		entry := KeyEntry{
+			timestamp: binary.LittleEndian.Uint32(rest[0:4]),
+			position:  binary.LittleEndian.Uint32(rest[4:8]),
+			totalSize: binary.LittleEndian.Uint32(rest[8:12]),
+			segment:   binary.LittleEndian.Uint32(rest[12:16]),
+			expiresAt: binary.LittleEndian.Uint32(rest[16:20]),
+			valueSize: binary.LittleEndian.Uint32(rest[20:24]),
+		}
+		keySize := binary.LittleEndian.Uint32(rest[24:28])
+		rest = rest[hintEntrySize:]
+		if uint64(len(rest)) < uint64(keySize) {
+			return hintHeader{}, errInvalidHint
+		}
+		keyStore.Set(string(rest[:keySize]), entry)
+		rest = rest[keySize:]
+	}
+	return header, nil
+}
+
+// decodeHintHeader checks the checksum of a hint file, returning its header
+// along with its entries.
+func decodeHintHeader(data []byte) (hintHeader, []byte, error) {
+	if len(data) < hintHeaderSize+crcSize {
+		return hintHeader{}, nil, errInvalidHint
+	}
+	body, checksum := data[:len(data)-crcSize], data[len(data)-crcSize:]
+	if binary.LittleEndian.Uint32(checksum) != crc32.ChecksumIEEE(body) {
+		return hintHeader{}, nil, errInvalidHint
+	}
+	if string(body[:4]) != hintMagic || binary.LittleEndian.Uint32(body[4:8]) != hintVersion {
+		return hintHeader{}, nil, errInvalidHint
+	}
+	header := hintHeader{
+		dataSize:      int64(binary.LittleEndian.Uint64(body[8:16])),
+		deadRecords:   int64(binary.LittleEndian.Uint64(body[16:24])),
+		lastTimestamp: binary.LittleEndian.Uint32(body[24:28]),
+	}
+	return header, body[hintHeaderSize:], nil
+}
+
+// WriteHint writes the hint file now, rather than waiting for Close or a
+// compaction, for instance to regenerate a deleted hint file. Writes block while
+// the keyStore is being written out.
+func (d *DiskStore) WriteHint() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.writeHint()
+}
+
+// writeHint writes the current keyStore to the hint file. The caller must hold mu
+// exclusively.
+func (d *DiskStore) writeHint() error {
+	if d.deferred {
+		return ErrIndexNotBuilt
+	}
+	info, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	return writeHintFile(hintFileName(d.fileName), encodeHint(hintHeader{info.Size(), d.deadRecords.Load(), d.lastTimestamp.Load()}, d.keyStore))
+}
+
+// writeHintFile writes a hint file atomically: data is written to a temporary
+// file renamed over fileName once synced, so a crash never leaves a half written
+// hint behind, nor loses the previous one.
+func writeHintFile(fileName string, data []byte) error {
+	tmpName := fileName + ".tmp"
+	file, err := os.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fileName)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
+
+// loadHint fills the keyStore from the hint file, returning the size of the data
+// file the hint accounts for. A missing or unusable hint is not an error; the
+// store falls back to scanning the data file from the start.
+func (d *DiskStore) loadHint(dataSize int64) (int64, bool) {
+	data, err := os.ReadFile(hintFileName(d.fileName))
+	if err != nil {
+		return 0, false
+	}
+	keyStore := d.newKeyDir()
+	header, err := decodeHint(data, keyStore)
+	if err != nil {
+		return 0, false
+	}
+	hintDataSize := header.dataSize
+	if hintDataSize > dataSize {
+		d.logger().Printf("caskdb: ignoring hint file of %s, which accounts for %d bytes of a %d byte data file",
+			d.fileName, hintDataSize, dataSize)
+		return 0, false
+	}
+	valid := true
+	keyStore.Range(func(key string, entry KeyEntry) bool {
+		start, size := d.dataStart, hintDataSize
+		if entry.segment != d.segment {
+			seg, ok := d.segments[entry.segment]
+			if !ok {
+				valid = false
+				return false
+			}
+			start, size = seg.dataStart, seg.size
+		}
+		end := int64(entry.position) + int64(entry.totalSize)
+		valid = int64(entry.position) >= start && end <= size
+		return valid
+	})
+	if !valid {
+		return 0, false
+	}
+	d.keyStore = keyStore
+	d.deadRecords.Store(header.deadRecords)
+	d.noteTimestamp(header.lastTimestamp)
+	return hintDataSize, true
+}
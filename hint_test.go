@@ -0,0 +1,245 @@
+package caskdb
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// crash tears store down as a crash would, without compacting, flushing or
+// writing a hint, while still stopping its goroutines and closing its files so
+// that the test does not leak it
+func crash(tb testing.TB, store *DiskStore) {
+	tb.Helper()
+	store.stopBackground()
+	store.stopCommitter()
+	unregisterStore(store)
+	store.file.Close()
+	if store.values != nil {
+		store.values.Close()
+	}
+	if store.readers != nil {
+		store.readers.close()
+	}
+	store.closeSegments()
+	store.releaseLock()
+}
+
+func TestDiskStore_OpenWithHint(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Close()
+	if _, err := os.Stat(hintFileName(fileName)); err != nil {
+		t.Fatalf("hint file was not written: %v", err)
+	}
+
+	store, result, err := NewDiskStoreWithResult(fileName, Options{})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if !result.HintUsed {
+		t.Errorf("HintUsed = false, want true")
+	}
+	if result.Loaded != 0 {
+		t.Errorf("Loaded = %v, want %v", result.Loaded, 0)
+	}
+	if store.Get("hamlet") != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", store.Get("hamlet"), "shakespeare")
+	}
+}
+
+func TestDiskStore_OpenWithStaleHint(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Close()
+
+	// write some more records after the hint, then crash before the next Close
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	store.Set("dune", "herbert")
+	store.Set("anna karenina", "tolstoy")
+	crash(t, store)
+
+	store, result, err := NewDiskStoreWithResult(fileName, Options{})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if !result.HintUsed {
+		t.Errorf("HintUsed = false, want true")
+	}
+	if result.Loaded != 2 {
+		t.Errorf("Loaded = %v, want %v", result.Loaded, 2)
+	}
+	tests := map[string]string{
+		"hamlet":        "shakespeare",
+		"dune":          "herbert",
+		"anna karenina": "tolstoy",
+	}
+	for key, val := range tests {
+		if store.Get(key) != val {
+			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		}
+	}
+}
+
+func TestDiskStore_OpenWithCorruptHint(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+	os.WriteFile(hintFileName(fileName), []byte("not a hint file"), 0666)
+
+	store, result, err := NewDiskStoreWithResult(fileName, Options{})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if result.HintUsed {
+		t.Errorf("HintUsed = true, want false")
+	}
+	if store.Get("hamlet") != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", store.Get("hamlet"), "shakespeare")
+	}
+}
+
+func TestDiskStore_OpenCopyWithHint(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Close()
+
+	data, _ := os.ReadFile(fileName)
+	hint, _ := os.ReadFile(hintFileName(fileName))
+	copyName := filepath.Join(t.TempDir(), "copy", "books.db")
+	os.Mkdir(filepath.Dir(copyName), 0777)
+	os.WriteFile(copyName, data, 0666)
+	os.WriteFile(hintFileName(copyName), hint, 0666)
+
+	store, result, err := NewDiskStoreWithResult(copyName, Options{})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	if !result.HintUsed || result.Loaded != 0 {
+		t.Errorf("OpenResult = %+v, want the copy opened through the hint only", result)
+	}
+	if store.Get("dune") != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", store.Get("dune"), "frank herbert")
+	}
+	crash(t, store)
+
+	// a truncated copy must not be trusted to the hint
+	os.WriteFile(copyName, data[:len(data)-5], 0666)
+	os.WriteFile(hintFileName(copyName), hint, 0666)
+	var logs strings.Builder
+	store, result, err = NewDiskStoreWithResult(copyName, Options{Logger: log.New(&logs, "", 0)})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if result.HintUsed {
+		t.Errorf("HintUsed = true, want the hint of a truncated copy ignored")
+	}
+	if !strings.Contains(logs.String(), "ignoring hint file") {
+		t.Errorf("log = %q, want the ignored hint reported", logs.String())
+	}
+	if store.Get("hamlet") != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", store.Get("hamlet"), "shakespeare")
+	}
+}
+
+func TestDiskStore_WriteHint(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Set("hamlet", "bacon")
+	if err := store.WriteHint(); err != nil {
+		t.Fatalf("WriteHint() error = %v", err)
+	}
+	// crash, so that Close does not write the hint itself
+	crash(t, store)
+
+	store, result, err := NewDiskStoreWithResult(fileName, Options{})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if !result.HintUsed || result.Loaded != 0 {
+		t.Errorf("OpenResult = %+v, want the store opened through the hint only", result)
+	}
+	if store.Get("hamlet") != "bacon" {
+		t.Errorf("Get() = %v, want %v", store.Get("hamlet"), "bacon")
+	}
+	if store.Get("dune") != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", store.Get("dune"), "frank herbert")
+	}
+}
+
+func TestDiskStore_HintInterval(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{HintInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	// wait for a checkpoint accounting for both records
+	info, _ := os.Stat(fileName)
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		data, err := os.ReadFile(hintFileName(fileName))
+		if err == nil {
+			if header, err := decodeHint(data, NewMapKeyDir()); err == nil && header.dataSize == info.Size() {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	store.stopBackground()
+	store.Set("anna karenina", "tolstoy")
+	crash(t, store)
+
+	if _, err := os.Stat(hintFileName(fileName) + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary hint file left behind: %v", err)
+	}
+	store, result, err := NewDiskStoreWithResult(fileName, Options{})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if !result.HintUsed || result.Loaded != 1 {
+		t.Errorf("OpenResult = %+v, want the checkpointed hint used and 1 record scanned", result)
+	}
+	for key, val := range map[string]string{"hamlet": "shakespeare", "dune": "frank herbert", "anna karenina": "tolstoy"} {
+		if got := store.Get(key); got != val {
+			t.Errorf("Get(%v) = %v, want %v", key, got, val)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package caskdb
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+)
+
+// hotKeysCapacity bounds the number of keys hotKeys counts writes for.
+const hotKeysCapacity = 1024
+
+// hotKeys counts the writes to each key with the Space-Saving algorithm: once it
+// counts hotKeysCapacity keys, a write to a new key evicts the key with the
+// lowest count and takes over its count. The memory stays bounded and the counts
+// are approximate, overestimating by at most the evicted count, but any key
+// written more than 1/hotKeysCapacity of the time is sure to be counted.
+type hotKeys struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func (h *hotKeys) observe(key string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if count, ok := h.counts[key]; ok || len(h.counts) < hotKeysCapacity {
+		h.counts[key] = count + 1
+		return
+	}
+	var coldest string
+	var lowest uint64
+	found := false
+	for key, count := range h.counts {
+		if !found || count < lowest {
+			coldest, lowest, found = key, count, true
+		}
+	}
+	delete(h.counts, coldest)
+	h.counts[key] = lowest + 1
+}
+
+// top returns the n keys with the highest counts, highest first.
+func (h *hotKeys) top(n int) []string {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	keys := make([]string, 0, len(h.counts))
+	for key := range h.counts {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if c := cmp.Compare(h.counts[b], h.counts[a]); c != 0 {
+			return c
+		}
+		return cmp.Compare(a, b)
+	})
+	h.mu.Unlock()
+	return keys[:min(n, len(keys))]
+}
+
+// HotKeys returns the n keys written most often since the store was opened, most
+// written first. Sets and deletes both count, as both grow the file, so these are
+// the keys driving its growth and compactions.
+//
+// The counts are approximate: only a bounded number of keys is tracked, and with
+// more distinct keys than that, a rarely written key can show up in place of
+// another one. The keys written the most are always reported. Writes are only
+// counted with Options.TrackHotKeys; without it HotKeys returns nothing.
+func (d *DiskStore) HotKeys(n int) []string {
+	if n <= 0 {
+		return nil
+	}
+	return d.hot.top(n)
+}
@@ -0,0 +1,65 @@
+package caskdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDiskStore_HotKeys(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{TrackHotKeys: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// more distinct keys than are tracked, with two of them written far more
+	for i := range 3 * hotKeysCapacity {
+		store.Set(fmt.Sprintf("cold:%d", i), "value")
+		if i%4 == 0 {
+			store.Set("hamlet", "value")
+		}
+		if i%10 == 0 {
+			store.Set("othello", "value")
+			store.Delete("othello")
+		}
+	}
+
+	if got, want := store.HotKeys(2), []string{"hamlet", "othello"}; !slices.Equal(got, want) {
+		t.Errorf("HotKeys(2) = %v, want %v", got, want)
+	}
+	if got := store.HotKeys(5 * hotKeysCapacity); len(got) != hotKeysCapacity {
+		t.Errorf("HotKeys() returned %d keys, want at most %d", len(got), hotKeysCapacity)
+	}
+	if got := store.HotKeys(0); len(got) != 0 {
+		t.Errorf("HotKeys(0) = %v, want none", got)
+	}
+}
+
+func TestDiskStore_HotKeysDisabled(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Delete("hamlet")
+	if got := store.HotKeys(1); len(got) != 0 {
+		t.Errorf("HotKeys(1) = %v without Options.TrackHotKeys, want none", got)
+	}
+}
+
+func TestHotKeysEmptyKey(t *testing.T) {
+	h := &hotKeys{counts: map[string]uint64{"": 1, "hamlet": 100}}
+	for i := 0; len(h.counts) < hotKeysCapacity; i++ {
+		h.counts[fmt.Sprintf("cold:%d", i)] = 50
+	}
+	// the empty key is the coldest, and must not be taken for none found yet
+	h.observe("othello")
+	if _, ok := h.counts[""]; ok {
+		t.Errorf("observe() kept the coldest key %q", "")
+	}
+	if h.counts["othello"] != 2 {
+		t.Errorf("count = %v, want %v", h.counts["othello"], 2)
+	}
+}
@@ -0,0 +1,74 @@
+package caskdb
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// readHeader reads the file header of the data file, without building the
+// keyStore
+func (d *DiskStore) readHeader() error {
+	var err error
+	d.dataStart, d.version, err = readFileHeader(d.file, d.opts.LegacyFormat)
+	return err
+}
+
+// checkTail finds a torn record left at the end of the data file by a crash when
+// opening with Options.DeferIndex, truncating it away before any record is
+// appended after it, without building the keyStore. Only the records after
+// those the hint file accounts for are scanned, which after a clean Close is
+// none at all.
+func (d *DiskStore) checkTail(ctx context.Context) (OpenResult, error) {
+	var result OpenResult
+	if err := d.readHeader(); err != nil {
+		return result, err
+	}
+	info, err := d.file.Stat()
+	if err != nil {
+		return result, err
+	}
+	offset := d.dataStart
+	if data, err := os.ReadFile(hintFileName(d.fileName)); err == nil {
+		if header, _, err := decodeHintHeader(data); err == nil && header.dataSize <= info.Size() {
+			offset = max(offset, header.dataSize)
+			d.noteTimestamp(header.lastTimestamp)
+		}
+	}
+	// the records scanned are only checked, the keyStore is built by BuildIndex
+	keyStore := d.keyStore
+	d.keyStore = d.newKeyDir()
+	defer func() {
+		d.keyStore = keyStore
+		d.deadRecords.Store(0)
+	}()
+	if err := d.scanRecords(ctx, d.file, d.segment, d.version, offset, info.Size(), &result); err != nil {
+		return result, err
+	}
+	return result, d.truncateTornTail(d.file, result)
+}
+
+// BuildIndex builds the keyStore of a store opened with Options.DeferIndex,
+// scanning the data file, after which the store can be read from. Records written
+// since the store was opened are included. It does nothing if the keyStore is
+// already built. Writes block until it finishes. A torn record left by a crash
+// was already truncated away when the store was opened, before any record was
+// appended after it.
+func (d *DiskStore) BuildIndex() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.deferred {
+		return nil
+	}
+	d.keyStore = d.newKeyDir()
+	result, err := d.createKeyStore(context.Background(), d.file)
+	if err != nil {
+		return fmt.Errorf("error creating keyStore: %w", err)
+	}
+	if result.Recovered > 0 {
+		d.logger().Printf("caskdb: loaded %d records from %s, recovered from %d torn record(s) at offset %d",
+			result.Loaded, d.fileName, result.Recovered, result.RecoveryOffset)
+	}
+	d.deferred = false
+	return d.loadValues()
+}
@@ -0,0 +1,124 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_DeferIndex(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("othello", "shakespeare")
+	store.Close()
+
+	store, result, err := NewDiskStoreWithResult(fileName, Options{DeferIndex: true})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if result.Loaded != 0 || result.HintUsed {
+		t.Errorf("OpenResult = %+v, want nothing loaded", result)
+	}
+	if err := store.Set("dune", "frank herbert"); err != nil {
+		t.Errorf("Set() error = %v", err)
+	}
+	if err := store.Delete("othello"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if _, err := store.Fetch("hamlet"); !errors.Is(err, ErrIndexNotBuilt) {
+		t.Errorf("Fetch() error = %v, want %v", err, ErrIndexNotBuilt)
+	}
+	if err := store.Compact(); !errors.Is(err, ErrIndexNotBuilt) {
+		t.Errorf("Compact() error = %v, want %v", err, ErrIndexNotBuilt)
+	}
+	if _, err := store.KeysModifiedSince(time.Time{}); !errors.Is(err, ErrIndexNotBuilt) {
+		t.Errorf("KeysModifiedSince() error = %v, want %v", err, ErrIndexNotBuilt)
+	}
+	if _, err := store.Equal(store); !errors.Is(err, ErrIndexNotBuilt) {
+		t.Errorf("Equal() error = %v, want %v", err, ErrIndexNotBuilt)
+	}
+	if _, _, err := store.ScanPage("", "", 10); !errors.Is(err, ErrIndexNotBuilt) {
+		t.Errorf("ScanPage() error = %v, want %v", err, ErrIndexNotBuilt)
+	}
+	if _, err := store.Namespace("books").Keys(); !errors.Is(err, ErrIndexNotBuilt) {
+		t.Errorf("Keys() error = %v, want %v", err, ErrIndexNotBuilt)
+	}
+	// the reads without an error find nothing rather than exit
+	if val := store.Get("hamlet"); val != "" {
+		t.Errorf("Get() = %v, want nothing before BuildIndex", val)
+	}
+	if val, ok := store.Lookup("hamlet"); ok {
+		t.Errorf("Lookup() = %v, %v, want nothing before BuildIndex", val, ok)
+	}
+	if val := store.GetOr("hamlet", "none"); val != "none" {
+		t.Errorf("GetOr() = %v, want %v", val, "none")
+	}
+	if _, _, ok := store.GetMeta2("hamlet"); ok {
+		t.Errorf("GetMeta2() found a key before BuildIndex")
+	}
+	if _, _, ok := store.GetWithTimestamp("hamlet"); ok {
+		t.Errorf("GetWithTimestamp() found a key before BuildIndex")
+	}
+	_, release, ok := store.GetView("hamlet")
+	release()
+	if ok {
+		t.Errorf("GetView() found a key before BuildIndex")
+	}
+
+	if err := store.BuildIndex(); err != nil {
+		t.Fatalf("BuildIndex() error = %v", err)
+	}
+	tests := map[string]string{"hamlet": "shakespeare", "dune": "frank herbert"}
+	for key, val := range tests {
+		if got, err := store.Fetch(key); err != nil || got != val {
+			t.Errorf("Fetch(%v) = %v, %v, want %v, nil", key, got, err, val)
+		}
+	}
+	if _, ok := store.Lookup("othello"); ok {
+		t.Errorf("Lookup() found a key deleted before the index was built")
+	}
+}
+
+func TestDiskStore_DeferIndexTornTail(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+	// records appended after the hint, the last of them torn by a crash
+	file, _ := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0666)
+	file.Write(encodeRecord(formatVersion, recordHeader{}, "emma", "austen"))
+	file.Write(encodeRecord(formatVersion, recordHeader{}, "ulysses", "joyce")[:20])
+	file.Close()
+
+	store, result, err := NewDiskStoreWithResult(fileName, Options{DeferIndex: true})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if result.Recovered != 1 {
+		t.Errorf("OpenResult.Recovered = %v, want %v", result.Recovered, 1)
+	}
+	if err := store.Set("dune", "frank herbert"); err != nil {
+		t.Errorf("Set() error = %v", err)
+	}
+	// the write after the open is not lost to the torn record before it
+	if err := store.BuildIndex(); err != nil {
+		t.Fatalf("BuildIndex() error = %v", err)
+	}
+	tests := map[string]string{"hamlet": "shakespeare", "emma": "austen", "dune": "frank herbert"}
+	for key, val := range tests {
+		if got, err := store.Fetch(key); err != nil || got != val {
+			t.Errorf("Fetch(%v) = %v, %v, want %v, nil", key, got, err, val)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package caskdb
+
+// Iterator walks over the live keys of the store in sorted order, reading the
+// value of a key only when its filter accepts it.
+//
+// Typical usage example:
+//
+//	it := store.IteratorFiltered(func(key string) bool { return strings.HasSuffix(key, ".json") })
+//	for it.Next() {
+//		if it.Loaded() {
+//			process(it.Key(), it.Value())
+//		}
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	store  *DiskStore
+	filter func(key string) bool
+	keys   []string
+	key    string
+	value  string
+	loaded bool
+	err    error
+}
+
+// IteratorFiltered returns an iterator over the live keys, which reads the value
+// of a key only when filter returns true for it, and otherwise yields the key
+// alone. Skipping the values the caller is going to ignore saves a disk read for
+// each of them. A nil filter reads every value.
+//
+// The keys are those live when IteratorFiltered is called: keys deleted since are
+// skipped, and keys set since are not visited. Values are read as of when Next
+// reaches them.
+func (d *DiskStore) IteratorFiltered(filter func(key string) bool) *Iterator {
+	it := &Iterator{store: d, filter: filter}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.deferred {
+		it.err = ErrIndexNotBuilt
+		return it
+	}
+	it.keys = d.sortedKeys("")
+	return it
+}
+
+// Next advances the iterator to the next key, returning false when there are no
+// more keys or an error occurred.
+func (it *Iterator) Next() bool {
+	for it.err == nil && len(it.keys) > 0 {
+		key := it.keys[0]
+		it.keys = it.keys[1:]
+		it.key, it.value, it.loaded = key, "", false
+		if it.filter != nil && !it.filter(key) {
+			if it.store.exists(key) {
+				return true
+			}
+			continue
+		}
+		it.store.mu.RLock()
+		_, value, ok, err := it.store.readRecord(key)
+		it.store.mu.RUnlock()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if ok {
+			it.value, it.loaded = value, true
+			return true
+		}
+	}
+	return false
+}
+
+// Key returns the key the iterator is positioned at.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the value of the key the iterator is positioned at, or "" when
+// the filter skipped reading it.
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+// Loaded reports whether the value of the current key was read, which is when
+// the filter accepted the key.
+func (it *Iterator) Loaded() bool {
+	return it.loaded
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// exists reports whether key is live, looking only at the keyStore
+func (d *DiskStore) exists(key string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	entry, ok := d.keyStore.Get(key)
+	return ok && !entry.expired(d.now().Unix())
+}
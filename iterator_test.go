@@ -0,0 +1,52 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_IteratorFiltered(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("book:dune", "frank herbert")
+	store.Set("book:hamlet", "shakespeare")
+	store.Set("film:dune", "villeneuve")
+	store.Set("film:alien", "scott")
+	store.Set("play:othello", "shakespeare")
+	// reading the value of a film would fail
+	for _, key := range []string{"film:dune", "film:alien"} {
+		store.keyStore.Set(key, KeyEntry{position: 1 << 30, totalSize: 64})
+	}
+
+	it := store.IteratorFiltered(func(key string) bool { return !strings.HasPrefix(key, "film:") })
+	store.Delete("play:othello")
+	type entry struct {
+		key, value string
+		loaded     bool
+	}
+	var got []entry
+	for it.Next() {
+		got = append(got, entry{it.Key(), it.Value(), it.Loaded()})
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("IteratorFiltered() error = %v", err)
+	}
+	want := []entry{
+		{"book:dune", "frank herbert", true},
+		{"book:hamlet", "shakespeare", true},
+		{"film:alien", "", false},
+		{"film:dune", "", false},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("IteratorFiltered() yielded %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %v = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
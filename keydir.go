@@ -0,0 +1,144 @@
+package caskdb
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// KeyDir is the in-memory hash table mapping every key to the location of its
+// latest record, called keyDir in the BitCask paper. DiskStore uses a plain Go map
+// by default; Options.NewKeyDir lets users plug in an implementation with less
+// memory overhead or less lock contention, such as NewShardedKeyDir.
+// Implementations must be safe for concurrent use.
+type KeyDir interface {
+	Get(key string) (KeyEntry, bool)
+	Set(key string, entry KeyEntry)
+	Delete(key string)
+	Len() int
+	// Range calls fn for every key until fn returns false. fn must not modify
+	// the KeyDir.
+	Range(fn func(key string, entry KeyEntry) bool)
+}
+
+// mapKeyDir is the default KeyDir, a Go map behind a single lock.
+type mapKeyDir struct {
+	sync.RWMutex
+	entries map[string]KeyEntry
+}
+
+// NewMapKeyDir returns the default KeyDir, backed by a Go map.
+func NewMapKeyDir() KeyDir {
+	return &mapKeyDir{entries: make(map[string]KeyEntry)}
+}
+
+func (m *mapKeyDir) Get(key string) (KeyEntry, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	entry, ok := m.entries[key]
+	return entry, ok
+}
+
+func (m *mapKeyDir) Set(key string, entry KeyEntry) {
+	m.Lock()
+	defer m.Unlock()
+	m.entries[key] = entry
+}
+
+func (m *mapKeyDir) Delete(key string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.entries, key)
+}
+
+func (m *mapKeyDir) Len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.entries)
+}
+
+func (m *mapKeyDir) Range(fn func(key string, entry KeyEntry) bool) {
+	m.RLock()
+	defer m.RUnlock()
+	for key, entry := range m.entries {
+		if !fn(key, entry) {
+			return
+		}
+	}
+}
+
+// shardedKeyDir partitions the keys over several maps, each with its own lock, so
+// that concurrent access to different keys rarely contends.
+type shardedKeyDir struct {
+	shards []keyDirShard
+}
+
+type keyDirShard struct {
+	sync.RWMutex
+	entries map[string]KeyEntry
+}
+
+// NewShardedKeyDir returns a KeyDir spreading the keys over the given number of
+// independently locked shards, so that concurrent access to different keys rarely
+// contends.
+func NewShardedKeyDir(shards int) KeyDir {
+	if shards < 1 {
+		shards = 1
+	}
+	s := &shardedKeyDir{shards: make([]keyDirShard, shards)}
+	for i := range s.shards {
+		s.shards[i].entries = make(map[string]KeyEntry)
+	}
+	return s
+}
+
+func (s *shardedKeyDir) shard(key string) *keyDirShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &s.shards[h.Sum32()%uint32(len(s.shards))]
+}
+
+func (s *shardedKeyDir) Get(key string) (KeyEntry, bool) {
+	shard := s.shard(key)
+	shard.RLock()
+	defer shard.RUnlock()
+	entry, ok := shard.entries[key]
+	return entry, ok
+}
+
+func (s *shardedKeyDir) Set(key string, entry KeyEntry) {
+	shard := s.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.entries[key] = entry
+}
+
+func (s *shardedKeyDir) Delete(key string) {
+	shard := s.shard(key)
+	shard.Lock()
+	defer shard.Unlock()
+	delete(shard.entries, key)
+}
+
+func (s *shardedKeyDir) Len() int {
+	n := 0
+	for i := range s.shards {
+		s.shards[i].RLock()
+		n += len(s.shards[i].entries)
+		s.shards[i].RUnlock()
+	}
+	return n
+}
+
+func (s *shardedKeyDir) Range(fn func(key string, entry KeyEntry) bool) {
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.RLock()
+		for key, entry := range shard.entries {
+			if !fn(key, entry) {
+				shard.RUnlock()
+				return
+			}
+		}
+		shard.RUnlock()
+	}
+}
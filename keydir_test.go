@@ -0,0 +1,108 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var keyDirs = map[string]func() KeyDir{
+	"map":     NewMapKeyDir,
+	"sharded": func() KeyDir { return NewShardedKeyDir(8) },
+}
+
+func TestKeyDir(t *testing.T) {
+	for name, newKeyDir := range keyDirs {
+		t.Run(name, func(t *testing.T) {
+			keyDir := newKeyDir()
+			keyDir.Set("hamlet", NewKeyEntry(1, 0, 10))
+			keyDir.Set("dune", NewKeyEntry(2, 10, 20))
+			keyDir.Set("hamlet", NewKeyEntry(3, 30, 10))
+			if entry, ok := keyDir.Get("hamlet"); !ok || entry != NewKeyEntry(3, 30, 10) {
+				t.Errorf("Get() = %v, %v, want %v", entry, ok, NewKeyEntry(3, 30, 10))
+			}
+			if keyDir.Len() != 2 {
+				t.Errorf("Len() = %v, want %v", keyDir.Len(), 2)
+			}
+			seen := 0
+			keyDir.Range(func(key string, entry KeyEntry) bool {
+				seen++
+				return true
+			})
+			if seen != 2 {
+				t.Errorf("Range() visited %v keys, want %v", seen, 2)
+			}
+			seen = 0
+			keyDir.Range(func(key string, entry KeyEntry) bool {
+				seen++
+				return false
+			})
+			if seen != 1 {
+				t.Errorf("Range() visited %v keys after stopping, want %v", seen, 1)
+			}
+			keyDir.Delete("hamlet")
+			if _, ok := keyDir.Get("hamlet"); ok {
+				t.Errorf("Get() found a deleted key")
+			}
+			if keyDir.Len() != 1 {
+				t.Errorf("Len() = %v, want %v", keyDir.Len(), 1)
+			}
+		})
+	}
+}
+
+func TestDiskStore_KeyDirs(t *testing.T) {
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"war and peace":        "tolstoy",
+		"hamlet":               "shakespeare",
+		"othello":              "shakespeare",
+		"brave new world":      "huxley",
+		"dune":                 "frank herbert",
+	}
+	for name, newKeyDir := range keyDirs {
+		t.Run(name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "test.db")
+			opts := Options{NewKeyDir: newKeyDir, AllowUnsafeInPlace: true}
+			store, err := NewDiskStoreWithOptions(fileName, opts)
+			if err != nil {
+				t.Fatalf("failed to create disk store: %v", err)
+			}
+			for key, val := range tests {
+				store.Set(key, "draft")
+				store.Set(key, val)
+				if store.Get(key) != val {
+					t.Errorf("Get() = %v, want %v", store.Get(key), val)
+				}
+			}
+			if store.Get("some key") != "" {
+				t.Errorf("Get() = %v, want %v", store.Get("some key"), "")
+			}
+			if err := store.Shrink(); err != nil {
+				t.Fatalf("Shrink() error = %v", err)
+			}
+			store.Close()
+
+			// reopen once from the hint file, then once by scanning the data file
+			for _, removeHint := range []bool{false, true} {
+				if removeHint {
+					os.Remove(hintFileName(fileName))
+				}
+				store, err = NewDiskStoreWithOptions(fileName, opts)
+				if err != nil {
+					t.Fatalf("failed to open disk store: %v", err)
+				}
+				for key, val := range tests {
+					if store.Get(key) != val {
+						t.Errorf("Get() = %v, want %v", store.Get(key), val)
+					}
+				}
+				if stats, _ := store.Stats(); stats.Keys != len(tests) || stats.DeadBytes != 0 {
+					t.Errorf("Stats() = %+v, want %v keys and no dead bytes", stats, len(tests))
+				}
+				store.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package caskdb
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// KeysModifiedSince returns the live keys last written at or after t, in no
+// particular order. It only looks at the timestamps in the keyStore, without
+// reading the disk, which makes it cheap enough to ship only what changed to a
+// backup or replica.
+//
+// Timestamps are stored in whole seconds, so keys written in the same second as t
+// but before it are included too.
+func (d *DiskStore) KeysModifiedSince(t time.Time) ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.deferred {
+		return nil, ErrIndexNotBuilt
+	}
+	since, now := t.Unix(), d.now().Unix()
+	var keys []string
+	d.keyStore.Range(func(key string, entry KeyEntry) bool {
+		if int64(entry.timestamp) >= since && !entry.expired(now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, nil
+}
+
+// ScanPage returns up to limit live keys with the given prefix, in sorted order,
+// starting after cursor. Pass an empty cursor for the first page and the returned
+// nextCursor for the following ones; an empty nextCursor means there are no more
+// keys. The cursor is opaque and only valid for the same prefix.
+//
+// The keyStore is unordered, so every call sorts the matching keys. Keys written
+// between calls show up in a later page if they sort after the cursor.
+func (d *DiskStore) ScanPage(prefix, cursor string, limit int) (keys []string, nextCursor string, err error) {
+	if limit <= 0 {
+		return nil, "", fmt.Errorf("caskdb: scan limit must be positive, got %d", limit)
+	}
+	var after string
+	if cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || !strings.HasPrefix(string(raw), prefix) {
+			return nil, "", ErrInvalidCursor
+		}
+		after = string(raw)
+	}
+	d.mu.RLock()
+	if d.deferred {
+		d.mu.RUnlock()
+		return nil, "", ErrIndexNotBuilt
+	}
+	matched := d.sortedKeys(prefix)
+	d.mu.RUnlock()
+	if cursor != "" {
+		start, found := slices.BinarySearch(matched, after)
+		if found {
+			start++
+		}
+		matched = matched[start:]
+	}
+	if len(matched) <= limit {
+		return matched, "", nil
+	}
+	keys = matched[:limit]
+	return keys, base64.RawURLEncoding.EncodeToString([]byte(keys[limit-1])), nil
+}
+
+// sortedKeys returns the live keys with the given prefix in sorted order. The
+// caller must hold mu.
+func (d *DiskStore) sortedKeys(prefix string) []string {
+	now := d.now().Unix()
+	var keys []string
+	d.keyStore.Range(func(key string, entry KeyEntry) bool {
+		if strings.HasPrefix(key, prefix) && !entry.expired(now) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	slices.Sort(keys)
+	return keys
+}
+
+// ForEachKey calls fn with every live key and its KeyEntry, in no particular
+// order, stopping at the first error fn returns. Only the keyStore is read, never
+// the disk, so aggregating over the keys, say counting them by prefix or summing
+// the size of their records or values, is cheap. Deleted and expired keys are
+// skipped.
+//
+// Writes block until ForEachKey returns; fn must not call the methods of the store.
+func (d *DiskStore) ForEachKey(fn func(key string, entry KeyEntry) error) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.deferred {
+		return ErrIndexNotBuilt
+	}
+	now := d.now().Unix()
+	var err error
+	d.keyStore.Range(func(key string, entry KeyEntry) bool {
+		if !entry.expired(now) {
+			err = fn(key, entry)
+		}
+		return err == nil
+	})
+	return err
+}
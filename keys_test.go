@@ -0,0 +1,153 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_KeysModifiedSince(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	now := time.Now()
+	written := map[string]time.Time{
+		"hamlet":        now.Add(-3 * time.Hour),
+		"dune":          now.Add(-2 * time.Hour),
+		"anna karenina": now.Add(-time.Hour),
+		"othello":       now,
+	}
+	for key, at := range written {
+		store.Set(key, "value")
+		// backdate the write, as if it happened at the given time
+		entry, _ := store.keyStore.Get(key)
+		entry.timestamp = uint32(at.Unix())
+		store.keyStore.Set(key, entry)
+	}
+
+	keys, err := store.KeysModifiedSince(now.Add(-90 * time.Minute))
+	if err != nil {
+		t.Fatalf("KeysModifiedSince() error = %v", err)
+	}
+	slices.Sort(keys)
+	if want := []string{"anna karenina", "othello"}; !slices.Equal(keys, want) {
+		t.Errorf("KeysModifiedSince() = %v, want %v", keys, want)
+	}
+	if keys, _ := store.KeysModifiedSince(now.Add(time.Hour)); len(keys) != 0 {
+		t.Errorf("KeysModifiedSince() = %v, want none", keys)
+	}
+	if keys, _ := store.KeysModifiedSince(time.Time{}); len(keys) != len(written) {
+		t.Errorf("KeysModifiedSince() = %v, want all keys", keys)
+	}
+}
+
+func TestDiskStore_ScanPage(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	var want []string
+	for i := range 23 {
+		key := fmt.Sprintf("book:%03d", i)
+		store.Set(key, "value")
+		want = append(want, key)
+	}
+	store.Set("author:tolstoy", "value")
+	store.Set("zebra", "value")
+	store.Delete("book:007")
+	want = slices.Delete(want, 7, 8)
+
+	var got []string
+	cursor, pages := "", 0
+	for {
+		keys, next, err := store.ScanPage("book:", cursor, 5)
+		if err != nil {
+			t.Fatalf("ScanPage() error = %v", err)
+		}
+		if len(keys) > 5 {
+			t.Fatalf("ScanPage() returned %d keys, want at most 5", len(keys))
+		}
+		got = append(got, keys...)
+		pages++
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ScanPage() pages = %v, want %v", got, want)
+	}
+	if pages != 5 {
+		t.Errorf("ScanPage() took %d pages, want 5", pages)
+	}
+
+	if _, _, err := store.ScanPage("book:", "not a cursor!", 5); !errors.Is(err, ErrInvalidCursor) {
+		t.Errorf("ScanPage() error = %v, want %v", err, ErrInvalidCursor)
+	}
+	if _, _, err := store.ScanPage("book:", "", 0); err == nil {
+		t.Error("ScanPage() with zero limit succeeded, want an error")
+	}
+}
+
+func TestDiskStore_ForEachKey(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	values := map[string]string{
+		"book:hamlet":  "shakespeare",
+		"book:dune":    "frank herbert",
+		"author:woolf": "virginia",
+	}
+	for key, value := range values {
+		store.Set(key, "overwritten")
+		store.Set(key, value)
+	}
+	store.Set("book:othello", "shakespeare")
+	store.Delete("book:othello")
+
+	var valueBytes, recordBytes int64
+	books := 0
+	err = store.ForEachKey(func(key string, entry KeyEntry) error {
+		if strings.HasPrefix(key, "book:") {
+			books++
+		}
+		recordBytes += entry.Size()
+		valueBytes += entry.ValueSize()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEachKey() error = %v", err)
+	}
+	want := 0
+	for _, value := range values {
+		want += len(value)
+	}
+	if valueBytes != int64(want) {
+		t.Errorf("summed value sizes = %v, want %v", valueBytes, want)
+	}
+	if stats, _ := store.Stats(); recordBytes != stats.LiveBytes {
+		t.Errorf("summed record sizes = %v, want LiveBytes %v", recordBytes, stats.LiveBytes)
+	}
+	if books != 2 {
+		t.Errorf("counted %v books, want 2", books)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = store.ForEachKey(func(key string, entry KeyEntry) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("ForEachKey() = %v after %d calls, want %v after 1", err, calls, stop)
+	}
+}
@@ -0,0 +1,77 @@
+package caskdb
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Loader writes the initial data of a new store much faster than calling Set for
+// every pair: records are buffered and written out sequentially, without syncing
+// each one or maintaining a keyStore.
+//
+// Typical usage example:
+//
+//	loader, _ := NewLoader("books.db")
+//	for _, book := range books {
+//		loader.Add(book.Title, book.Author)
+//	}
+//	store, err := loader.Finish()
+type Loader struct {
+	file      *os.File
+	w         *bufio.Writer
+	timestamp uint32
+}
+
+// NewLoader creates the data file at path for loading. The file must not exist
+// yet.
+func NewLoader(path string) (*Loader, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, err
+	}
+	l := &Loader{file: file, w: bufio.NewWriter(file), timestamp: uint32(time.Now().Unix())}
+	if _, err := l.w.Write(encodeFileHeader(formatVersion)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Add appends a pair to the store. When a key is added more than once, the last
+// value wins.
+func (l *Loader) Add(key string, value string) error {
+	_, err := l.w.Write(encodeRecord(formatVersion, recordHeader{timestamp: l.timestamp}, key, value))
+	return err
+}
+
+// Finish writes out the buffered records and opens the store, writing its hint
+// file so the next open is fast too. The Loader must not be used afterwards.
+func (l *Loader) Finish() (*DiskStore, error) {
+	fileName := l.file.Name()
+	if err := l.w.Flush(); err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	if err := l.file.Sync(); err != nil {
+		l.file.Close()
+		return nil, err
+	}
+	if err := l.file.Close(); err != nil {
+		return nil, err
+	}
+	if err := syncDir(filepath.Dir(fileName)); err != nil {
+		return nil, err
+	}
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.WriteHint(); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("error writing hint file: %w", err)
+	}
+	return store, nil
+}
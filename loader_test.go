@@ -0,0 +1,78 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoader(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	loader, err := NewLoader(fileName)
+	if err != nil {
+		t.Fatalf("NewLoader() error = %v", err)
+	}
+	const keys = 10_000
+	for i := 0; i < keys; i++ {
+		if err := loader.Add(fmt.Sprintf("key-%d", i), fmt.Sprintf("draft-%d", i)); err != nil {
+			t.Fatalf("Add() error = %v", err)
+		}
+	}
+	for i := 0; i < keys; i += 2 {
+		loader.Add(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+	store, err := loader.Finish()
+	if err != nil {
+		t.Fatalf("Finish() error = %v", err)
+	}
+	if _, err := os.Stat(hintFileName(fileName)); err != nil {
+		t.Errorf("hint file was not written: %v", err)
+	}
+	store.Set("loaded", "yes")
+	store.Close()
+
+	store, result, err := NewDiskStoreWithResult(fileName, Options{})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if !result.HintUsed {
+		t.Errorf("HintUsed = false, want true")
+	}
+	for i := 0; i < keys; i++ {
+		want := fmt.Sprintf("draft-%d", i)
+		if i%2 == 0 {
+			want = fmt.Sprintf("value-%d", i)
+		}
+		if val := store.Get(fmt.Sprintf("key-%d", i)); val != want {
+			t.Fatalf("Get() = %v, want %v", val, want)
+		}
+	}
+	if val := store.Get("loaded"); val != "yes" {
+		t.Errorf("Get() = %v, want %v", val, "yes")
+	}
+}
+
+func TestLoaderExistingFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	os.WriteFile(fileName, nil, 0666)
+	if _, err := NewLoader(fileName); err == nil {
+		t.Errorf("NewLoader() error = nil, want an error for an existing file")
+	}
+}
+
+func BenchmarkLoader(b *testing.B) {
+	loader, err := NewLoader(filepath.Join(b.TempDir(), "test.db"))
+	if err != nil {
+		b.Fatalf("NewLoader() error = %v", err)
+	}
+	for i := 0; i < b.N; i++ {
+		loader.Add(fmt.Sprintf("key-%d", i), "value")
+	}
+	store, err := loader.Finish()
+	if err != nil {
+		b.Fatalf("Finish() error = %v", err)
+	}
+	store.Close()
+}
@@ -12,8 +12,9 @@ func (m *MemoryStore) Get(key string) string {
 	return m.data[key]
 }
 
-func (m *MemoryStore) Set(key string, value string) {
+func (m *MemoryStore) Set(key string, value string) error {
 	m.data[key] = value
+	return nil
 }
 
 func (m *MemoryStore) Close() bool {
@@ -0,0 +1,127 @@
+package caskdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// MigrateFile rewrites the data file at path in format version targetVersion,
+// upgrading an old file to the current version or downgrading it to version 0,
+// the original format without a file header or checksums, for an older release
+// of caskdb. Every record is kept, overwritten versions and tombstones included,
+// each checked against its checksum. Version 0 has no room for tombstones,
+// metadata or expiry times, so downgrading a file holding any returns
+// ErrOldFormat; compacting first drops the tombstones. Compressed values are
+// decompressed.
+//
+// The file must not be open in a store. The new file is written next to it and
+// renamed over it once complete, so a crash leaves either file intact. The hint
+// file, which points into the old file, is removed before the rename.
+// opts.LegacyFormat allows migrating files written before the file header was
+// introduced, and is needed to open a file downgraded to version 0.
+func MigrateFile(path string, targetVersion int, opts Options) error {
+	if targetVersion != 0 && targetVersion != formatVersion {
+		return fmt.Errorf("caskdb: cannot migrate to format version %d, only to 0 or %d", targetVersion, formatVersion)
+	}
+	target := uint32(targetVersion)
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dataStart, version, err := readFileHeader(src, opts.LegacyFormat)
+	if err != nil {
+		return err
+	}
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmpName := compactFileName(path)
+	if err := migrateRecords(src, dataStart, version, info.Size(), tmpName, target, opts); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	// the hint goes first, so that a crash after the rename cannot leave it
+	// pointing into the new file
+	if err := os.Remove(hintFileName(path)); err != nil && !os.IsNotExist(err) {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// migrateRecords writes the records of src, between dataStart and end, to a new
+// data file fileName in format version target
+func migrateRecords(src io.ReaderAt, dataStart int64, version uint32, end int64, fileName string, target uint32, opts Options) error {
+	dst, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	w := bufio.NewWriter(dst)
+	// version 0 predates the file header
+	if target != 0 {
+		if _, err := w.Write(encodeFileHeader(target)); err != nil {
+			return err
+		}
+	}
+	r := bufio.NewReader(io.NewSectionReader(src, dataStart, end-dataStart))
+	var buf []byte
+	for pos := dataStart; pos < end; {
+		_, record, err := readRecord(r, version, buf)
+		if err != nil {
+			return migrateReadError(err, pos)
+		}
+		buf = record
+		size := int64(len(record))
+		if !verifyRecord(version, record) {
+			return fmt.Errorf("%w: checksum mismatch at offset %d", ErrCorruptRecord, pos)
+		}
+		if version != target {
+			h, key, value := decodeRecord(version, record)
+			if target == 0 {
+				if h.isTombstone() || h.meta != 0 || h.expiresAt != 0 || (h.codec() != CodecNone && opts.SeparateValues) {
+					return fmt.Errorf("%w: the record of %q at offset %d", ErrOldFormat, key, pos)
+				}
+				if value, err = h.codec().decode(value); err != nil {
+					return err
+				}
+				h = recordHeader{timestamp: h.timestamp}
+			}
+			record = encodeRecord(target, h, key, value)
+		}
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+		pos += size
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		return err
+	}
+	return dst.Close()
+}
+
+// migrateReadError reports a record cut short by the end of the file at pos as
+// corrupt, rather than just an unexpected EOF
+func migrateReadError(err error, pos int64) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: torn record at offset %d", ErrCorruptRecord, pos)
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrateFileBaseline(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	data := baselineRecord(7, "hamlet", "bacon")
+	data = append(data, baselineRecord(8, "hamlet", "shakespeare")...)
+	data = append(data, baselineRecord(9, "dune", "frank herbert")...)
+	os.WriteFile(fileName, data, 0666)
+
+	if err := MigrateFile(fileName, formatVersion, Options{}); !errors.Is(err, ErrNotACaskDB) {
+		t.Errorf("MigrateFile() error = %v, want %v", err, ErrNotACaskDB)
+	}
+	if err := MigrateFile(fileName, formatVersion, Options{LegacyFormat: true}); err != nil {
+		t.Fatalf("MigrateFile() error = %v", err)
+	}
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if store.version != formatVersion {
+		t.Errorf("version = %v, want %v", store.version, formatVersion)
+	}
+	for key, val := range map[string]string{"hamlet": "shakespeare", "dune": "frank herbert"} {
+		if got := store.Get(key); got != val {
+			t.Errorf("Get(%q) = %v, want %v", key, got, val)
+		}
+	}
+	if _, ts, _ := store.GetWithTimestamp("hamlet"); ts.Unix() != 8 {
+		t.Errorf("GetWithTimestamp() ts = %v, want %v", ts.Unix(), 8)
+	}
+}
+
+func TestMigrateFile(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	data := encodeFileHeader(1)
+	data = append(data, encodeRecord(1, recordHeader{timestamp: 7}, "hamlet", "bacon")...)
+	data = append(data, encodeRecord(1, recordHeader{timestamp: 8}, "hamlet", "shakespeare")...)
+	data = append(data, encodeRecord(1, recordHeader{timestamp: 9}, "dune", "frank herbert")...)
+	os.WriteFile(fileName, data, 0666)
+
+	if err := MigrateFile(fileName, 2, Options{}); err != nil {
+		t.Fatalf("MigrateFile() error = %v", err)
+	}
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	if store.version != 2 {
+		t.Errorf("version = %v, want %v", store.version, 2)
+	}
+	if _, ts, _ := store.GetWithTimestamp("hamlet"); ts.Unix() != 8 {
+		t.Errorf("GetWithTimestamp() ts = %v, want %v", ts.Unix(), 8)
+	}
+	it := store.RawRecords()
+	records := 0
+	for ; it.Next(); records++ {
+	}
+	if records != 3 {
+		t.Errorf("RawRecords() yielded %v records, want %v", records, 3)
+	}
+	// metadata and deletes, which version 1 has no room for, work on the new file
+	if err := store.SetWithMeta("logo", "<svg/>", 42); err != nil {
+		t.Errorf("SetWithMeta() error = %v", err)
+	}
+	if err := store.Delete("dune"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	store.Close()
+
+	// version 1 was never released, so there is nothing to downgrade to
+	if err := MigrateFile(fileName, 1, Options{}); err == nil {
+		t.Errorf("MigrateFile() to version 1 succeeded")
+	}
+	// the tombstone and the metadata do not fit in version 0
+	if err := MigrateFile(fileName, 0, Options{}); !errors.Is(err, ErrOldFormat) {
+		t.Errorf("MigrateFile() error = %v, want %v", err, ErrOldFormat)
+	}
+	store, err = NewDiskStoreWithOptions(fileName, Options{Codec: CodecFlate})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	store.Set("logo", "<svg/>")
+	store.Compact()
+	store.Close()
+	if err := MigrateFile(fileName, 0, Options{}); err != nil {
+		t.Fatalf("MigrateFile() error = %v", err)
+	}
+	// the original format has no file header
+	if data, _ := os.ReadFile(fileName); len(data) >= fileHeaderSize {
+		if _, ok := decodeFileHeader(data[:fileHeaderSize]); ok {
+			t.Errorf("MigrateFile() to version 0 wrote a file header")
+		}
+	}
+	store, err = NewDiskStoreWithOptions(fileName, Options{LegacyFormat: true})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if store.version != 0 {
+		t.Errorf("version = %v, want %v", store.version, 0)
+	}
+	for key, val := range map[string]string{"hamlet": "shakespeare", "logo": "<svg/>", "dune": ""} {
+		if got := store.Get(key); got != val {
+			t.Errorf("Get(%q) = %v, want %v", key, got, val)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package caskdb
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// link is os.Link, swapped out by tests to simulate moves across devices
+var link = os.Link
+
+// MoveTo moves the database to newPath while it is open: the data file is moved
+// to newPath, and its hint, values and lock files along with it. Reads and writes
+// carry on against the new path once it returns. When newPath is on another
+// device, the files are copied and synced before the originals are removed.
+// Writes block while the files are moved. An existing file at newPath, or at the
+// path of one of its other files, is never replaced: MoveTo fails with an error
+// wrapping os.ErrExist instead.
+//
+// If moving any file fails, the ones already moved are moved back and the store
+// keeps using its old path. MoveTo is not supported by stores opened with Open.
+func (d *DiskStore) MoveTo(newPath string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dir != "" {
+		return errors.New("caskdb: MoveTo is not supported by stores opened with Open")
+	}
+	if !d.deferred {
+		if err := d.writeHint(); err != nil {
+			return err
+		}
+	}
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+	type move struct{ from, to string }
+	// the data file goes last, so a store with its data file in place has the
+	// rest of its files too
+	var moves []move
+	if d.opts.NetworkFS {
+		moves = append(moves, move{d.lockFileName(), lockFileName(newPath)})
+	}
+	if d.values != nil {
+		moves = append(moves, move{valuesFileName(d.fileName), valuesFileName(newPath)})
+	}
+	if _, err := os.Stat(hintFileName(d.fileName)); err == nil {
+		moves = append(moves, move{hintFileName(d.fileName), hintFileName(newPath)})
+	}
+	moves = append(moves, move{d.fileName, newPath})
+
+	// an open file cannot be renamed on every platform
+	if err := d.closeFiles(); err != nil {
+		return err
+	}
+	var moveErr error
+	for i, m := range moves {
+		if moveErr = moveFile(m.from, m.to); moveErr != nil {
+			for _, m := range moves[:i] {
+				moveFile(m.to, m.from)
+			}
+			break
+		}
+	}
+	if moveErr == nil {
+		oldDir := filepath.Dir(d.fileName)
+		d.fileName = newPath
+		if err := syncDir(oldDir); err != nil {
+			moveErr = err
+		} else if err := syncDir(filepath.Dir(newPath)); err != nil {
+			moveErr = err
+		}
+	}
+	if err := d.openFiles(); err != nil {
+		return err
+	}
+	return moveErr
+}
+
+// closeFiles closes the data file, values file and read handles
+func (d *DiskStore) closeFiles() error {
+	if err := d.file.Close(); err != nil {
+		return err
+	}
+	if d.values != nil {
+		if err := d.values.Close(); err != nil {
+			return err
+		}
+	}
+	if d.readers != nil {
+		return d.readers.close()
+	}
+	return nil
+}
+
+// openFiles reopens the files closed by closeFiles at the current fileName
+func (d *DiskStore) openFiles() error {
+	file, err := os.OpenFile(d.fileName, os.O_RDWR|d.opts.appendFlag(), 0666)
+	if err != nil {
+		return err
+	}
+	d.file, d.writer = file, file
+	if d.values != nil {
+		if d.values, err = openValuesFile(d.fileName, d.opts); err != nil {
+			return err
+		}
+	}
+	return d.reopenReaders()
+}
+
+// moveFile moves from to to, failing with an error wrapping os.ErrExist rather
+// than replace an existing file at to. It links to to and removes from, falling
+// back to a copy when they are on different devices or the file system has no
+// links. The copy is synced before from is removed.
+func moveFile(from string, to string) error {
+	err := link(from, to)
+	if err == nil {
+		return os.Remove(from)
+	}
+	if errors.Is(err, os.ErrExist) {
+		return err
+	}
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
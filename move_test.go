@@ -0,0 +1,113 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDiskStore_MoveTo(t *testing.T) {
+	defer func() { link = os.Link }()
+	for _, crossDevice := range []bool{false, true} {
+		if crossDevice {
+			link = func(from, to string) error {
+				return &os.LinkError{Op: "link", Old: from, New: to, Err: syscall.EXDEV}
+			}
+		}
+		dir := t.TempDir()
+		fileName := filepath.Join(dir, "test.db")
+		store, err := NewDiskStoreWithOptions(fileName, Options{SeparateValues: true, ReadHandles: 2})
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		store.Set("hamlet", "shakespeare")
+
+		newPath := filepath.Join(dir, "moved", "books.db")
+		os.Mkdir(filepath.Dir(newPath), 0777)
+		if err := store.MoveTo(newPath); err != nil {
+			t.Fatalf("MoveTo() error = %v, cross device = %v", err, crossDevice)
+		}
+		for _, name := range []string{fileName, hintFileName(fileName), valuesFileName(fileName)} {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("%v still exists after MoveTo()", name)
+			}
+		}
+		if val := store.Get("hamlet"); val != "shakespeare" {
+			t.Errorf("Get() = %v, want shakespeare", val)
+		}
+		if err := store.Set("othello", "shakespeare"); err != nil {
+			t.Errorf("Set() error = %v", err)
+		}
+		if !store.Close() {
+			t.Errorf("Close() = false, want true")
+		}
+
+		store, err = NewDiskStoreWithOptions(newPath, Options{SeparateValues: true})
+		if err != nil {
+			t.Fatalf("failed to open moved disk store: %v", err)
+		}
+		for _, key := range []string{"hamlet", "othello"} {
+			if val := store.Get(key); val != "shakespeare" {
+				t.Errorf("Get(%v) = %v, want shakespeare", key, val)
+			}
+		}
+		store.Close()
+	}
+}
+
+func TestDiskStore_MoveToFailure(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	if err := store.MoveTo(filepath.Join(t.TempDir(), "missing", "test.db")); err == nil {
+		t.Fatalf("MoveTo() into a missing directory succeeded")
+	}
+	// the store keeps working from its old path, with its hint moved back
+	if _, err := os.Stat(hintFileName(fileName)); err != nil {
+		t.Errorf("hint file missing after a failed MoveTo(): %v", err)
+	}
+	if err := store.Set("othello", "shakespeare"); err != nil {
+		t.Errorf("Set() error = %v", err)
+	}
+	if val := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want shakespeare", val)
+	}
+}
+
+func TestDiskStore_MoveToExisting(t *testing.T) {
+	defer func() { link = os.Link }()
+	for _, crossDevice := range []bool{false, true} {
+		if crossDevice {
+			link = func(from, to string) error {
+				return &os.LinkError{Op: "link", Old: from, New: to, Err: syscall.EXDEV}
+			}
+		}
+		dir := t.TempDir()
+		fileName := filepath.Join(dir, "test.db")
+		store, err := NewDiskStoreWithOptions(fileName, Options{SeparateValues: true})
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		store.Set("hamlet", "shakespeare")
+
+		// only a sibling of the data file is in the way, which moves first
+		newPath := filepath.Join(dir, "books.db")
+		os.WriteFile(valuesFileName(newPath), []byte("someone else's"), 0666)
+		if err := store.MoveTo(newPath); !errors.Is(err, os.ErrExist) {
+			t.Errorf("MoveTo() error = %v, want %v, cross device = %v", err, os.ErrExist, crossDevice)
+		}
+		if data, _ := os.ReadFile(valuesFileName(newPath)); string(data) != "someone else's" {
+			t.Errorf("MoveTo() replaced an existing file with %q", data)
+		}
+		if val := store.Get("hamlet"); val != "shakespeare" {
+			t.Errorf("Get() = %v, want shakespeare", val)
+		}
+		store.Close()
+	}
+}
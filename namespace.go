@@ -0,0 +1,61 @@
+package caskdb
+
+import (
+	"sort"
+	"strings"
+)
+
+// Namespace is a view of a DiskStore which only sees the keys starting with its
+// prefix. It partitions the keys of a single store, say between tenants, without
+// needing a file for each. Keys are stored as prefix + ":" + key, with any ":"
+// or \ in the prefix escaped by a \, so that keys may hold any byte and no two
+// namespaces share a key.
+type Namespace struct {
+	store  *DiskStore
+	prefix string
+}
+
+// Namespace returns a view of the store whose keys are all prefixed with
+// prefix + ":".
+func (d *DiskStore) Namespace(prefix string) *Namespace {
+	return &Namespace{store: d, prefix: namespaceEscaper.Replace(prefix) + ":"}
+}
+
+// namespaceEscaper escapes the separator in namespace prefixes. Otherwise the
+// key "c" of namespace "a:b" and the key "b:c" of namespace "a" would both be
+// stored as "a:b:c".
+var namespaceEscaper = strings.NewReplacer(`\`, `\\`, ":", `\:`)
+
+// Get gets a value from the namespace, like DiskStore.Get.
+func (n *Namespace) Get(key string) string {
+	return n.store.Get(n.prefix + key)
+}
+
+// Set sets a value in the namespace, like DiskStore.Set.
+func (n *Namespace) Set(key string, value string) error {
+	return n.store.Set(n.prefix+key, value)
+}
+
+// Delete removes a key from the namespace, like DiskStore.Delete.
+func (n *Namespace) Delete(key string) error {
+	return n.store.Delete(n.prefix + key)
+}
+
+// Keys returns the keys in the namespace, without the prefix, in sorted order.
+func (n *Namespace) Keys() ([]string, error) {
+	n.store.mu.RLock()
+	defer n.store.mu.RUnlock()
+	if n.store.deferred {
+		return nil, ErrIndexNotBuilt
+	}
+	var keys []string
+	now := n.store.now().Unix()
+	n.store.keyStore.Range(func(key string, entry KeyEntry) bool {
+		if rest, ok := strings.CutPrefix(key, n.prefix); ok && !entry.expired(now) {
+			keys = append(keys, rest)
+		}
+		return true
+	})
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,63 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestNamespace(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	books := store.Namespace("books")
+	films := store.Namespace("films")
+
+	books.Set("dune", "frank herbert")
+	books.Set("hamlet", "shakespeare")
+	films.Set("dune", "denis villeneuve")
+	store.Set("bookshelf", "ikea")
+	books.Delete("hamlet")
+
+	if val := books.Get("dune"); val != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", val, "frank herbert")
+	}
+	if val := films.Get("dune"); val != "denis villeneuve" {
+		t.Errorf("Get() = %v, want %v", val, "denis villeneuve")
+	}
+	if val := store.Get("films:dune"); val != "denis villeneuve" {
+		t.Errorf("Get() = %v, want the namespaced key stored with its prefix", val)
+	}
+	if keys, err := books.Keys(); err != nil || !slices.Equal(keys, []string{"dune"}) {
+		t.Errorf("Keys() = %v, %v, want %v", keys, err, []string{"dune"})
+	}
+	if keys, err := store.Namespace("book").Keys(); err != nil || len(keys) != 0 {
+		t.Errorf("Keys() = %v, %v, want none", keys, err)
+	}
+}
+
+func TestNamespace_Separator(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// without escaping, both would be stored as "a:b:c"
+	store.Namespace("a").Set("b:c", "short prefix")
+	store.Namespace("a:b").Set("c", "long prefix")
+	store.Namespace(`a\`).Set(`:b:c`, "backslash")
+
+	for prefix, want := range map[string]string{"a": "short prefix", "a:b": "long prefix", `a\`: "backslash"} {
+		ns := store.Namespace(prefix)
+		keys, err := ns.Keys()
+		if err != nil || len(keys) != 1 {
+			t.Errorf("Keys() of %q = %q, want a single key", prefix, keys)
+			continue
+		}
+		if val := ns.Get(keys[0]); val != want {
+			t.Errorf("Get(%q) of %q = %v, want %v", keys[0], prefix, val, want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Network filesystems like NFS and SMB do not give the guarantees the store relies
+// on locally. Appends with O_APPEND are not atomic on NFS: the client computes the
+// end of the file from its cached attributes, so records can land at the wrong
+// offset. Writes fail transiently while the server is unreachable. And there is no
+// other process to coordinate with but the ones on the other clients, which advisory
+// locks do not reliably reach. Options.NetworkFS deals with all three: files are
+// opened without O_APPEND and written at the offset the store seeks to, failed
+// writes are retried, and a lock file created with O_EXCL keeps a second store
+// from opening the same database. The store never maps its files into memory, so
+// there is no mmap to disable.
+
+// networkFSWriteRetries is Options.WriteRetries with Options.NetworkFS, when it is
+// not set
+const networkFSWriteRetries = 5
+
+// ErrLocked is returned when opening a store with Options.NetworkFS while its lock
+// file exists, because another store has it open or crashed without removing it.
+var ErrLocked = errors.New("caskdb: the store is locked by another process")
+
+// appendFlag is the flag the files written to are opened with
+func (o Options) appendFlag() int {
+	if o.NetworkFS {
+		return 0
+	}
+	return os.O_APPEND
+}
+
+func lockFileName(fileName string) string {
+	return fileName + ".lock"
+}
+
+// lockFileName is the lock file of the store, see Options.NetworkFS. In directory
+// mode it is in the directory, since the active segment changes.
+func (d *DiskStore) lockFileName() string {
+	if d.dir != "" {
+		return filepath.Join(d.dir, "LOCK")
+	}
+	return lockFileName(d.fileName)
+}
+
+// acquireLock creates the lock file, returning ErrLocked if it exists. The file
+// holds the host and process holding the lock, to help removing a stale one.
+func (d *DiskStore) acquireLock() error {
+	file, err := os.OpenFile(d.lockFileName(), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return fmt.Errorf("%w: %s exists", ErrLocked, d.lockFileName())
+	}
+	if err != nil {
+		return err
+	}
+	host, _ := os.Hostname()
+	_, err = fmt.Fprintf(file, "%s %d\n", host, os.Getpid())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(d.lockFileName())
+	}
+	return err
+}
+
+// releaseLock removes the lock file, if the store holds one
+func (d *DiskStore) releaseLock() error {
+	if !d.opts.NetworkFS {
+		return nil
+	}
+	return os.Remove(d.lockFileName())
+}
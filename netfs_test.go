@@ -0,0 +1,96 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_NetworkFS(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{NetworkFS: true, SeparateValues: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if _, err := os.Stat(lockFileName(fileName)); err != nil {
+		t.Errorf("lock file was not created: %v", err)
+	}
+	if _, err := NewDiskStoreWithOptions(fileName, Options{NetworkFS: true}); !errors.Is(err, ErrLocked) {
+		t.Errorf("second open error = %v, want %v", err, ErrLocked)
+	}
+	if store.opts.WriteRetries != networkFSWriteRetries {
+		t.Errorf("WriteRetries = %v, want %v", store.opts.WriteRetries, networkFSWriteRetries)
+	}
+	// the flags of the handle are only visible on Linux
+	if info, err := os.ReadFile(fmt.Sprintf("/proc/self/fdinfo/%d", store.file.Fd())); err == nil {
+		for _, line := range strings.Split(string(info), "\n") {
+			if flags, ok := strings.CutPrefix(line, "flags:"); ok {
+				if flags, _ := strconv.ParseUint(strings.TrimSpace(flags), 8, 64); flags&uint64(os.O_APPEND) != 0 {
+					t.Errorf("data file is opened with O_APPEND")
+				}
+			}
+		}
+	}
+
+	for i := range 100 {
+		store.Set(fmt.Sprintf("key-%d", i), strings.Repeat("v", i))
+	}
+	store.Delete("key-0")
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	check := func(store *DiskStore) {
+		t.Helper()
+		for i := 1; i < 100; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if got := store.Get(key); got != strings.Repeat("v", i) {
+				t.Errorf("Get(%q) = %q, want %d bytes", key, got, i)
+			}
+		}
+		if got := store.Get("hamlet"); got != "shakespeare" {
+			t.Errorf("Get() = %v, want %v", got, "shakespeare")
+		}
+	}
+	check(store)
+	if !store.Close() {
+		t.Fatalf("Close() failed")
+	}
+	if _, err := os.Stat(lockFileName(fileName)); !os.IsNotExist(err) {
+		t.Errorf("lock file was not removed by Close()")
+	}
+
+	store, err = NewDiskStoreWithOptions(fileName, Options{NetworkFS: true, SeparateValues: true})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	check(store)
+}
+
+func TestOpenNetworkFS(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, Options{NetworkFS: true})
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	if err := store.Rotate(); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	store.Set("dune", "frank herbert")
+	if _, err := Open(dir, Options{NetworkFS: true}); !errors.Is(err, ErrLocked) {
+		t.Errorf("second Open() error = %v, want %v", err, ErrLocked)
+	}
+	if got := store.Get("hamlet"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", got, "shakespeare")
+	}
+	if got := store.Get("dune"); got != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", got, "frank herbert")
+	}
+}
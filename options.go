@@ -0,0 +1,338 @@
+package caskdb
+
+import (
+	"io"
+	"log"
+	"time"
+)
+
+// defaultRetryBackoff is the wait before the first retry of a failed write, when
+// Options.RetryBackoff is not set
+const defaultRetryBackoff = 10 * time.Millisecond
+
+// defaultLockShards is the number of write lock shards when Options.LockShards is
+// not set
+const defaultLockShards = 16
+
+// defaultScanBufferSize is the read buffer of the scan of the data file on open,
+// when Options.ScanBufferSize is not set
+const defaultScanBufferSize = 64 << 10
+
+// OpenMode decides what opening a store does about corrupt records, see
+// Options.OpenMode.
+type OpenMode int
+
+const (
+	// OpenLenient recovers what it can: a record torn by a crash at the end of
+	// the data file is truncated away, and a record running past the end of
+	// the file with valid records after it, which is corrupt rather than torn,
+	// is skipped along with everything up to the next valid record, see
+	// OpenResult.Skipped. Checksums are not verified, so a record whose sizes
+	// are intact but whose contents are not is loaded as is; ReadRepair deals
+	// with those at compaction.
+	OpenLenient OpenMode = iota
+	// OpenStrict refuses to open a data file with a torn record or a record
+	// whose checksum does not match, returning ErrCorruptRecord. It reads every
+	// value to verify its checksum, which makes opening slower.
+	OpenStrict
+)
+
+// Options configures the behaviour of a DiskStore. The zero value is the default
+// configuration, which is what NewDiskStore uses.
+type Options struct {
+	// SkipIdenticalWrites makes Set compare the new value against the value
+	// currently stored for the key, and skip the append entirely when they are
+	// equal. This keeps applications which re-Set the same pair from bloating the
+	// log, at the cost of one extra disk read for every Set of an existing key.
+	SkipIdenticalWrites bool
+
+	// Logger receives diagnostics such as records discarded while opening the
+	// store. When nil, the standard logger of the log package is used.
+	Logger *log.Logger
+
+	// AllowUnsafeInPlace permits Shrink, which compacts the data file in place.
+	// A crash during Shrink corrupts the database, so only enable it when there is
+	// no room on the disk for a safer copy-based compaction.
+	AllowUnsafeInPlace bool
+
+	// SeparateValues keeps values in a separate values file next to the data
+	// file, so that building the keyStore on open only has to read the keys. This
+	// makes opening much faster for stores with large values, at the cost of an
+	// extra read for every Get. A store must always be opened with the same
+	// setting it was created with.
+	SeparateValues bool
+
+	// Dedup makes Set point records at an identical value already in the values
+	// file instead of appending the value again, which saves a lot of space when
+	// many keys share large values. It keeps the size and checksum of every value
+	// written since the store was opened in memory; values written before are not
+	// deduplicated against. Requires SeparateValues.
+	Dedup bool
+
+	// WriteRetries is how many times a failed write is retried before Set gives
+	// up and returns the error. Some filesystems, like NFS, fail writes
+	// transiently. Any partially written record is truncated away before retrying.
+	WriteRetries int
+
+	// RetryBackoff is the wait before the first retry of a failed write, doubled
+	// on every following retry. Defaults to 10ms.
+	RetryBackoff time.Duration
+
+	// NewKeyDir creates the KeyDir holding the location of every key. Defaults to
+	// NewMapKeyDir.
+	NewKeyDir func() KeyDir
+
+	// LockShards is the number of locks the keys are partitioned over for
+	// writes. Writes to keys in different shards run concurrently, though they
+	// still briefly serialise while appending to the file. 1 serialises all
+	// writes. Defaults to 16.
+	LockShards int
+
+	// LegacyFormat allows opening data files written before the file header was
+	// introduced, which have no magic and version: the original format without
+	// checksums, told apart by the first record, or version 1 of the format.
+	// Files with a header are still validated as usual. A torn record at the end
+	// of a legacy file fails the open rather than being truncated away, as
+	// without checksums there is no telling it from a corrupt record.
+	LegacyFormat bool
+
+	// Resolver picks the value to keep when Apply receives a set event with the
+	// same timestamp as the record already stored for the key. It should be
+	// deterministic, so that replicas converge whatever order they see events in.
+	// Defaults to keeping the larger of the two values.
+	Resolver func(key, existingVal, incomingVal string) string
+
+	// CompactOnClose makes Close run a final Compact before closing the file, for
+	// long lived services which want a tidy file without a separate maintenance
+	// job. If compaction fails the file is still closed, and Close reports failure.
+	// The final Compact is skipped when another compaction is still running.
+	CompactOnClose bool
+
+	// ConcurrentCompaction lets Set and Delete carry on while Compact runs,
+	// instead of blocking until it finishes. The data file is compacted up to
+	// where it ended when Compact was called, and the records written meanwhile
+	// are copied over as they are, with writes blocked only for that copy and the
+	// swap of the files. No write is lost either way. Stores opened with Open
+	// always block writes while compacting.
+	ConcurrentCompaction bool
+
+	// MaxStaleRecords makes CompactIfNeeded compact once this many records are
+	// dead, overwritten or deleted, whatever their size, on top of its byte ratio
+	// threshold. Small records overwritten over and over bloat the keyStore scan
+	// more than the ratio of their bytes tells. 0 only uses the ratio.
+	MaxStaleRecords int
+
+	// ReadHandles is the number of read only file handles kept open for Get,
+	// apart from the handle used for appends, so that reads and appends do not
+	// share a handle and parallel reads do not contend on a single one. Defaults
+	// to 1; a negative number reads through the append handle.
+	ReadHandles int
+
+	// MaxTotalSize caps the size of the files of the store, in bytes: the data
+	// file, the read-only segments and the values file. A write which would go
+	// past it fails with ErrStoreFull, after Set, Put and the variants of Set have
+	// tried compacting to make room. Deletes are always allowed, so that space can be
+	// freed. Writes running concurrently are all checked against the size before
+	// any of them, so together they may end up a few records past the cap. 0 is
+	// unlimited.
+	MaxTotalSize int64
+
+	// PreallocateBytes reserves this much disk space for the data file when it is
+	// opened and after every compaction, which reduces fragmentation and makes
+	// running out of space show up on open rather than in the middle of writes.
+	// The reserved space is not part of the file size, so the store only ever
+	// sees real records. It is only implemented on Linux, and ignored by file
+	// systems which do not support it.
+	PreallocateBytes int64
+
+	// VerifyOnRead makes Get check that the record read from the disk belongs to
+	// the requested key, returning ErrIndexCorrupt when it does not. This catches
+	// a keyStore which drifted out of sync with the data file early, at the cost
+	// of a comparison on every read.
+	VerifyOnRead bool
+
+	// KeyQuota returns the largest value, in bytes, which may be set for key, so
+	// that tenants sharing a store can be capped. Set and Put return
+	// ErrQuotaExceeded for larger values. A quota of 0 or less is unlimited, as is
+	// every key when KeyQuota is nil.
+	KeyQuota func(key string) int64
+
+	// MaxOpenSegments caps the number of read-only segments of a store opened
+	// with Open which have an open file handle. The least recently read segments
+	// are closed, and reopened when read again, so huge databases do not exhaust
+	// the file descriptor limit. 0 keeps every segment open once read.
+	MaxOpenSegments int
+
+	// DeferIndex skips building the keyStore when opening the store, which makes
+	// opening a huge file instant for write-only workloads like log ingestion.
+	// Set and Delete work as usual, while reads, compaction and hint files fail
+	// with ErrIndexNotBuilt until BuildIndex is called. Reads which return no
+	// error, like Get and Lookup, report every key as not found meanwhile.
+	DeferIndex bool
+
+	// Codec compresses values as they are written. Only data files in the current
+	// format version have room to record the codec; values written to older files
+	// are stored uncompressed.
+	Codec Codec
+
+	// CompactionCodec recompresses values during compaction, typically with a
+	// stronger codec than Codec: write fast, compact small. CodecNone keeps every
+	// value as it was written. Values in the values file of SeparateValues are
+	// never recompressed.
+	CompactionCodec Codec
+
+	// SortOnCompact makes compaction write the live records sorted by key, so
+	// that keys sharing a prefix end up next to each other in the file, which
+	// makes reading them in order sequential and the file compress better. The
+	// compacted file is rewritten a second time in key order, which reads it in
+	// random order.
+	SortOnCompact bool
+
+	// TempDir is the directory Compact and ReplaceAll write their temporary file
+	// to, instead of next to the data file, say when the data volume is slow. The
+	// complete file is then moved next to the data file, copying it when TempDir
+	// is on another device, and renamed over it. Stores can share a TempDir,
+	// their temporary files are named after the path of the store.
+	TempDir string
+
+	// OpenMode decides whether opening the store recovers from corrupt records or
+	// fails on them. Only the records scanned on open are checked: those covered
+	// by a hint file are not. Defaults to OpenLenient.
+	OpenMode OpenMode
+
+	// ExpireInterval runs ExpireExpiredKeys in the background at this interval,
+	// so that keys set with SetWithTTL free their memory soon after they expire
+	// even if they are never read again. 0 leaves expired keys until they are
+	// read, purged or compacted away.
+	ExpireInterval time.Duration
+
+	// DebugAsserts makes every write read back the record it just appended and
+	// check it is at the offset the keyStore is about to point at, returning
+	// ErrAssertion otherwise. It catches offset tracking bugs the moment they
+	// happen rather than on some later read, at the cost of a read for every
+	// write, so it is meant for development and tests.
+	DebugAsserts bool
+
+	// KeepVersions is how many of the most recent versions of every key
+	// compaction keeps, for audit trails or reading recent history with GetAt and
+	// RawRecords. Get still only sees the latest. Deleting a key drops all its
+	// versions, as does Shrink. Kept versions still count as dead bytes in Stats.
+	// 0 and 1 keep only the latest version.
+	KeepVersions int
+
+	// KeyNormalizer maps every key passed to reads and writes to the form it is
+	// stored under, say strings.ToLower for case-insensitive keys, so that reads
+	// and writes agree on the key. It must be idempotent. Opening a store with a
+	// different normalizer than it was written with is unsupported: keys stored
+	// in the old form may become unreachable.
+	KeyNormalizer func(key string) string
+
+	// Clock returns the current time, which timestamps records and decides when
+	// keys set with SetWithTTL expire. Tests can pass a fake clock to check time
+	// dependent behaviour without sleeping. Defaults to time.Now.
+	Clock func() time.Time
+
+	// MonotonicTimestamps keeps the timestamps of the records written by the
+	// store increasing even when the clock goes backwards, say when it is stepped
+	// back by NTP: a record is stamped one second past the latest timestamp given
+	// out so far whenever the clock is behind it or still within the same second,
+	// rather than with a time which would make Apply, and anything else going by
+	// last writer wins, take it for the older write. Under more than one write a
+	// second, timestamps run ahead of the clock. The latest timestamp starts from
+	// the newest record in the files when the store is opened, tombstones
+	// included, and is kept in the hint file. Timestamps passed explicitly, as to
+	// SetWithTimestamp, are kept as they are.
+	MonotonicTimestamps bool
+
+	// AuditWriter receives a line for every Set and Delete, with the timestamp,
+	// the key and the size of the value, but never the value itself, for audit
+	// trails. Lines are buffered and flushed by Close, so a slow writer does not
+	// hold up writes. The data file does not depend on it in any way.
+	AuditWriter io.Writer
+
+	// TrackHotKeys counts the writes to each key for HotKeys. The counts live in
+	// a bounded table behind a single lock taken by every Set and Delete, and a
+	// write to a key which is not counted yet scans the table once it is full, so
+	// it is off unless asked for.
+	TrackHotKeys bool
+
+	// ReadRepair makes compaction verify the checksum of the latest record of
+	// every key, and replace a corrupt one with the newest intact older version of
+	// the key, logging the repair. The older value is better than losing the key
+	// altogether, but it is stale, so this is opt-in. Keys without an intact
+	// older version keep their corrupt record.
+	ReadRepair bool
+
+	// HintInterval writes the hint file in the background at this interval, on
+	// top of Close, so that reopening after a crash only has to scan the records
+	// written since the last hint. Writes block while the hint is written. 0 only
+	// writes the hint on Close.
+	HintInterval time.Duration
+
+	// ScanBufferSize is the size of the read buffer used to scan the records of
+	// the data file when opening the store, so that reading the header and key
+	// of every record takes a handful of syscalls rather than several. Values
+	// larger than what is left in the buffer are seeked over. Defaults to 64KiB;
+	// a negative size reads straight from the file, without a buffer.
+	ScanBufferSize int
+
+	// GroupCommit hands every append to a single committer goroutine, which
+	// writes the appends of concurrent writers as one batch and syncs it once,
+	// rather than syncing every record on its own. Writes still only return once
+	// their record is synced. It raises the throughput of many concurrent
+	// writers, at the cost of a goroutine handoff for a lone writer.
+	GroupCommit bool
+
+	// SyncEveryN syncs the data file once every N writes, deletes included,
+	// rather than after each of them, so a crash loses at most the last N-1
+	// writes. Writes return before their record is synced, unless it is the Nth;
+	// Sync syncs the pending writes right away. It has no effect with
+	// GroupCommit, which syncs every batch. 0 syncs every write.
+	SyncEveryN int
+
+	// NetworkFS makes the store safe to use on network filesystems like NFS and
+	// SMB: records are written at explicit offsets rather than relying on
+	// O_APPEND, failed writes are retried as if WriteRetries were 5, unless it
+	// is set, and a lock file next to the data file keeps other stores, on this
+	// machine or another, from opening the database, returning ErrLocked. Close
+	// removes the lock file; after a crash, it has to be removed by hand.
+	NetworkFS bool
+
+	// CacheAllValues keeps the value of every key in memory, read when the store
+	// is opened and kept up to date by every write, so that Get never reads the
+	// disk. Writes still go to the file as usual. This turns the store into a
+	// durable in-memory map for data sets which fit in memory, at the cost of
+	// holding all of it. GetReader still streams values from the disk.
+	CacheAllValues bool
+
+	// WarmCache keeps the values of the keys passed to Warm in memory, kept up to
+	// date by writes, so that reading them never goes to the disk. Services can
+	// preload their hot keys on startup this way without caching everything as
+	// CacheAllValues does. The cache starts out empty every time the store is
+	// opened.
+	WarmCache bool
+
+	// ExpireOnAccess makes reads which find an expired key purge it right away,
+	// writing a tombstone and dropping it from the keyStore, rather than only
+	// reporting it absent and leaving it to ExpireExpiredKeys or compaction.
+	// Memory is reclaimed sooner, but reads turn into writes: every first read of
+	// an expired key appends and syncs a record, which adds up when many keys
+	// expire and are polled.
+	ExpireOnAccess bool
+
+	// IndexFunc maintains a secondary index for LookupByIndex: every key whose
+	// value it maps to an index key, say a field of the value, can be found by
+	// that index key. Keys it returns false for are not indexed. The index is
+	// kept in memory and updated by every write; it is built when the store is
+	// opened by reading every value, which makes opening as slow as reading the
+	// whole store, and costs the memory of every key once more.
+	IndexFunc func(key, value string) (indexKey string, ok bool)
+}
+
+// keepLarger is the default Options.Resolver
+func keepLarger(key, existingVal, incomingVal string) string {
+	if incomingVal > existingVal {
+		return incomingVal
+	}
+	return existingVal
+}
@@ -0,0 +1,65 @@
+package caskdb
+
+import (
+	"errors"
+	"io"
+	"slices"
+)
+
+// FindOrphans returns the keys, sorted, whose entry in the keyStore points at a
+// record which is not there: running past the end of the file, or not a record of
+// that key and size. This is what is left when the data file loses its end after
+// the keyStore was built, say a torn tail truncated away by another process
+// recovering the file, or a hint which disagrees with the file, and helps assess
+// the damage. Only the header and key of every record are read, so corrupt values
+// are not noticed, nor are values lost from the values file of
+// Options.SeparateValues; the store is not modified.
+func (d *DiskStore) FindOrphans() ([]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.deferred {
+		return nil, ErrIndexNotBuilt
+	}
+	info, err := d.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	d.keyStore.Range(func(key string, entry KeyEntry) bool {
+		var orphan bool
+		if orphan, err = d.orphaned(key, entry, info.Size()); err != nil {
+			return false
+		}
+		if orphan {
+			orphans = append(orphans, key)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(orphans)
+	return orphans, nil
+}
+
+// orphaned reports whether the record entry points at is missing, in part or
+// whole, or is not a record of key. fileSize is the size of the data file. The
+// caller must hold mu.
+func (d *DiskStore) orphaned(key string, entry KeyEntry, fileSize int64) (bool, error) {
+	version := d.version
+	if seg, ok := d.segments[entry.segment]; ok && entry.segment != d.segment {
+		version, fileSize = seg.version, seg.size
+	}
+	headerSize := recordHeaderSize(version)
+	if int(entry.totalSize) < headerSize+len(key) || int64(entry.position)+int64(entry.totalSize) > fileSize {
+		return true, nil
+	}
+	buf := make([]byte, headerSize+len(key))
+	if _, _, err := d.readEntry(buf, entry); err == io.EOF || errors.Is(err, ErrIndexCorrupt) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	h := decodeRecordHeader(version, buf[:headerSize])
+	return h.size(version) != int64(entry.totalSize) || string(buf[headerSize:]) != key, nil
+}
@@ -0,0 +1,44 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDiskStore_FindOrphans(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	info, _ := os.Stat(fileName)
+	validSize := info.Size()
+	store.Set("dune", "frank herbert")
+	store.Set("anna karenina", "tolstoy")
+	defer store.Close()
+	// the end of the file is lost after the keyStore is built, cutting into the
+	// value of dune, right after its header and key
+	if err := os.Truncate(fileName, validSize+int64(headerSize+len("dune")+5)); err != nil {
+		t.Fatalf("failed to truncate data file: %v", err)
+	}
+
+	orphans, err := store.FindOrphans()
+	if err != nil {
+		t.Fatalf("FindOrphans() error = %v", err)
+	}
+	if want := []string{"anna karenina", "dune"}; !slices.Equal(orphans, want) {
+		t.Errorf("FindOrphans() = %v, want %v", orphans, want)
+	}
+	if _, ok := store.keyStore.Get("dune"); !ok {
+		t.Errorf("FindOrphans() removed the orphaned key")
+	}
+	if _, err := store.Fetch("dune"); err == nil {
+		t.Errorf("Fetch() of an orphaned key succeeded")
+	}
+	if got := store.Get("hamlet"); got != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", got, "shakespeare")
+	}
+}
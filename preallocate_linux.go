@@ -0,0 +1,22 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize is FALLOC_FL_KEEP_SIZE, which reserves the blocks without
+// changing the size of the file
+const fallocKeepSize = 0x1
+
+// preallocate reserves size bytes of disk space for file. The file size is left
+// untouched, so the end of the file is still the end of the last record. File
+// systems which do not support it are silently skipped.
+func preallocate(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), fallocKeepSize, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return nil
+	}
+	return err
+}
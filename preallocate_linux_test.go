@@ -0,0 +1,43 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDiskStore_PreallocateBytes(t *testing.T) {
+	const reserve = 1 << 20
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{PreallocateBytes: reserve})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+
+	info, _ := os.Stat(fileName)
+	if allocated := info.Sys().(*syscall.Stat_t).Blocks * 512; allocated < reserve {
+		t.Skipf("file system did not preallocate, %d bytes allocated", allocated)
+	}
+	want := int64(fileHeaderSize) +
+		int64(len(encodeRecord(formatVersion, recordHeader{}, "hamlet", "shakespeare"))) +
+		int64(len(encodeRecord(formatVersion, recordHeader{}, "dune", "frank herbert")))
+	if info.Size() != want {
+		t.Errorf("file size = %v, want %v", info.Size(), want)
+	}
+	if stats, _ := store.Stats(); stats.Keys != 2 || stats.TotalBytes != want {
+		t.Errorf("Stats() = %+v, want 2 keys and %v bytes", stats, want)
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, Options{PreallocateBytes: reserve})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if val := store.Get("dune"); val != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", val, "frank herbert")
+	}
+}
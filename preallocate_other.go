@@ -0,0 +1,11 @@
+//go:build !linux
+
+package caskdb
+
+import "os"
+
+// preallocate is a no-op on platforms which cannot reserve space without growing
+// the file
+func preallocate(file *os.File, size int64) error {
+	return nil
+}
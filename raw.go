@@ -0,0 +1,168 @@
+package caskdb
+
+import "fmt"
+
+// RawRecord is a single record as it is stored in the log. Unlike Get, which only
+// sees the latest value of a key, raw records include every version which has not
+// been compacted away yet.
+type RawRecord struct {
+	Position  uint64
+	Timestamp uint32
+	Key       string
+	Value     string
+	// Meta is the metadata set by SetWithMeta, 0 if there is none
+	Meta uint32
+	// ExpiresAt is the Unix time the key expires at, set by the TTL variants of
+	// Set, 0 if it never expires
+	ExpiresAt uint32
+	// Deleted reports whether the record is a tombstone written by Delete
+	Deleted bool
+
+	// size is the length of the record in the data file
+	size uint32
+}
+
+// RawIterator walks over the records of the log in the order they were written.
+//
+// Typical usage example:
+//
+//	it := store.RawRecords()
+//	for it.Next() {
+//		record := it.Record()
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type RawIterator struct {
+	store  *DiskStore
+	pos    int64
+	end    int64
+	record RawRecord
+	err    error
+	// dead skips the records which are the live version of their key, with
+	// segment the segment of the file being walked
+	dead    bool
+	segment uint32
+}
+
+// RawRecords returns an iterator over every record currently in the log. Records
+// appended after the call are not visited, and the iterator must not be used after
+// the file is rewritten by Shrink or Compact.
+func (d *DiskStore) RawRecords() *RawIterator {
+	return d.rawRecordsFrom(d.dataStart)
+}
+
+// DeadRecords returns an iterator over the records which are no longer live: the
+// superseded versions of a key and the tombstones, which compaction reclaims
+// except for the versions kept by Options.KeepVersions. It is RawRecords without
+// the records Get would read, and has the same limitations.
+func (d *DiskStore) DeadRecords() *RawIterator {
+	it := d.rawRecordsFrom(d.dataStart)
+	it.dead = true
+	it.segment = d.segment
+	return it
+}
+
+// rawRecordsFrom returns an iterator over the records starting at the offset pos
+func (d *DiskStore) rawRecordsFrom(pos int64) *RawIterator {
+	it := &RawIterator{store: d, pos: pos}
+	info, err := d.file.Stat()
+	if err != nil {
+		it.err = err
+		return it
+	}
+	it.end = info.Size()
+	return it
+}
+
+// Next advances the iterator to the next record, returning false when there are no
+// more records or an error occurred.
+func (it *RawIterator) Next() bool {
+	it.store.mu.RLock()
+	defer it.store.mu.RUnlock()
+	for it.err == nil && it.pos < it.end {
+		record, err := it.store.readRecordAt(it.pos, it.end)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.pos += int64(record.size)
+		if it.dead && it.live(record) {
+			continue
+		}
+		it.record = record
+		return true
+	}
+	return false
+}
+
+// live reports whether record is the version of its key in the keyStore
+func (it *RawIterator) live(record RawRecord) bool {
+	if record.Deleted {
+		return false
+	}
+	entry, ok := it.store.keyStore.Get(record.Key)
+	return ok && entry.segment == it.segment && uint64(entry.position) == record.Position
+}
+
+// Record returns the record the iterator is positioned at.
+func (it *RawIterator) Record() RawRecord {
+	return it.record
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *RawIterator) Err() error {
+	return it.err
+}
+
+// GetAt decodes the record stored at the given file offset, which must be the start
+// of a record, such as the Position of a RawRecord. Since old versions stay in the
+// log until compaction, this can read values that have since been overwritten.
+func (d *DiskStore) GetAt(position uint64) (key, value string, err error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	info, err := d.file.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	record, err := d.readRecordAt(int64(position), info.Size())
+	if err != nil {
+		return "", "", err
+	}
+	return record.Key, record.Value, nil
+}
+
+// readRecordAt reads and validates the record starting at position. end is the
+// size of the log, records running past it are rejected.
+func (d *DiskStore) readRecordAt(position int64, end int64) (RawRecord, error) {
+	size := int64(recordHeaderSize(d.version))
+	if position < d.dataStart || position+size > end {
+		return RawRecord{}, fmt.Errorf("%w: %d", ErrInvalidOffset, position)
+	}
+	header := make([]byte, size)
+	if _, err := d.readAt(header, position); err != nil {
+		return RawRecord{}, err
+	}
+	totalSize := decodeRecordHeader(d.version, header).size(d.version)
+	if position+totalSize > end {
+		return RawRecord{}, fmt.Errorf("%w: %d", ErrInvalidOffset, position)
+	}
+	buf := make([]byte, totalSize)
+	if _, err := d.readAt(buf, position); err != nil {
+		return RawRecord{}, err
+	}
+	if !verifyRecord(d.version, buf) {
+		return RawRecord{}, fmt.Errorf("%w: %d", ErrInvalidOffset, position)
+	}
+	h, key, value := decodeRecord(d.version, buf)
+	if !h.isTombstone() {
+		var err error
+		if value, err = d.resolveValue(value); err != nil {
+			return RawRecord{}, err
+		}
+		if value, err = h.codec().decode(value); err != nil {
+			return RawRecord{}, err
+		}
+	}
+	return RawRecord{uint64(position), h.timestamp, key, value, h.meta, h.expiresAt, h.isTombstone(), uint32(totalSize)}, nil
+}
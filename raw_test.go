@@ -0,0 +1,111 @@
+package caskdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_RawRecords(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Set("othello", "william shakespeare")
+
+	want := []struct{ key, value string }{
+		{"othello", "shakespeare"},
+		{"dune", "frank herbert"},
+		{"othello", "william shakespeare"},
+	}
+	it := store.RawRecords()
+	i := 0
+	for ; it.Next(); i++ {
+		record := it.Record()
+		if i >= len(want) {
+			t.Fatalf("RawRecords() yielded more than %v records", len(want))
+		}
+		if record.Key != want[i].key || record.Value != want[i].value {
+			t.Errorf("record %v = %v/%v, want %v/%v", i, record.Key, record.Value, want[i].key, want[i].value)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("RawRecords() error = %v", err)
+	}
+	if i != len(want) {
+		t.Errorf("RawRecords() yielded %v records, want %v", i, len(want))
+	}
+}
+
+func TestDiskStore_DeadRecords(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Set("othello", "william shakespeare")
+	store.Set("hamlet", "shakespeare")
+	store.Set("othello", "w. shakespeare")
+	store.Delete("hamlet")
+
+	want := []struct {
+		key, value string
+		deleted    bool
+	}{
+		{"othello", "shakespeare", false},
+		{"othello", "william shakespeare", false},
+		{"hamlet", "shakespeare", false},
+		{"hamlet", "", true},
+	}
+	it := store.DeadRecords()
+	i := 0
+	for ; it.Next(); i++ {
+		record := it.Record()
+		if i >= len(want) {
+			t.Fatalf("DeadRecords() yielded more than %v records", len(want))
+		}
+		if record.Key != want[i].key || record.Value != want[i].value || record.Deleted != want[i].deleted {
+			t.Errorf("record %v = %v/%v/%v, want %v/%v/%v", i, record.Key, record.Value, record.Deleted, want[i].key, want[i].value, want[i].deleted)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("DeadRecords() error = %v", err)
+	}
+	if i != len(want) {
+		t.Errorf("DeadRecords() yielded %v records, want %v", i, len(want))
+	}
+}
+
+func TestDiskStore_GetAt(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	entry, _ := store.keyStore.Get("othello")
+	oldPosition := uint64(entry.position)
+	store.Set("othello", "william shakespeare")
+
+	key, value, err := store.GetAt(oldPosition)
+	if err != nil {
+		t.Fatalf("GetAt() error = %v", err)
+	}
+	if key != "othello" || value != "shakespeare" {
+		t.Errorf("GetAt() = %v/%v, want %v/%v", key, value, "othello", "shakespeare")
+	}
+	if store.Get("othello") != "william shakespeare" {
+		t.Errorf("Get() = %v, want %v", store.Get("othello"), "william shakespeare")
+	}
+
+	for _, position := range []uint64{oldPosition + 1, 1 << 40} {
+		if _, _, err := store.GetAt(position); !errors.Is(err, ErrInvalidOffset) {
+			t.Errorf("GetAt(%v) error = %v, want %v", position, err, ErrInvalidOffset)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package caskdb
+
+import (
+	"io"
+	"os"
+)
+
+// valueReader reads a value straight from the file, through its own handle so
+// that it stays usable after the read lock is released
+type valueReader struct {
+	io.Reader
+	file *os.File
+}
+
+func (r *valueReader) Close() error {
+	return r.file.Close()
+}
+
+// GetReader returns a reader over the value of key and the length of the value,
+// reporting whether the key exists. The value is streamed from the disk rather
+// than read into memory, which suits values of many megabytes. The caller must
+// close the reader. Compressed values (see Options.Codec) are decompressed as they
+// are read, and their length is reported once decompressed, as ValueSize does.
+//
+// As with Get, the checksum of the value is not verified. The reader has its own
+// file handle, so it keeps reading the value written at the time of the call even
+// if the key is overwritten or the store is compacted meanwhile, except by Shrink,
+// which moves records within the file.
+func (d *DiskStore) GetReader(key string) (io.ReadCloser, int64, bool, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.deferred {
+		return nil, 0, false, ErrIndexNotBuilt
+	}
+	entry, ok := d.keyStore.Get(d.normalizeKey(key))
+	if !ok || entry.expired(d.now().Unix()) {
+		return nil, 0, false, nil
+	}
+
+	fileName, version := d.fileName, d.version
+	if seg, ok := d.segments[entry.segment]; ok && entry.segment != d.segment {
+		fileName, version = seg.fileName, seg.version
+	}
+	var h recordHeader
+	var offset, size int64
+	if d.values != nil {
+		buf := make([]byte, entry.totalSize)
+		if _, _, err := d.readEntry(buf, entry); err != nil {
+			return nil, 0, false, err
+		}
+		var location string
+		h, _, location = decodeRecord(d.version, buf)
+		valueOffset, valueSize, _, err := decodeValueLocation(location)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		fileName = valuesFileName(d.fileName)
+		offset, size = int64(valueOffset), int64(valueSize)
+	} else {
+		buf := make([]byte, recordHeaderSize(version))
+		if _, _, err := d.readEntry(buf, entry); err != nil {
+			return nil, 0, false, err
+		}
+		h = decodeRecordHeader(version, buf)
+		offset = int64(entry.position) + int64(len(buf)) + int64(h.keySize)
+		size = int64(h.valueSize)
+		if h.flags&flagExpires != 0 {
+			offset, size = offset+expirySize, size-expirySize
+		}
+	}
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	var r io.Reader = io.NewSectionReader(file, offset, size)
+	if h.codec() != CodecNone {
+		if r, err = h.codec().reader(r); err != nil {
+			file.Close()
+			return nil, 0, false, err
+		}
+	}
+	return &valueReader{r, file}, int64(entry.valueSize), true, nil
+}
@@ -0,0 +1,44 @@
+package caskdb
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_GetReader(t *testing.T) {
+	large := strings.Repeat("all work and no play makes jack a dull boy\n", 100_000)
+	for name, opts := range map[string]Options{"default": {}, "separate values": {SeparateValues: true}} {
+		t.Run(name, func(t *testing.T) {
+			store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), opts)
+			if err != nil {
+				t.Fatalf("failed to create disk store: %v", err)
+			}
+			defer store.Close()
+			store.Set("hamlet", "shakespeare")
+			store.Set("the shining", large)
+			store.Set("dune", "frank herbert")
+
+			r, size, ok, err := store.GetReader("the shining")
+			if err != nil || !ok {
+				t.Fatalf("GetReader() = %v, %v, want true, nil", ok, err)
+			}
+			defer r.Close()
+			if size != int64(len(large)) {
+				t.Errorf("GetReader() size = %v, want %v", size, len(large))
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if string(data) != large {
+				t.Errorf("read %v bytes which differ from the value set", len(data))
+			}
+
+			if _, _, ok, _ := store.GetReader("some key"); ok {
+				t.Errorf("GetReader() ok = true, want false")
+			}
+		})
+	}
+}
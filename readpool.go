@@ -0,0 +1,89 @@
+package caskdb
+
+import "os"
+
+// defaultReadHandles is the number of read only handles on the data file when
+// Options.ReadHandles is not set
+const defaultReadHandles = 1
+
+// readHandles returns the number of read only handles Options.ReadHandles asks
+// for, 0 to read through the append handle
+func (o Options) readHandles() int {
+	if o.ReadHandles == 0 {
+		return defaultReadHandles
+	}
+	return max(o.ReadHandles, 0)
+}
+
+// readPool is a fixed set of read only handles on the data file, which Get
+// borrows so that reads and appends go through handles of their own.
+type readPool struct {
+	files chan *os.File
+}
+
+// openReadPool opens size read only handles on fileName
+func openReadPool(fileName string, size int) (*readPool, error) {
+	p := &readPool{files: make(chan *os.File, size)}
+	for i := 0; i < size; i++ {
+		file, err := os.Open(fileName)
+		if err != nil {
+			p.close()
+			return nil, err
+		}
+		p.files <- file
+	}
+	return p, nil
+}
+
+// get borrows a handle, waiting for one to be returned if all are in use
+func (p *readPool) get() *os.File {
+	return <-p.files
+}
+
+// put returns a handle borrowed with get
+func (p *readPool) put(file *os.File) {
+	p.files <- file
+}
+
+// close closes every handle in the pool. All borrowed handles must have been
+// returned.
+func (p *readPool) close() error {
+	var firstErr error
+	for {
+		select {
+		case file := <-p.files:
+			if err := file.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		default:
+			return firstErr
+		}
+	}
+}
+
+// readAt reads len(buf) bytes of the data file at offset, through a pooled handle
+// unless Options.ReadHandles is negative
+func (d *DiskStore) readAt(buf []byte, offset int64) (int, error) {
+	if d.readers == nil {
+		return d.file.ReadAt(buf, offset)
+	}
+	file := d.readers.get()
+	defer d.readers.put(file)
+	return file.ReadAt(buf, offset)
+}
+
+// reopenReaders replaces the pooled handles with fresh ones, after the data file
+// has been replaced by a compaction. The caller must hold mu exclusively.
+func (d *DiskStore) reopenReaders() error {
+	if d.readers == nil {
+		return nil
+	}
+	d.readers.close()
+	readers, err := openReadPool(d.fileName, d.opts.readHandles())
+	if err != nil {
+		d.readers = nil
+		return err
+	}
+	d.readers = readers
+	return nil
+}
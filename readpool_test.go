@@ -0,0 +1,134 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestDiskStore_ReadHandles(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{ReadHandles: 4})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+	}
+	// the pooled handles must follow the data file when compaction replaces it
+	store.Set("key-0", "value-0")
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				want := fmt.Sprintf("value-%d", i)
+				if val := store.Get(fmt.Sprintf("key-%d", i)); val != want {
+					t.Errorf("Get() = %v, want %v", val, want)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDiskStore_ReadHandlesConcurrentWrites(t *testing.T) {
+	for _, handles := range []int{-1, 0, 2} {
+		fileName := filepath.Join(t.TempDir(), "test.db")
+		store, err := NewDiskStoreWithOptions(fileName, Options{ReadHandles: handles})
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		const goroutines, keys = 4, 100
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(2)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < keys; i++ {
+					store.Set(fmt.Sprintf("key-%d-%d", g, i), fmt.Sprintf("value-%d-%d", g, i))
+				}
+			}(g)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < keys; i++ {
+					want := fmt.Sprintf("value-%d-%d", g, i)
+					if val, ok := store.Lookup(fmt.Sprintf("key-%d-%d", g, i)); ok && val != want {
+						t.Errorf("Lookup() = %v, want %v", val, want)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		// the records were appended back to back, each where the keyStore says
+		info, _ := os.Stat(fileName)
+		pos := uint64(store.dataStart)
+		for it := store.RawRecords(); it.Next(); {
+			record := it.Record()
+			if record.Position != pos {
+				t.Fatalf("record of %q at offset %v, want %v", record.Key, record.Position, pos)
+			}
+			if entry, _ := store.keyStore.Get(record.Key); uint64(entry.position) != pos {
+				t.Errorf("keyStore offset of %q = %v, want %v", record.Key, entry.position, pos)
+			}
+			pos += uint64(record.size)
+		}
+		if pos != uint64(info.Size()) {
+			t.Errorf("records end at %v, want %v", pos, info.Size())
+		}
+		store.Close()
+	}
+}
+
+func TestDiskStore_ReadHandlesClosed(t *testing.T) {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("cannot count open file descriptors:", err)
+	}
+	before := len(fds)
+
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{ReadHandles: 8})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Compact()
+	store.Get("hamlet")
+	store.Close()
+
+	fds, _ = os.ReadDir("/proc/self/fd")
+	if len(fds) != before {
+		t.Errorf("open file descriptors = %v, want %v", len(fds), before)
+	}
+}
+
+func BenchmarkDiskStore_GetParallel(b *testing.B) {
+	for _, handles := range []int{-1, 0, 8} {
+		b.Run(fmt.Sprintf("handles=%d", handles), func(b *testing.B) {
+			store, err := NewDiskStoreWithOptions(filepath.Join(b.TempDir(), "test.db"), Options{ReadHandles: handles})
+			if err != nil {
+				b.Fatalf("failed to create disk store: %v", err)
+			}
+			defer store.Close()
+			for i := 0; i < 1000; i++ {
+				store.Set(fmt.Sprintf("key-%d", i), "value")
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					store.Get(fmt.Sprintf("key-%d", i%1000))
+					i++
+				}
+			})
+		})
+	}
+}
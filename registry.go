@@ -0,0 +1,30 @@
+package caskdb
+
+import "sync"
+
+// openStores holds every DiskStore which has been opened and not closed yet
+var openStores = struct {
+	sync.Mutex
+	stores map[*DiskStore]struct{}
+}{stores: make(map[*DiskStore]struct{})}
+
+func registerStore(d *DiskStore) {
+	openStores.Lock()
+	defer openStores.Unlock()
+	openStores.stores[d] = struct{}{}
+}
+
+func unregisterStore(d *DiskStore) {
+	openStores.Lock()
+	defer openStores.Unlock()
+	delete(openStores.stores, d)
+}
+
+// OpenStoreCount returns how many stores are currently open, that is opened but
+// not closed yet. Test suites can check it to catch stores leaked by a missing
+// Close.
+func OpenStoreCount() int {
+	openStores.Lock()
+	defer openStores.Unlock()
+	return len(openStores.stores)
+}
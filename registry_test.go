@@ -0,0 +1,35 @@
+package caskdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenStoreCount(t *testing.T) {
+	before := OpenStoreCount()
+	dir := t.TempDir()
+	var stores []*DiskStore
+	for i := 0; i < 3; i++ {
+		store, err := NewDiskStore(filepath.Join(dir, fmt.Sprintf("test-%d.db", i)))
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		stores = append(stores, store)
+	}
+	segmented, err := Open(filepath.Join(dir, "segments"), Options{})
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	stores = append(stores, segmented)
+	if count := OpenStoreCount(); count != before+4 {
+		t.Errorf("OpenStoreCount() = %v, want %v", count, before+4)
+	}
+
+	for _, store := range stores {
+		store.Close()
+	}
+	if count := OpenStoreCount(); count != before {
+		t.Errorf("OpenStoreCount() = %v, want %v", count, before)
+	}
+}
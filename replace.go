@@ -0,0 +1,103 @@
+package caskdb
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// ReplaceAll replaces the whole content of the store with pairs: keys not in
+// pairs are gone afterwards. The pairs are written to a new data file which is
+// synced and renamed over the current one, the same way Compact does, so a crash
+// leaves either the old or the new data set on disk. Reads and writes block while
+// the new file is written, so they see either the old or the new data set too,
+// never a mix of both.
+//
+// Every record gets the timestamp a write would get at the time, the current time
+// or, with Options.MonotonicTimestamps, one later than any before. ReplaceAll is
+// not supported in directory mode, where the segments would have to be replaced
+// along with the data file.
+func (d *DiskStore) ReplaceAll(pairs map[string]string) error {
+	if d.dir != "" {
+		return errors.New("caskdb: ReplaceAll is not supported in directory mode")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.deferred {
+		return ErrIndexNotBuilt
+	}
+	tmpName := d.compactTempName(d.fileName)
+	keyStore, err := d.writePairs(tmpName, pairs)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if tmpName, err = d.stageCompacted(tmpName, d.fileName); err != nil {
+		return err
+	}
+	if err := d.installFile(tmpName, keyStore); err != nil {
+		return err
+	}
+	return d.loadValues()
+}
+
+// writePairs writes a record for every pair to a new data file in the current
+// format version, sorted by key, returning the keyStore pointing into it.
+func (d *DiskStore) writePairs(fileName string, pairs map[string]string) (KeyDir, error) {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	w := bufio.NewWriter(file)
+	if _, err := w.Write(encodeFileHeader(formatVersion)); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	keyStore := d.newKeyDir()
+	offset := uint32(fileHeaderSize)
+	h := recordHeader{timestamp: d.timestamp()}
+	for _, key := range keys {
+		value := pairs[key]
+		valueSize := uint32(len(value))
+		key = d.normalizeKey(key)
+		if err := d.checkQuota(key, value); err != nil {
+			return nil, err
+		}
+		h := h
+		if d.opts.Codec != CodecNone {
+			if value, err = d.opts.Codec.encode(value); err != nil {
+				return nil, err
+			}
+			h = h.withCodec(d.opts.Codec)
+		}
+		if size := int64(recordHeaderSize(formatVersion)) + int64(len(key)) + int64(len(value)); size > maxRecordSize {
+			return nil, fmt.Errorf("%w: %d bytes for %q", ErrRecordTooLarge, size, key)
+		}
+		if d.values != nil {
+			if value, err = d.appendValue(value); err != nil {
+				return nil, err
+			}
+		}
+		record := encodeRecord(formatVersion, h, key, value)
+		if _, err := w.Write(record); err != nil {
+			return nil, err
+		}
+		keyStore.Set(key, KeyEntry{h.timestamp, offset, uint32(len(record)), d.segment, 0, valueSize})
+		offset += uint32(len(record))
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	return keyStore, file.Close()
+}
@@ -0,0 +1,112 @@
+package caskdb
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_ReplaceAll(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	oldSet, newSet := make(map[string]string), make(map[string]string)
+	for i := range 100 {
+		oldSet[fmt.Sprintf("book:%03d", i)] = "old"
+	}
+	for i := 50; i < 200; i++ {
+		newSet[fmt.Sprintf("book:%03d", i)] = "new"
+	}
+	for key, value := range oldSet {
+		store.Set(key, value)
+	}
+	sortedKeys := func(pairs map[string]string) []string {
+		var keys []string
+		for key := range pairs {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		return keys
+	}
+	oldKeys, newKeys := sortedKeys(oldSet), sortedKeys(newSet)
+
+	// a reader listing the keys all along only ever sees one of the two sets
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			keys, _, err := store.ScanPage("book:", "", 1000)
+			if err != nil {
+				t.Errorf("ScanPage() error = %v", err)
+				return
+			}
+			if !slices.Equal(keys, oldKeys) && !slices.Equal(keys, newKeys) {
+				t.Errorf("ScanPage() saw %d keys mixing the old and new sets", len(keys))
+				return
+			}
+		}
+	}()
+	for range 5 {
+		if err := store.ReplaceAll(oldSet); err != nil {
+			t.Fatalf("ReplaceAll() error = %v", err)
+		}
+		if err := store.ReplaceAll(newSet); err != nil {
+			t.Fatalf("ReplaceAll() error = %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	check := func(store *DiskStore) {
+		t.Helper()
+		if keys, _, _ := store.ScanPage("", "", 1000); !slices.Equal(keys, newKeys) {
+			t.Errorf("keys = %v, want %v", keys, newKeys)
+		}
+		for key, value := range newSet {
+			if got := store.Get(key); got != value {
+				t.Errorf("Get(%q) = %q, want %q", key, got, value)
+			}
+		}
+		if _, ok := store.Lookup("book:000"); ok {
+			t.Errorf("Lookup() found a key which was not in the new set")
+		}
+	}
+	check(store)
+	store.Close()
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	check(store)
+}
+
+func TestDiskStore_ReplaceAllMonotonicTimestamps(t *testing.T) {
+	now := time.Unix(2000, 0)
+	clock := func() time.Time { return now }
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{Clock: clock, MonotonicTimestamps: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "draft")
+	now = time.Unix(1000, 0)
+	if err := store.ReplaceAll(map[string]string{"hamlet": "shakespeare"}); err != nil {
+		t.Fatalf("ReplaceAll() error = %v", err)
+	}
+	if _, ts, _ := store.GetWithTimestamp("hamlet"); ts.Unix() <= 2000 {
+		t.Errorf("timestamp = %v, want later than %v", ts, 2000)
+	}
+}
@@ -0,0 +1,160 @@
+package caskdb
+
+import "fmt"
+
+// ChangeOp is the kind of write a ChangeEvent describes.
+type ChangeOp int
+
+const (
+	// ChangeSet is a key being set to a value
+	ChangeSet ChangeOp = iota
+	// ChangeDelete is a key being deleted
+	ChangeDelete
+)
+
+// ChangeEvent is a single write read back from the log.
+type ChangeEvent struct {
+	Op        ChangeOp
+	Key       string
+	Value     string
+	Timestamp uint32
+	// Meta is the metadata set by SetWithMeta, 0 if there is none
+	Meta uint32
+	// ExpiresAt is the Unix time the key expires at, 0 if it never expires
+	ExpiresAt uint32
+	// Position is the offset of the record in the data file
+	Position uint64
+}
+
+// ChangeIterator yields the writes recorded in the log, oldest first.
+//
+// Typical usage example, replaying the writes of a primary into a replica:
+//
+//	it, _ := primary.ChangeStream(0)
+//	for it.Next() {
+//		event := it.Event()
+//		...
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//	resumeFrom := it.Offset()
+type ChangeIterator struct {
+	records *RawIterator
+}
+
+// ChangeStream returns an iterator over the writes recorded in the log starting at
+// fromOffset, which must be the start of a record (0 means the beginning of the
+// log). Since the log is the source of truth, this is a natural replication feed:
+// a follower applies the events to its own store, and later resumes the stream
+// from Offset. Compaction drops overwritten records and rewrites the offsets, so a
+// follower which falls behind a compaction has to resync from 0.
+func (d *DiskStore) ChangeStream(fromOffset uint64) (*ChangeIterator, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	pos := max(int64(fromOffset), d.dataStart)
+	records := d.rawRecordsFrom(pos)
+	if records.err != nil {
+		return nil, records.err
+	}
+	if fromOffset != 0 && pos < records.end {
+		if _, err := d.readRecordAt(pos, records.end); err != nil {
+			return nil, fmt.Errorf("change stream: %w", err)
+		}
+	} else if pos > records.end {
+		return nil, fmt.Errorf("change stream: %w: %d", ErrInvalidOffset, fromOffset)
+	}
+	return &ChangeIterator{records: records}, nil
+}
+
+// Apply writes a change event read from another store's ChangeStream, keeping the
+// event's original timestamp rather than the current time, and its expiry, so a
+// key set with a TTL expires on the replica when it does on the primary. An event
+// older than the record the store already holds for the key is ignored, so the
+// newest write wins no matter in which order events arrive, which keeps replicas
+// consistent with the primary. When a set event ties with the stored record, the
+// value to keep is chosen by Options.Resolver; a delete event wins a tie.
+//
+// Only live keys remember their timestamp: once a key is deleted, an older set
+// event arriving late brings it back.
+func (d *DiskStore) Apply(event ChangeEvent) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	event.Key = d.normalizeKey(event.Key)
+	shard := d.lockKey(event.Key)
+	defer shard.Unlock()
+
+	if d.version < 2 {
+		return ErrOldFormat
+	}
+	if d.deferred {
+		return ErrIndexNotBuilt
+	}
+	entry, ok := d.keyStore.Get(event.Key)
+	if ok && entry.timestamp > event.Timestamp {
+		return nil
+	}
+	switch event.Op {
+	case ChangeSet:
+		value := event.Value
+		if ok && entry.timestamp == event.Timestamp {
+			_, existing, _, err := d.getRecord(event.Key)
+			if err != nil {
+				return err
+			}
+			value = d.resolver()(event.Key, existing, event.Value)
+			if value == existing {
+				return nil
+			}
+		}
+		return d.writeRecord(event.Key, value, recordHeader{timestamp: event.Timestamp, meta: event.Meta, expiresAt: event.ExpiresAt})
+	case ChangeDelete:
+		if !ok {
+			return nil
+		}
+		return d.writeRecord(event.Key, "", recordHeader{timestamp: event.Timestamp, flags: flagTombstone})
+	}
+	return fmt.Errorf("caskdb: unknown change op %d", event.Op)
+}
+
+func (d *DiskStore) resolver() func(key, existingVal, incomingVal string) string {
+	if d.opts.Resolver != nil {
+		return d.opts.Resolver
+	}
+	return keepLarger
+}
+
+// Next advances the iterator to the next event, returning false when there are no
+// more events or an error occurred.
+func (it *ChangeIterator) Next() bool {
+	return it.records.Next()
+}
+
+// Event returns the event the iterator is positioned at.
+func (it *ChangeIterator) Event() ChangeEvent {
+	record := it.records.Record()
+	event := ChangeEvent{
+		Op:        ChangeSet,
+		Key:       record.Key,
+		Value:     record.Value,
+		Timestamp: record.Timestamp,
+		Meta:      record.Meta,
+		ExpiresAt: record.ExpiresAt,
+		Position:  record.Position,
+	}
+	if record.Deleted {
+		event.Op = ChangeDelete
+	}
+	return event
+}
+
+// Offset returns the offset of the first record not yet yielded, to resume the
+// stream from with ChangeStream.
+func (it *ChangeIterator) Offset() uint64 {
+	return uint64(it.records.pos)
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *ChangeIterator) Err() error {
+	return it.records.Err()
+}
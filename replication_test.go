@@ -0,0 +1,212 @@
+package caskdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// replicate applies the events of it to replica, returning the offset to resume
+// the stream from
+func replicate(t *testing.T, it *ChangeIterator, replica *DiskStore) uint64 {
+	t.Helper()
+	for it.Next() {
+		event := it.Event()
+		var err error
+		switch event.Op {
+		case ChangeSet:
+			err = replica.Set(event.Key, event.Value)
+		case ChangeDelete:
+			err = replica.Delete(event.Key)
+		}
+		if err != nil {
+			t.Fatalf("applying %+v: %v", event, err)
+		}
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("ChangeStream() error = %v", err)
+	}
+	return it.Offset()
+}
+
+func assertSameContents(t *testing.T, primary, replica *DiskStore) {
+	t.Helper()
+	if primary.keyStore.Len() != replica.keyStore.Len() {
+		t.Errorf("replica has %v keys, want %v", replica.keyStore.Len(), primary.keyStore.Len())
+	}
+	primary.keyStore.Range(func(key string, entry KeyEntry) bool {
+		if val, ok := replica.Lookup(key); !ok || val != primary.Get(key) {
+			t.Errorf("replica Get(%v) = %v, %v, want %v", key, val, ok, primary.Get(key))
+		}
+		return true
+	})
+}
+
+func TestDiskStore_ChangeStream(t *testing.T) {
+	dir := t.TempDir()
+	primary, err := NewDiskStore(filepath.Join(dir, "primary.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer primary.Close()
+	replica, err := NewDiskStore(filepath.Join(dir, "replica.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer replica.Close()
+
+	primary.Set("hamlet", "shakespeare")
+	primary.Set("dune", "herbert")
+	primary.Set("dune", "frank herbert")
+	primary.Set("othello", "shakespeare")
+	primary.Delete("othello")
+
+	it, err := primary.ChangeStream(0)
+	if err != nil {
+		t.Fatalf("ChangeStream() error = %v", err)
+	}
+	offset := replicate(t, it, replica)
+	assertSameContents(t, primary, replica)
+
+	// resume the stream where the replica left off
+	primary.Set("anna karenina", "tolstoy")
+	primary.Delete("hamlet")
+	it, err = primary.ChangeStream(offset)
+	if err != nil {
+		t.Fatalf("ChangeStream() error = %v", err)
+	}
+	events := 0
+	for it.Next() {
+		events++
+	}
+	if events != 2 {
+		t.Errorf("resumed stream yielded %v events, want %v", events, 2)
+	}
+	it, _ = primary.ChangeStream(offset)
+	replicate(t, it, replica)
+	assertSameContents(t, primary, replica)
+
+	if _, err := primary.ChangeStream(offset + 1); !errors.Is(err, ErrInvalidOffset) {
+		t.Errorf("ChangeStream() error = %v, want %v", err, ErrInvalidOffset)
+	}
+}
+
+func TestDiskStore_Apply(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	replica, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	events := []ChangeEvent{
+		{Op: ChangeSet, Key: "dune", Value: "frank herbert", Timestamp: 300},
+		{Op: ChangeSet, Key: "dune", Value: "herbert", Timestamp: 200},
+		{Op: ChangeSet, Key: "hamlet", Value: "shakespeare", Timestamp: 100, Meta: 7},
+		{Op: ChangeDelete, Key: "hamlet", Timestamp: 50},
+		{Op: ChangeSet, Key: "othello", Value: "shakespeare", Timestamp: 100},
+		{Op: ChangeDelete, Key: "othello", Timestamp: 150},
+	}
+	for _, event := range events {
+		if err := replica.Apply(event); err != nil {
+			t.Fatalf("Apply(%+v) error = %v", event, err)
+		}
+	}
+	replica.Close()
+
+	replica, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer replica.Close()
+	if val := replica.Get("dune"); val != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", val, "frank herbert")
+	}
+	if val, meta, ok := replica.GetMeta2("hamlet"); !ok || val != "shakespeare" || meta != 7 {
+		t.Errorf("GetMeta2() = %v, %v, %v, want %v, 7, true", val, meta, ok, "shakespeare")
+	}
+	if _, ok := replica.Lookup("othello"); ok {
+		t.Errorf("Lookup() found a key deleted by a newer event")
+	}
+	if entry, _ := replica.keyStore.Get("dune"); entry.timestamp != 300 {
+		t.Errorf("timestamp = %v, want the original %v", entry.timestamp, 300)
+	}
+}
+
+func TestDiskStore_ApplyResolver(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolver func(key, existingVal, incomingVal string) string
+		want     string
+	}{
+		{"default keeps larger", nil, "shakespeare"},
+		{"keep existing", func(key, existingVal, incomingVal string) string { return existingVal }, "bacon"},
+		{"keep incoming", func(key, existingVal, incomingVal string) string { return incomingVal }, "marlowe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "test.db")
+			store, err := NewDiskStoreWithOptions(fileName, Options{Resolver: tt.resolver})
+			if err != nil {
+				t.Fatalf("failed to create disk store: %v", err)
+			}
+			events := []ChangeEvent{
+				{Op: ChangeSet, Key: "hamlet", Value: "bacon", Timestamp: 100},
+				{Op: ChangeSet, Key: "hamlet", Value: "shakespeare", Timestamp: 100},
+				{Op: ChangeSet, Key: "hamlet", Value: "marlowe", Timestamp: 100},
+			}
+			for _, event := range events {
+				if err := store.Apply(event); err != nil {
+					t.Fatalf("Apply(%+v) error = %v", event, err)
+				}
+			}
+			store.Close()
+
+			store, err = NewDiskStoreWithOptions(fileName, Options{Resolver: tt.resolver})
+			if err != nil {
+				t.Fatalf("failed to open disk store: %v", err)
+			}
+			defer store.Close()
+			if val := store.Get("hamlet"); val != tt.want {
+				t.Errorf("Get() = %v, want %v", val, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiskStore_ApplyExpiry(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Unix(1_000_000, 0)
+	clock := func() time.Time { return now }
+	primary, err := NewDiskStoreWithOptions(filepath.Join(dir, "primary.db"), Options{Clock: clock})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer primary.Close()
+	replica, err := NewDiskStoreWithOptions(filepath.Join(dir, "replica.db"), Options{Clock: clock})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer replica.Close()
+
+	primary.SetWithTTL("hamlet", "shakespeare", time.Hour)
+	it, err := primary.ChangeStream(0)
+	if err != nil {
+		t.Fatalf("ChangeStream() error = %v", err)
+	}
+	for it.Next() {
+		event := it.Event()
+		if want := uint32(now.Add(time.Hour).Unix()); event.ExpiresAt != want {
+			t.Errorf("ExpiresAt = %v, want %v", event.ExpiresAt, want)
+		}
+		if err := replica.Apply(event); err != nil {
+			t.Fatalf("Apply(%+v) error = %v", event, err)
+		}
+	}
+	if val := replica.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+	now = now.Add(2 * time.Hour)
+	if _, ok := replica.Lookup("hamlet"); ok {
+		t.Errorf("Lookup() found a key expired on the primary")
+	}
+}
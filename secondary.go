@@ -0,0 +1,115 @@
+package caskdb
+
+import (
+	"slices"
+	"sync"
+)
+
+// secondaryIndex maps the index keys returned by Options.IndexFunc to the keys
+// whose values produced them
+type secondaryIndex struct {
+	mu   sync.RWMutex
+	keys map[string]map[string]struct{}
+	// indexKeys holds the index key of every indexed key, to find the entry to
+	// remove when the key is overwritten or deleted
+	indexKeys map[string]string
+}
+
+func newSecondaryIndex() *secondaryIndex {
+	return &secondaryIndex{keys: make(map[string]map[string]struct{}), indexKeys: make(map[string]string)}
+}
+
+// update indexes key under the index key of value, or removes it from the index
+// when it was deleted
+func (s *secondaryIndex) update(fn func(key, value string) (string, bool), key, value string, deleted bool) {
+	if s == nil {
+		return
+	}
+	indexKey, ok := "", false
+	if !deleted {
+		indexKey, ok = fn(key, value)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, indexed := s.indexKeys[key]; indexed {
+		delete(s.keys[old], key)
+		if len(s.keys[old]) == 0 {
+			delete(s.keys, old)
+		}
+		delete(s.indexKeys, key)
+	}
+	if !ok {
+		return
+	}
+	if s.keys[indexKey] == nil {
+		s.keys[indexKey] = make(map[string]struct{})
+	}
+	s.keys[indexKey][key] = struct{}{}
+	s.indexKeys[key] = indexKey
+}
+
+func (s *secondaryIndex) lookup(indexKey string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.keys[indexKey]))
+	for key := range s.keys[indexKey] {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// indexValue updates the secondary index, if any, with a write of key
+func (d *DiskStore) indexValue(key, value string, deleted bool) {
+	d.index.update(d.opts.IndexFunc, key, value, deleted)
+}
+
+// loadIndex builds the secondary index of Options.IndexFunc from the value of
+// every key. The caller must hold mu exclusively, or be opening the store.
+func (d *DiskStore) loadIndex() error {
+	if d.opts.IndexFunc == nil {
+		return nil
+	}
+	index := newSecondaryIndex()
+	var err error
+	d.keyStore.Range(func(key string, entry KeyEntry) bool {
+		var value string
+		var ok bool
+		if _, value, ok, err = d.getRecord(key); ok {
+			index.update(d.opts.IndexFunc, key, value, false)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	d.index = index
+	return nil
+}
+
+// loadValues fills everything kept in memory which derives from the values, the
+// cache of Options.CacheAllValues and the secondary index of Options.IndexFunc.
+// The caller must hold mu exclusively, or be opening the store.
+func (d *DiskStore) loadValues() error {
+	if err := d.loadCache(); err != nil {
+		return err
+	}
+	return d.loadIndex()
+}
+
+// LookupByIndex returns the live keys whose values Options.IndexFunc mapped to
+// indexKey, in sorted order. It only looks at the index in memory; it reports
+// nothing without an IndexFunc.
+func (d *DiskStore) LookupByIndex(indexKey string) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.index == nil {
+		return nil
+	}
+	now := d.now().Unix()
+	keys := slices.DeleteFunc(d.index.lookup(indexKey), func(key string) bool {
+		entry, ok := d.keyStore.Get(key)
+		return !ok || entry.expired(now)
+	})
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,65 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_LookupByIndex(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	// values are "author|title", indexed by author
+	opts := Options{IndexFunc: func(key, value string) (string, bool) {
+		author, _, ok := strings.Cut(value, "|")
+		return author, ok
+	}}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("1", "shakespeare|hamlet")
+	store.Set("2", "shakespeare|othello")
+	store.Set("3", "tolstoy|anna karenina")
+	store.Set("4", "bacon|hamlet")
+	store.Set("5", "no author")
+	// a new value moves the key to another index key
+	store.Set("4", "shakespeare|macbeth")
+	store.Set("3", "tolstoy|war and peace")
+	store.Delete("2")
+	store.DeleteMulti([]string{"5"})
+
+	check := func(store *DiskStore) {
+		t.Helper()
+		for indexKey, want := range map[string][]string{
+			"shakespeare": {"1", "4"},
+			"tolstoy":     {"3"},
+			"bacon":       {},
+			"no author":   {},
+		} {
+			if got := store.LookupByIndex(indexKey); !slices.Equal(got, want) {
+				t.Errorf("LookupByIndex(%q) = %v, want %v", indexKey, got, want)
+			}
+		}
+	}
+	check(store)
+	store.Close()
+
+	// the index is rebuilt from the values on open
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	check(store)
+
+	plain, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer plain.Close()
+	plain.Set("1", "shakespeare|hamlet")
+	if got := plain.LookupByIndex("shakespeare"); got != nil {
+		t.Errorf("LookupByIndex() without IndexFunc = %v, want nil", got)
+	}
+}
@@ -0,0 +1,399 @@
+package caskdb
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A store opened with Open keeps its records in a directory of segment files, like
+// the original BitCask. Segments are named after their id, which grows with every
+// new segment:
+//
+//	books/
+//	├── 000001.cask       read-only segment
+//	├── 000002.cask       read-only segment
+//	├── 000003.cask       active segment, where new records are appended
+//	└── 000003.cask.hint  hint of the active segment
+//
+// Every segment is a regular data file, with its own file header. Records in newer
+// segments win over older ones. The hint file of the active segment holds the
+// whole keyStore, the location in older segments included, so that a store which
+// was closed cleanly opens from the hint alone.
+//
+// Rotate seals the active segment and starts a new one. Compaction merges all
+// segments into a new one, and removes the old ones.
+
+const segmentExt = ".cask"
+
+// segment is a read-only segment file
+type segment struct {
+	fileName  string
+	dataStart int64
+	version   uint32
+	size      int64
+
+	// file is the handle on the segment, nil while the segment is not in the
+	// open segments LRU. refs counts the readers using it, which keep it from
+	// being evicted. Both are guarded by segmentLRU.mu.
+	file *os.File
+	refs int
+	elem *list.Element
+}
+
+// segmentLRU keeps the handles on the most recently read segments open, see
+// Options.MaxOpenSegments
+type segmentLRU struct {
+	mu sync.Mutex
+	// open holds the segments with an open handle, most recently used first
+	open list.List
+}
+
+func segmentFileName(dir string, id uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", id, segmentExt))
+}
+
+// listSegments returns the ids of the segment files in dir, in ascending order
+func listSegments(dir string) ([]uint32, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint32
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), segmentExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		id, err := strconv.ParseUint(name, 10, 32)
+		if err != nil || id == 0 {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// openSegment reads the file header of a read-only segment file, validating it.
+// The file is left closed until the segment is first read.
+func openSegment(fileName string, legacy bool) (*segment, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	dataStart, version, err := readFileHeader(file, legacy)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	return &segment{fileName: fileName, dataStart: dataStart, version: version, size: info.Size()}, nil
+}
+
+// acquireSegment returns an open handle on seg, opening it if needed. The caller
+// must call releaseSegment once done with it.
+//
+// At most Options.MaxOpenSegments handles are kept open: opening one more closes
+// the least recently used handle which no reader is using.
+func (d *DiskStore) acquireSegment(seg *segment) (*os.File, error) {
+	d.segmentLRU.mu.Lock()
+	defer d.segmentLRU.mu.Unlock()
+	if seg.file == nil {
+		file, err := os.Open(seg.fileName)
+		if err != nil {
+			return nil, err
+		}
+		seg.file = file
+		seg.elem = d.segmentLRU.open.PushFront(seg)
+	} else {
+		d.segmentLRU.open.MoveToFront(seg.elem)
+	}
+	seg.refs++
+	d.evictSegments()
+	return seg.file, nil
+}
+
+// releaseSegment marks the handle returned by acquireSegment as no longer used
+func (d *DiskStore) releaseSegment(seg *segment) {
+	d.segmentLRU.mu.Lock()
+	defer d.segmentLRU.mu.Unlock()
+	seg.refs--
+	d.evictSegments()
+}
+
+// evictSegments closes the least recently used handles until no more than
+// Options.MaxOpenSegments are open, skipping the ones in use. The caller must hold
+// segmentLRU.mu.
+func (d *DiskStore) evictSegments() {
+	limit := d.opts.MaxOpenSegments
+	if limit <= 0 {
+		return
+	}
+	for elem := d.segmentLRU.open.Back(); elem != nil && d.segmentLRU.open.Len() > limit; {
+		seg := elem.Value.(*segment)
+		elem = elem.Prev()
+		if seg.refs == 0 {
+			d.closeSegment(seg)
+		}
+	}
+}
+
+// closeSegment closes the handle on seg. The caller must hold segmentLRU.mu.
+func (d *DiskStore) closeSegment(seg *segment) error {
+	d.segmentLRU.open.Remove(seg.elem)
+	err := seg.file.Close()
+	seg.file, seg.elem = nil, nil
+	return err
+}
+
+// Open opens the store kept in the directory dir, creating the directory if
+// needed. The newest segment file in it becomes the active file, which new records
+// are appended to, while all older segments are only read from. An empty
+// directory starts out with a single segment. Use NewDiskStore to keep a store in
+// a single file instead.
+//
+// RawRecords, ChangeStream and GetAt only see the active segment. SeparateValues is
+// not supported.
+func Open(dir string, opts Options) (*DiskStore, error) {
+	if opts.SeparateValues {
+		return nil, errors.New("caskdb: Options.SeparateValues is not supported by Open")
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	ids, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		ids = []uint32{1}
+	}
+	active := ids[len(ids)-1]
+	ds := &DiskStore{
+		fileName: segmentFileName(dir, active),
+		opts:     opts,
+		dir:      dir,
+		segment:  active,
+		segments: make(map[uint32]*segment),
+	}
+	for _, id := range ids[:len(ids)-1] {
+		seg, err := openSegment(segmentFileName(dir, id), opts.LegacyFormat)
+		if err != nil {
+			ds.closeSegments()
+			return nil, err
+		}
+		ds.segments[id] = seg
+	}
+	store, _, err := openDiskStore(context.Background(), ds)
+	if err != nil {
+		ds.closeSegments()
+		return nil, err
+	}
+	return store, nil
+}
+
+// segmentIDs returns the ids of the read-only segments, oldest first
+func (d *DiskStore) segmentIDs() []uint32 {
+	return slices.Sorted(maps.Keys(d.segments))
+}
+
+// loadSegments reads the records of the read-only segments into the keyStore,
+// oldest first, counting them in result.
+func (d *DiskStore) loadSegments(ctx context.Context, result *OpenResult) error {
+	for _, id := range d.segmentIDs() {
+		seg := d.segments[id]
+		file, err := d.acquireSegment(seg)
+		if err != nil {
+			return err
+		}
+		var loaded OpenResult
+		err = d.scanRecords(ctx, file, id, seg.version, seg.dataStart, seg.size, &loaded)
+		d.releaseSegment(seg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", seg.fileName, err)
+		}
+		// only the active file is ever written to, so only it can be torn
+		if loaded.Recovered > 0 {
+			return fmt.Errorf("%s: torn record at offset %d", seg.fileName, loaded.RecoveryOffset)
+		}
+		result.Loaded += loaded.Loaded
+	}
+	return nil
+}
+
+// closeSegments closes the open handles on the read-only segments, returning the
+// first error
+func (d *DiskStore) closeSegments() error {
+	d.segmentLRU.mu.Lock()
+	defer d.segmentLRU.mu.Unlock()
+	var firstErr error
+	for _, seg := range d.segments {
+		if seg.file == nil {
+			continue
+		}
+		if err := d.closeSegment(seg); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// readEntry reads the record entry points at into buf, which must be as long as
+// the record, returning the number of bytes read and the format version of the
+// segment holding it.
+func (d *DiskStore) readEntry(buf []byte, entry KeyEntry) (int, uint32, error) {
+	if entry.segment == d.segment {
+		n, err := d.readAt(buf, int64(entry.position))
+		return n, d.version, err
+	}
+	seg, ok := d.segments[entry.segment]
+	if !ok {
+		return 0, 0, fmt.Errorf("%w: no segment %d", ErrIndexCorrupt, entry.segment)
+	}
+	file, err := d.acquireSegment(seg)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer d.releaseSegment(seg)
+	n, err := file.ReadAt(buf, int64(entry.position))
+	return n, seg.version, err
+}
+
+// compactSegments merges all segments into a new active segment, removing the old
+// ones, and keeping keepVersions versions of every key. The caller must hold mu
+// exclusively.
+//
+// Merging drops deleted keys altogether, so once the new segment is in place the
+// old ones must not be scanned again, or they would bring deleted keys back. This
+// is why the hint of the new segment is written before the segment is renamed into
+// place: opening the store then only reads the new segment, even if a crash leaves
+// some of the old segments behind.
+func (d *DiskStore) compactSegments(keepVersions int) error {
+	id := d.segment + 1
+	fileName := segmentFileName(d.dir, id)
+	tmpName := d.compactTempName(fileName)
+	keyStore, err := d.writeCompacted(tmpName, id, 0, keepVersions)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if tmpName, err = d.stageCompacted(tmpName, fileName); err != nil {
+		return err
+	}
+	// the handle stays valid across the rename, so nothing can fail once the new
+	// segment is in place
+	file, err := os.OpenFile(tmpName, os.O_RDWR|d.opts.appendFlag(), 0666)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		err = writeHintFile(hintFileName(fileName), encodeHint(hintHeader{dataSize: info.Size(), lastTimestamp: d.lastTimestamp.Load()}, keyStore))
+	}
+	if err == nil {
+		err = os.Rename(tmpName, fileName)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpName)
+		os.Remove(hintFileName(fileName))
+		return err
+	}
+
+	d.file.Close()
+	d.closeSegments()
+	for _, seg := range d.segments {
+		os.Remove(seg.fileName)
+	}
+	os.Remove(d.fileName)
+	os.Remove(hintFileName(d.fileName))
+
+	d.file, d.writer = file, file
+	d.fileName = fileName
+	d.segment = id
+	d.segments = make(map[uint32]*segment)
+	d.keyStore = keyStore
+	d.deadRecords.Store(0)
+	d.usedBytes.Store(-1)
+	d.dataStart = fileHeaderSize
+	d.version = formatVersion
+	if err := syncDir(d.dir); err != nil {
+		return err
+	}
+	if err := d.reopenReaders(); err != nil {
+		return err
+	}
+	if d.opts.PreallocateBytes > 0 {
+		return preallocate(d.file, d.opts.PreallocateBytes)
+	}
+	return nil
+}
+
+// Rotate seals the active segment of a store opened with Open, which becomes
+// read-only, and starts appending to a new, empty segment. Keeping segments small
+// makes them easier to back up incrementally, as sealed segments never change
+// until they are compacted away. Writes block while the new segment is created.
+func (d *DiskStore) Rotate() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dir == "" {
+		return errors.New("caskdb: Rotate requires a store opened with Open")
+	}
+	if d.deferred {
+		return ErrIndexNotBuilt
+	}
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+	info, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	id := d.segment + 1
+	fileName := segmentFileName(d.dir, id)
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_EXCL|d.opts.appendFlag(), 0666)
+	if err != nil {
+		return err
+	}
+	if err := d.appendHeader(file); err != nil {
+		file.Close()
+		os.Remove(fileName)
+		return err
+	}
+	if err := syncDir(d.dir); err != nil {
+		file.Close()
+		os.Remove(fileName)
+		return err
+	}
+
+	d.file.Close()
+	// the hint of the sealed segment is stale now, the next hint is written for
+	// the new segment and covers the sealed one
+	os.Remove(hintFileName(d.fileName))
+	d.segments[d.segment] = &segment{fileName: d.fileName, dataStart: d.dataStart, version: d.version, size: info.Size()}
+	d.file, d.writer = file, file
+	d.fileName = fileName
+	d.segment = id
+	d.dataStart = fileHeaderSize
+	d.version = formatVersion
+	if err := d.reopenReaders(); err != nil {
+		return err
+	}
+	if d.opts.PreallocateBytes > 0 {
+		return preallocate(d.file, d.opts.PreallocateBytes)
+	}
+	return nil
+}
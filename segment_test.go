@@ -0,0 +1,197 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writeSegment writes a segment file holding the given records, where a nil value
+// is a tombstone
+func writeSegment(t *testing.T, dir string, id uint32, records [][2]*string) {
+	t.Helper()
+	data := encodeFileHeader(formatVersion)
+	for _, r := range records {
+		var h recordHeader
+		value := ""
+		if r[1] == nil {
+			h.flags = flagTombstone
+		} else {
+			value = *r[1]
+		}
+		data = append(data, encodeRecord(formatVersion, h, *r[0], value)...)
+	}
+	if err := os.WriteFile(segmentFileName(dir, id), data, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setRecord(key, value string) [2]*string { return [2]*string{&key, &value} }
+func deleteRecord(key string) [2]*string     { return [2]*string{&key, nil} }
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	for i := range matches {
+		matches[i] = filepath.Base(matches[i])
+	}
+	return matches
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	writeSegment(t, dir, 1, [][2]*string{setRecord("hamlet", "bacon"), setRecord("dune", "frank herbert"), setRecord("othello", "shakespeare")})
+	writeSegment(t, dir, 2, [][2]*string{setRecord("hamlet", "shakespeare"), deleteRecord("othello")})
+	writeSegment(t, dir, 3, [][2]*string{setRecord("anna karenina", "tolstoy")})
+
+	want := map[string]string{
+		"hamlet":        "shakespeare",
+		"dune":          "frank herbert",
+		"anna karenina": "tolstoy",
+		"crime":         "dostoevsky",
+	}
+	check := func(store *DiskStore) {
+		t.Helper()
+		for key, val := range want {
+			if got := store.Get(key); got != val {
+				t.Errorf("Get(%v) = %v, want %v", key, got, val)
+			}
+		}
+		if _, ok := store.Lookup("othello"); ok {
+			t.Errorf("Lookup() found a key deleted in a later segment")
+		}
+	}
+
+	before, _ := os.Stat(segmentFileName(dir, 2))
+	store, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	if err := store.Set("crime", "dostoevsky"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	check(store)
+	// older segments are read-only, new records go to the newest segment
+	if after, _ := os.Stat(segmentFileName(dir, 2)); after.Size() != before.Size() {
+		t.Errorf("read-only segment size = %v, want %v", after.Size(), before.Size())
+	}
+	store.Close()
+
+	// a clean Close leaves a hint covering all segments
+	store, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	check(store)
+	// an in-place shrink would drop tombstones of keys with records in older
+	// segments
+	if err := store.Shrink(); err == nil {
+		t.Errorf("Shrink() error = nil, want it refused by a store opened with Open")
+	}
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if files := segmentFiles(t, dir); !slices.Equal(files, []string{"000004.cask"}) {
+		t.Errorf("segment files = %v, want the segments merged into one", files)
+	}
+	check(store)
+	store.Close()
+
+	store, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	check(store)
+}
+
+func TestOpenEmptyDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "books")
+	store, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+	if files := segmentFiles(t, dir); !slices.Equal(files, []string{"000001.cask"}) {
+		t.Errorf("segment files = %v, want one new segment", files)
+	}
+
+	// without the hint, the segments are scanned
+	os.Remove(hintFileName(segmentFileName(dir, 1)))
+	store, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	if val := store.Get("hamlet"); val != "shakespeare" {
+		t.Errorf("Get() = %v, want %v", val, "shakespeare")
+	}
+}
+
+func TestOpenMaxOpenSegments(t *testing.T) {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("cannot count open file descriptors:", err)
+	}
+	before := len(fds)
+
+	dir := t.TempDir()
+	const segments, limit = 8, 2
+	for id := uint32(1); id <= segments; id++ {
+		writeSegment(t, dir, id, [][2]*string{setRecord(fmt.Sprintf("key-%d", id), fmt.Sprintf("value-%d", id))})
+	}
+	store, err := Open(dir, Options{MaxOpenSegments: limit})
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	for round := 0; round < 2; round++ {
+		for id := 1; id <= segments; id++ {
+			want := fmt.Sprintf("value-%d", id)
+			if val := store.Get(fmt.Sprintf("key-%d", id)); val != want {
+				t.Errorf("Get() = %v, want %v", val, want)
+			}
+			fds, _ := os.ReadDir("/proc/self/fd")
+			// the active segment and its read handle are always open on top of the limit
+			if open := len(fds) - before; open > limit+2 {
+				t.Fatalf("open file descriptors = %v, want at most %v", open, limit+2)
+			}
+		}
+	}
+	store.Close()
+	if fds, _ := os.ReadDir("/proc/self/fd"); len(fds) != before {
+		t.Errorf("open file descriptors = %v after Close, want %v", len(fds), before)
+	}
+}
+
+func TestOpenCompactMonotonicTimestamps(t *testing.T) {
+	dir := t.TempDir()
+	writeSegment(t, dir, 1, [][2]*string{setRecord("hamlet", "bacon")})
+	now := time.Unix(2000, 0)
+	clock := func() time.Time { return now }
+	store, err := Open(dir, Options{Clock: clock, MonotonicTimestamps: true})
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	// the hint of the merged segment carries the latest timestamp over a crash
+	crash(t, store)
+
+	now = time.Unix(1000, 0)
+	store, err = Open(dir, Options{Clock: clock, MonotonicTimestamps: true})
+	if err != nil {
+		t.Fatalf("failed to open store: %v", err)
+	}
+	defer store.Close()
+	store.Set("dune", "frank herbert")
+	if _, ts, _ := store.GetWithTimestamp("dune"); ts.Unix() <= 2000 {
+		t.Errorf("timestamp = %v, want later than %v", ts, 2000)
+	}
+}
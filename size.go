@@ -0,0 +1,58 @@
+package caskdb
+
+import (
+	"io"
+	"strings"
+)
+
+// ValueSize returns the length of the value of key, also reporting whether the key
+// exists. The length is kept in the keyStore, so no disk read is needed, which
+// makes it cheap to check before deciding whether to stream a value with
+// GetReader. Values compressed by a Codec report their length once decompressed,
+// the length Get returns.
+func (d *DiskStore) ValueSize(key string) (int, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.deferred {
+		return 0, false
+	}
+	key = d.normalizeKey(key)
+	entry, ok := d.keyStore.Get(key)
+	if !ok || entry.expired(d.now().Unix()) {
+		return 0, false
+	}
+	return int(entry.valueSize), true
+}
+
+// valueLength returns the length of the value of a record with header h once
+// decompressed, value being the value as stored in the record, without its
+// expiry time
+func valueLength(h recordHeader, value string) (uint32, error) {
+	if h.codec() == CodecNone {
+		return uint32(len(value)), nil
+	}
+	r, err := h.codec().reader(strings.NewReader(value))
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(io.Discard, r)
+	return uint32(n), err
+}
+
+// rawValueSize is valueLength for the records of the store, whose value is the
+// location of the value in the values file with Options.SeparateValues. Only a
+// compressed value has to be read from the values file.
+func (d *DiskStore) rawValueSize(h recordHeader, value string) (uint32, error) {
+	if d.values == nil {
+		return valueLength(h, value)
+	}
+	_, size, _, err := decodeValueLocation(value)
+	if err != nil || h.codec() == CodecNone {
+		return size, err
+	}
+	stored, err := d.resolveValue(value)
+	if err != nil {
+		return 0, err
+	}
+	return valueLength(h, stored)
+}
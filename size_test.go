@@ -0,0 +1,57 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_ValueSize(t *testing.T) {
+	for _, opts := range []Options{{}, {SeparateValues: true}, {Codec: CodecFlate}, {SeparateValues: true, Codec: CodecFlate}} {
+		fileName := filepath.Join(t.TempDir(), "test.db")
+		store, err := NewDiskStoreWithOptions(fileName, opts)
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		tests := map[string]string{
+			"crime and punishment": "dostoevsky",
+			"anna karenina":        "tolstoy",
+			"empty":                "",
+			"dune":                 strings.Repeat("spice", 1000),
+		}
+		for key, val := range tests {
+			store.Set(key, val)
+		}
+		tests["hamlet"] = "shakespeare"
+		store.SetWithTTL("hamlet", "shakespeare", time.Hour)
+		check := func(when string) {
+			t.Helper()
+			for key, val := range tests {
+				if size, ok := store.ValueSize(key); !ok || size != len(val) {
+					t.Errorf("%+v %s: ValueSize(%v) = %v, %v, want %v, true", opts, when, key, size, ok, len(val))
+				}
+			}
+			if size, ok := store.ValueSize("othello"); ok {
+				t.Errorf("%+v %s: ValueSize() = %v, %v for an absent key", opts, when, size, ok)
+			}
+		}
+		check("after writing")
+		if err := store.Compact(); err != nil {
+			t.Fatalf("Compact() error = %v", err)
+		}
+		check("after compacting")
+		store.Close()
+
+		// the sizes are loaded from the hint, and from the records without one
+		for _, when := range []string{"with a hint", "without a hint"} {
+			if store, err = NewDiskStoreWithOptions(fileName, opts); err != nil {
+				t.Fatalf("failed to open disk store: %v", err)
+			}
+			check(when)
+			crash(t, store)
+			os.Remove(hintFileName(fileName))
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package caskdb
+
+// Stats describes how the data file is used. Every overwritten record stays in the
+// file until compaction, so the data file is usually larger than the live data.
+type Stats struct {
+	// Keys is the number of live keys.
+	Keys int
+	// TotalBytes is the size of the data file, including its file header.
+	TotalBytes int64
+	// LiveBytes is the size of the records holding the latest value of each key.
+	LiveBytes int64
+	// DeadBytes is the size of the records which have been overwritten and can be
+	// reclaimed by compaction.
+	DeadBytes int64
+	// DeadRecords is the number of overwritten records and tombstones, counted
+	// since the last compaction by the writes and the scan on open. The hint
+	// file keeps the count of the records it covers, so it carries over across
+	// a clean Close; hint files written by older releases start it from 0.
+	DeadRecords int64
+	// Compacting reports whether a compaction was running when Stats was
+	// called. Stats waits for it to finish, so the other fields describe the
+	// compacted file.
+	Compacting bool
+}
+
+// DeadRatio returns the fraction of the data file taken by dead records.
+func (s Stats) DeadRatio() float64 {
+	if s.TotalBytes == 0 {
+		return 0
+	}
+	return float64(s.DeadBytes) / float64(s.TotalBytes)
+}
+
+// Stats returns the usage statistics of the store. It only looks at the keyStore
+// and the file size, so it never reads the data file.
+func (d *DiskStore) Stats() (Stats, error) {
+	compacting := d.compacting.Load()
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.deferred {
+		return Stats{}, ErrIndexNotBuilt
+	}
+	info, err := d.file.Stat()
+	if err != nil {
+		return Stats{}, err
+	}
+	stats := Stats{Keys: d.keyStore.Len(), TotalBytes: info.Size(), Compacting: compacting, DeadRecords: d.deadRecords.Load()}
+	headers := d.dataStart
+	for _, seg := range d.segments {
+		stats.TotalBytes += seg.size
+		headers += seg.dataStart
+	}
+	d.keyStore.Range(func(key string, entry KeyEntry) bool {
+		stats.LiveBytes += int64(entry.totalSize)
+		return true
+	})
+	stats.DeadBytes = stats.TotalBytes - headers - stats.LiveBytes
+	return stats, nil
+}
+
+// HealthReport is a summary of the state of the store, cheap enough to be polled by
+// a health check.
+type HealthReport struct {
+	// LiveKeys is the number of live keys.
+	LiveKeys int
+	// DeadRatio is the fraction of the data file taken by dead records.
+	DeadRatio float64
+	// CleanShutdown reports whether the store was closed properly the last time
+	// it was used. It is false when records had to be recovered on open, or when
+	// records were written after the last hint file.
+	CleanShutdown bool
+	// Compacting reports whether a compaction is currently running.
+	Compacting bool
+	// Err is set when the state of the store could not be read.
+	Err error
+}
+
+// Health reports the state of the store without scanning the data file.
+func (d *DiskStore) Health() HealthReport {
+	d.mu.RLock()
+	report := HealthReport{
+		LiveKeys:      d.keyStore.Len(),
+		CleanShutdown: d.cleanShutdown,
+		Compacting:    d.compacting.Load(),
+	}
+	d.mu.RUnlock()
+	stats, err := d.Stats()
+	if err != nil {
+		report.Err = err
+		return report
+	}
+	report.DeadRatio = stats.DeadRatio()
+	return report
+}
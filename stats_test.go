@@ -0,0 +1,102 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_Stats(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	store.Set("othello", "william shakespeare")
+	store.Set("dune", "frank herbert")
+
+	stats, err := store.Stats()
+	if err != nil {
+		t.Fatalf("Stats() error = %v", err)
+	}
+	oldSize, _ := encodeKV(0, "othello", "shakespeare")
+	liveSize := headerSize*2 + len("othello") + len("william shakespeare") + len("dune") + len("frank herbert")
+	if stats.Keys != 2 {
+		t.Errorf("Keys = %v, want %v", stats.Keys, 2)
+	}
+	if stats.TotalBytes != int64(fileHeaderSize+oldSize+liveSize) {
+		t.Errorf("TotalBytes = %v, want %v", stats.TotalBytes, fileHeaderSize+oldSize+liveSize)
+	}
+	if stats.LiveBytes != int64(liveSize) {
+		t.Errorf("LiveBytes = %v, want %v", stats.LiveBytes, liveSize)
+	}
+	if stats.DeadBytes != int64(oldSize) {
+		t.Errorf("DeadBytes = %v, want %v", stats.DeadBytes, oldSize)
+	}
+}
+
+func TestDiskStore_Health(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("othello", "shakespeare")
+	store.Set("othello", "william shakespeare")
+	report := store.Health()
+	if !report.CleanShutdown {
+		t.Errorf("CleanShutdown = false, want true for a new store")
+	}
+	if report.LiveKeys != 1 {
+		t.Errorf("LiveKeys = %v, want %v", report.LiveKeys, 1)
+	}
+	if report.DeadRatio <= 0 || report.DeadRatio >= 1 {
+		t.Errorf("DeadRatio = %v, want between 0 and 1", report.DeadRatio)
+	}
+	store.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	if report := store.Health(); !report.CleanShutdown {
+		t.Errorf("CleanShutdown = false, want true after Close")
+	}
+	// crash halfway through writing a record
+	crash(t, store)
+	_, torn := encodeKV(0, "dune", "frank herbert")
+	file, _ := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0666)
+	file.Write(torn[:5])
+	file.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	report = store.Health()
+	if report.CleanShutdown {
+		t.Errorf("CleanShutdown = true, want false after recovery")
+	}
+	if report.Compacting {
+		t.Errorf("Compacting = true, want false")
+	}
+
+	// polling while compaction swaps the keyStore, for the race detector
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			store.Compact()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			store.Health()
+		}
+	}
+}
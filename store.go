@@ -2,6 +2,6 @@ package caskdb
 
 type Store interface {
 	Get(key string) string
-	Set(key string, value string)
+	Set(key string, value string) error
 	Close() bool
 }
@@ -0,0 +1,183 @@
+package caskdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// StreamRecords writes the live records of the store to w in the format of the
+// data file, file header included, copying them as they are on disk rather than
+// decoding and encoding them again: the stream is a compacted copy of the store,
+// for RestoreRecords to turn back into a data file, which makes for a faster
+// backup than Dump. Only records in an older format version are re-encoded, and
+// expired keys are left out. Writes carry on while streaming, and may or may not
+// make it into the stream; compactions wait for it to finish.
+//
+// StreamRecords is not supported with Options.SeparateValues, whose records do
+// not hold their values.
+func (d *DiskStore) StreamRecords(w io.Writer) error {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.deferred {
+		return ErrIndexNotBuilt
+	}
+	if d.values != nil {
+		return errors.New("caskdb: StreamRecords is not supported with Options.SeparateValues")
+	}
+	type liveRecord struct {
+		key   string
+		entry KeyEntry
+	}
+	var records []liveRecord
+	now := d.now().Unix()
+	d.keyStore.Range(func(key string, entry KeyEntry) bool {
+		if !entry.expired(now) {
+			records = append(records, liveRecord{key, entry})
+		}
+		return true
+	})
+	// in the order of the files, so that they are read sequentially
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i].entry, records[j].entry
+		if a.segment != b.segment {
+			return a.segment < b.segment
+		}
+		return a.position < b.position
+	})
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(encodeFileHeader(formatVersion)); err != nil {
+		return err
+	}
+	var buf []byte
+	for _, record := range records {
+		if cap(buf) < int(record.entry.totalSize) {
+			buf = make([]byte, record.entry.totalSize)
+		}
+		data := buf[:record.entry.totalSize]
+		version, err := d.readKeyRecord(record.key, record.entry, data)
+		if err != nil {
+			return err
+		}
+		if version != formatVersion {
+			h, key, value := decodeRecord(version, data)
+			data = encodeRecord(formatVersion, h, key, value)
+		}
+		if _, err := bw.Write(data); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// RestoreRecords writes the records streamed by StreamRecords from r to a new data
+// file at path, along with a hint file so that opening it does not have to scan
+// it. Records are checked against their checksums but otherwise copied as they
+// are. The data file is written next to path and linked to it once complete,
+// so a failed restore leaves nothing behind; path must not exist yet, and is never
+// replaced even if it appears while restoring.
+func RestoreRecords(path string, r io.Reader) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("caskdb: cannot restore to %s: %w", path, os.ErrExist)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	tmpName := compactFileName(path)
+	header, keyStore, err := restoreRecords(tmpName, r)
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	// unlike a rename, a link fails rather than replace a file created at path
+	// since it was checked for
+	err = os.Link(tmpName, path)
+	os.Remove(tmpName)
+	if os.IsExist(err) {
+		return fmt.Errorf("caskdb: cannot restore to %s: %w", path, os.ErrExist)
+	}
+	if err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return writeHintFile(hintFileName(path), encodeHint(header, keyStore))
+}
+
+// restoreRecords writes the stream of records r to the data file fileName,
+// returning the header of its hint and the keyStore pointing into it
+func restoreRecords(fileName string, r io.Reader) (hintHeader, KeyDir, error) {
+	br := bufio.NewReader(r)
+	fileHeader := make([]byte, fileHeaderSize)
+	if _, err := io.ReadFull(br, fileHeader); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return hintHeader{}, nil, ErrNotACaskDB
+		}
+		return hintHeader{}, nil, err
+	}
+	if version, ok := decodeFileHeader(fileHeader); !ok {
+		return hintHeader{}, nil, ErrNotACaskDB
+	} else if version != formatVersion {
+		return hintHeader{}, nil, fmt.Errorf("%w: unsupported format version %d", ErrNotACaskDB, version)
+	}
+
+	dst, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return hintHeader{}, nil, err
+	}
+	defer dst.Close()
+	w := bufio.NewWriter(dst)
+	if _, err := w.Write(fileHeader); err != nil {
+		return hintHeader{}, nil, err
+	}
+	keyStore := NewMapKeyDir()
+	pos := int64(fileHeaderSize)
+	var lastTimestamp uint32
+	var buf []byte
+	for {
+		h, record, err := readRecord(br, formatVersion, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return hintHeader{}, nil, migrateReadError(err, pos)
+		}
+		buf = record
+		size := int64(len(record))
+		if !verifyRecord(formatVersion, record) {
+			return hintHeader{}, nil, fmt.Errorf("%w: checksum mismatch at offset %d", ErrCorruptRecord, pos)
+		}
+		if _, err := w.Write(record); err != nil {
+			return hintHeader{}, nil, err
+		}
+		lastTimestamp = max(lastTimestamp, h.timestamp)
+		key := string(record[headerSize : headerSize+h.keySize])
+		if h.isTombstone() {
+			keyStore.Delete(key)
+		} else {
+			value := record[headerSize+h.keySize:]
+			if h.flags&flagExpires != 0 && len(value) >= expirySize {
+				h.expiresAt = binary.LittleEndian.Uint32(value[:expirySize])
+				value = value[expirySize:]
+			}
+			valueSize, err := valueLength(h, string(value))
+			if err != nil {
+				return hintHeader{}, nil, fmt.Errorf("%w: value at offset %d does not decompress: %v", ErrCorruptRecord, pos, err)
+			}
+			keyStore.Set(key, KeyEntry{h.timestamp, uint32(pos), uint32(size), 0, h.expiresAt, valueSize})
+		}
+		pos += size
+	}
+	if err := w.Flush(); err != nil {
+		return hintHeader{}, nil, err
+	}
+	if err := dst.Sync(); err != nil {
+		return hintHeader{}, nil, err
+	}
+	return hintHeader{dataSize: pos, lastTimestamp: lastTimestamp}, keyStore, dst.Close()
+}
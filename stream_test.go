@@ -0,0 +1,111 @@
+package caskdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStreamRecords(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprintf("key-%d", i%20), fmt.Sprint(i))
+	}
+	store.Delete("key-0")
+	store.SetWithMeta("hamlet", "shakespeare", 7)
+	store.SetWithTTL("dune", "frank herbert", time.Hour)
+
+	var stream bytes.Buffer
+	if err := store.StreamRecords(&stream); err != nil {
+		t.Fatalf("StreamRecords() error = %v", err)
+	}
+	info, _ := os.Stat(filepath.Join(dir, "test.db"))
+	if int64(stream.Len()) >= info.Size() {
+		t.Errorf("stream is %d bytes, want less than the %d of the data file", stream.Len(), info.Size())
+	}
+	restored := filepath.Join(dir, "restored.db")
+	if err := RestoreRecords(restored, bytes.NewReader(stream.Bytes())); err != nil {
+		t.Fatalf("RestoreRecords() error = %v", err)
+	}
+	if err := RestoreRecords(restored, bytes.NewReader(stream.Bytes())); !errors.Is(err, os.ErrExist) {
+		t.Errorf("RestoreRecords() error = %v, want %v", err, os.ErrExist)
+	}
+
+	copied, result, err := NewDiskStoreWithResult(restored, Options{})
+	if err != nil {
+		t.Fatalf("failed to open restored store: %v", err)
+	}
+	defer copied.Close()
+	if !result.HintUsed || result.Loaded != 0 {
+		t.Errorf("OpenResult = %+v, want the restored keyStore loaded from the hint", result)
+	}
+	want, err := store.Digest()
+	if err != nil {
+		t.Fatalf("Digest() error = %v", err)
+	}
+	got, err := copied.Digest()
+	if err != nil {
+		t.Fatalf("Digest() error = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Digest() of the restored store = %x, want %x", got, want)
+	}
+	if value, meta, ok := copied.GetMeta2("hamlet"); !ok || value != "shakespeare" || meta != 7 {
+		t.Errorf("GetMeta2() = %v, %v, %v, want shakespeare, 7, true", value, meta, ok)
+	}
+	if _, ok := copied.Lookup("key-0"); ok {
+		t.Errorf("Lookup() found a deleted key")
+	}
+	original, _ := store.keyStore.Get("dune")
+	if entry, _ := copied.keyStore.Get("dune"); entry.expiresAt == 0 || entry.expiresAt != original.expiresAt {
+		t.Errorf("expiresAt = %v, want %v", entry.expiresAt, original.expiresAt)
+	}
+	if last, want := copied.lastTimestamp.Load(), store.lastTimestamp.Load(); last != want {
+		t.Errorf("latest timestamp = %v, want %v of the streamed records", last, want)
+	}
+}
+
+func TestRestoreRecordsCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewDiskStore(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	var stream bytes.Buffer
+	if err := store.StreamRecords(&stream); err != nil {
+		t.Fatalf("StreamRecords() error = %v", err)
+	}
+	data := stream.Bytes()
+	data[len(data)-1] ^= 0xff
+
+	restored := filepath.Join(dir, "restored.db")
+	if err := RestoreRecords(restored, bytes.NewReader(data)); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("RestoreRecords() error = %v, want %v", err, ErrCorruptRecord)
+	}
+	if err := RestoreRecords(restored, bytes.NewReader(data[:len(data)-3])); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("RestoreRecords() error = %v, want %v", err, ErrCorruptRecord)
+	}
+	// sizes no record can have are caught before allocating for them
+	huge := append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(huge[fileHeaderSize+8:], math.MaxUint32)
+	binary.LittleEndian.PutUint32(huge[fileHeaderSize+12:], math.MaxUint32)
+	if err := RestoreRecords(restored, bytes.NewReader(huge)); !errors.Is(err, ErrCorruptRecord) {
+		t.Errorf("RestoreRecords() error = %v, want %v", err, ErrCorruptRecord)
+	}
+	if _, err := os.Stat(restored); !os.IsNotExist(err) {
+		t.Errorf("failed RestoreRecords() left %s behind", restored)
+	}
+}
@@ -0,0 +1,63 @@
+package caskdb
+
+import "time"
+
+// SetWithTTL sets a value like Set, which expires after ttl. Expired keys read as
+// absent straight away, while their space is reclaimed by ExpireExpiredKeys or the
+// next compaction. Expiry times are kept in whole seconds and rounded up, so a key
+// never expires early but may outlive its ttl by up to a second.
+func (d *DiskStore) SetWithTTL(key string, value string, ttl time.Duration) error {
+	now := d.now()
+	expiresAt := now.Add(ttl)
+	if expiresAt.Truncate(time.Second) != expiresAt {
+		expiresAt = expiresAt.Add(time.Second)
+	}
+	return d.set(key, value, recordHeader{timestamp: d.timestamp(), expiresAt: uint32(expiresAt.Unix())})
+}
+
+// ExpireExpiredKeys writes a tombstone for every expired key and drops it from the
+// keyStore, returning how many keys were purged. Expired keys otherwise linger in
+// memory until the store is compacted, or they are read with
+// Options.ExpireOnAccess; Options.ExpireInterval runs this in the background.
+func (d *DiskStore) ExpireExpiredKeys() (int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.deferred {
+		return 0, ErrIndexNotBuilt
+	}
+	now := d.now().Unix()
+	var expired []string
+	d.keyStore.Range(func(key string, entry KeyEntry) bool {
+		if entry.expired(now) {
+			expired = append(expired, key)
+		}
+		return true
+	})
+
+	purged := 0
+	for _, key := range expired {
+		ok, err := d.expireKey(key, now)
+		if err != nil {
+			return purged, err
+		}
+		if ok {
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// expireKey writes a tombstone for key and drops it from the keyStore if it has
+// expired by now, reporting whether it did. The caller must hold mu, but not the
+// lock of the key.
+func (d *DiskStore) expireKey(key string, now int64) (bool, error) {
+	shard := d.lockKey(key)
+	defer shard.Unlock()
+	// the key may have been set again since it was found expired
+	entry, ok := d.keyStore.Get(key)
+	if !ok || !entry.expired(now) {
+		return false, nil
+	}
+	err := d.writeRecord(key, "", recordHeader{timestamp: d.timestamp(), flags: flagTombstone})
+	return err == nil, err
+}
@@ -0,0 +1,190 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_SetWithTTL(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.SetWithTTL("crime and punishment", "dostoevsky", time.Millisecond)
+	store.SetWithTTL("anna karenina", "tolstoy", time.Hour)
+	store.Set("othello", "shakespeare")
+	if val, ok := store.Lookup("anna karenina"); !ok || val != "tolstoy" {
+		t.Errorf("Lookup() = %v, %v, want tolstoy, true", val, ok)
+	}
+	time.Sleep(time.Second + 100*time.Millisecond)
+	if val, ok := store.Lookup("crime and punishment"); ok {
+		t.Errorf("Lookup() = %v, %v, want the key expired", val, ok)
+	}
+	store.Close()
+
+	// expiry times survive a reopen, through the hint file and through a scan
+	for _, hint := range []bool{true, false} {
+		if !hint {
+			os.Remove(hintFileName(fileName))
+		}
+		store, err = NewDiskStore(fileName)
+		if err != nil {
+			t.Fatalf("failed to open disk store: %v", err)
+		}
+		if _, ok := store.Lookup("crime and punishment"); ok {
+			t.Errorf("Lookup() found an expired key after reopening, hint = %v", hint)
+		}
+		if val := store.Get("anna karenina"); val != "tolstoy" {
+			t.Errorf("Get() = %v, want tolstoy", val)
+		}
+		entry, _ := store.keyStore.Get("anna karenina")
+		if entry.expiresAt == 0 {
+			t.Errorf("expiresAt = 0 after reopening, hint = %v", hint)
+		}
+		store.Close()
+	}
+}
+
+// fakeClock is an Options.Clock which only moves when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestDiskStore_ExpireExpiredKeys(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{Clock: clock.Now})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.SetWithTTL("crime and punishment", "dostoevsky", time.Millisecond)
+	store.SetWithTTL("hamlet", "shakespeare", 10*time.Millisecond)
+	store.SetWithTTL("one hundred years of solitude", "marquez", time.Minute)
+	store.SetWithTTL("anna karenina", "tolstoy", time.Hour)
+	store.Set("othello", "shakespeare")
+	// set again without a TTL, which clears the expiry
+	store.SetWithTTL("don quixote", "cervantes", time.Millisecond)
+	store.Set("don quixote", "cervantes")
+
+	clock.Advance(time.Minute)
+	n, err := store.ExpireExpiredKeys()
+	if err != nil {
+		t.Fatalf("ExpireExpiredKeys() error = %v", err)
+	}
+	if n != 3 {
+		t.Errorf("ExpireExpiredKeys() = %v, want 3", n)
+	}
+	if store.keyStore.Len() != 3 {
+		t.Errorf("keyStore.Len() = %v, want 3", store.keyStore.Len())
+	}
+	for _, key := range []string{"crime and punishment", "hamlet", "one hundred years of solitude"} {
+		if _, ok := store.keyStore.Get(key); ok {
+			t.Errorf("keyStore still has %v", key)
+		}
+	}
+	if n, _ := store.ExpireExpiredKeys(); n != 0 {
+		t.Errorf("ExpireExpiredKeys() = %v on the second run, want 0", n)
+	}
+}
+
+func TestDiskStore_Clock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{Clock: clock.Now})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.SetWithTTL("hamlet", "shakespeare", 90*time.Second)
+	store.Set("othello", "shakespeare")
+	if entry, _ := store.keyStore.Get("othello"); entry.timestamp != 1700000000 {
+		t.Errorf("timestamp = %v, want the time of the clock", entry.timestamp)
+	}
+
+	clock.Advance(89 * time.Second)
+	if _, ok := store.Lookup("hamlet"); !ok {
+		t.Errorf("Lookup() did not find a key before its TTL")
+	}
+	clock.Advance(time.Second)
+	if _, ok := store.Lookup("hamlet"); ok {
+		t.Errorf("Lookup() found a key past its TTL")
+	}
+	if keys, _ := store.KeysModifiedSince(time.Unix(0, 0)); len(keys) != 1 || keys[0] != "othello" {
+		t.Errorf("KeysModifiedSince() = %v, want [othello]", keys)
+	}
+}
+
+func TestDiskStore_ExpireInterval(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{ExpireInterval: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.SetWithTTL("crime and punishment", "dostoevsky", time.Millisecond)
+	deadline := time.Now().Add(3 * time.Second)
+	for store.keyStore.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if store.keyStore.Len() != 0 {
+		t.Errorf("keyStore.Len() = %v, want the key purged in the background", store.keyStore.Len())
+	}
+	if !store.Close() {
+		t.Errorf("Close() = false, want true")
+	}
+}
+
+func TestDiskStore_ExpireOnAccess(t *testing.T) {
+	for _, onAccess := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ExpireOnAccess=%v", onAccess), func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(1700000000, 0)}
+			fileName := filepath.Join(t.TempDir(), "test.db")
+			store, err := NewDiskStoreWithOptions(fileName, Options{Clock: clock.Now, ExpireOnAccess: onAccess})
+			if err != nil {
+				t.Fatalf("failed to create disk store: %v", err)
+			}
+			defer store.Close()
+			store.SetWithTTL("hamlet", "shakespeare", time.Second)
+			store.SetWithTTL("dune", "frank herbert", time.Second)
+			store.Set("othello", "shakespeare")
+			clock.Advance(time.Minute)
+			before, _ := os.Stat(fileName)
+
+			if _, ok := store.Lookup("hamlet"); ok {
+				t.Errorf("Lookup() found an expired key")
+			}
+			if _, err := store.Fetch("dune"); !errors.Is(err, ErrKeyNotFound) {
+				t.Errorf("Fetch() error = %v, want %v", err, ErrKeyNotFound)
+			}
+			for _, key := range []string{"hamlet", "dune"} {
+				if _, ok := store.keyStore.Get(key); ok == onAccess {
+					t.Errorf("keyStore has %q = %v after reading it expired, want %v", key, ok, !onAccess)
+				}
+			}
+			after, _ := os.Stat(fileName)
+			if wrote := after.Size() > before.Size(); wrote != onAccess {
+				t.Errorf("reading expired keys wrote to the file = %v, want %v", wrote, onAccess)
+			}
+			if _, ok := store.Lookup("othello"); !ok {
+				t.Errorf("Lookup() did not find a key without a TTL")
+			}
+		})
+	}
+}
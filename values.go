@@ -0,0 +1,125 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"os"
+)
+
+// With Options.SeparateValues, the store keeps its keys and values in two files.
+// The data file holds the usual records, except that instead of the value, each
+// record holds the location of the value in the values file:
+//
+//	┌──────────────────┬─────────────────┬────────────────┐
+//	│ value_offset(4B) │ value_size(4B)  │ value_crc(4B)  │
+//	└──────────────────┴─────────────────┴────────────────┘
+//
+// The values file is just the raw values, one after the other. Building the
+// keyStore only needs the data file, which stays small even when the values are
+// huge, so opening the store is fast. The price is a second read on every Get.
+//
+// Values are always written and synced before the record pointing at them, so a
+// crash can leave an unreferenced value behind, but never a record pointing at a
+// missing value.
+//
+// With Options.Dedup, records with the same value share a single copy of it in the
+// values file. Since the values file is never compacted, a shared value stays put
+// for as long as any record points at it.
+
+const valueLocationSize = 12
+
+// maxValuesSize is the largest the values file can grow, as the location of a
+// value keeps its offset in 4 bytes
+var maxValuesSize int64 = math.MaxUint32
+
+var errInvalidValueLocation = errors.New("caskdb: invalid value location")
+
+func valuesFileName(fileName string) string {
+	return fileName + ".values"
+}
+
+func encodeValueLocation(offset uint32, value string) string {
+	var result [valueLocationSize]byte
+	binary.LittleEndian.PutUint32(result[0:4], offset)
+	binary.LittleEndian.PutUint32(result[4:8], uint32(len(value)))
+	binary.LittleEndian.PutUint32(result[8:12], crc32.ChecksumIEEE([]byte(value)))
+	return string(result[:])
+}
+
+func decodeValueLocation(location string) (uint32, uint32, uint32, error) {
+	if len(location) != valueLocationSize {
+		return 0, 0, 0, errInvalidValueLocation
+	}
+	data := []byte(location)
+	offset := binary.LittleEndian.Uint32(data[0:4])
+	size := binary.LittleEndian.Uint32(data[4:8])
+	checksum := binary.LittleEndian.Uint32(data[8:12])
+	return offset, size, checksum, nil
+}
+
+// dedupKey identifies the values which may be identical for Options.Dedup
+type dedupKey struct {
+	size     uint32
+	checksum uint32
+}
+
+// appendValue writes value to the end of the values file, returning the location
+// to store in the data file in its place. With Options.Dedup, the location of an
+// identical value already in the file is returned instead.
+func (d *DiskStore) appendValue(value string) (string, error) {
+	var key dedupKey
+	if d.opts.Dedup {
+		key = dedupKey{uint32(len(value)), crc32.ChecksumIEEE([]byte(value))}
+		d.dedupMu.Lock()
+		location, ok := d.dedup[key]
+		d.dedupMu.Unlock()
+		// the checksum may collide, so the value is only shared once the bytes
+		// are known to be equal
+		if ok {
+			if existing, err := d.resolveValue(location); err == nil && existing == value {
+				return location, nil
+			}
+		}
+	}
+
+	pos, err := d.append(d.values, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	location := encodeValueLocation(uint32(pos), value)
+	if d.opts.Dedup {
+		d.dedupMu.Lock()
+		if d.dedup == nil {
+			d.dedup = make(map[dedupKey]string)
+		}
+		d.dedup[key] = location
+		d.dedupMu.Unlock()
+	}
+	return location, nil
+}
+
+// resolveValue turns the value decoded from a record into the actual value. It is
+// the identity unless the values are kept in a separate file.
+func (d *DiskStore) resolveValue(value string) (string, error) {
+	if d.values == nil {
+		return value, nil
+	}
+	offset, size, checksum, err := decodeValueLocation(value)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	if _, err := d.values.ReadAt(buf, int64(offset)); err != nil {
+		return "", err
+	}
+	if crc32.ChecksumIEEE(buf) != checksum {
+		return "", errInvalidValueLocation
+	}
+	return string(buf), nil
+}
+
+func openValuesFile(fileName string, opts Options) (*os.File, error) {
+	return os.OpenFile(valuesFileName(fileName), os.O_RDWR|os.O_CREATE|opts.appendFlag(), 0666)
+}
@@ -0,0 +1,163 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_SeparateValues(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{SeparateValues: true}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	tests := map[string]string{
+		"crime and punishment": strings.Repeat("dostoevsky", 1000),
+		"anna karenina":        strings.Repeat("tolstoy", 1000),
+		"hamlet":               "shakespeare",
+		"empty":                "",
+	}
+	for key, val := range tests {
+		if err := store.Set(key, val); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+		if store.Get(key) != val {
+			t.Errorf("Get(%v) = %v, want %v", key, store.Get(key), val)
+		}
+	}
+	store.Set("hamlet", "william shakespeare")
+	tests["hamlet"] = "william shakespeare"
+	store.Close()
+
+	keysInfo, _ := os.Stat(fileName)
+	valuesInfo, _ := os.Stat(valuesFileName(fileName))
+	if keysInfo.Size() >= valuesInfo.Size() {
+		t.Errorf("data file size = %v, want less than values file size %v", keysInfo.Size(), valuesInfo.Size())
+	}
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	for key, val := range tests {
+		if store.Get(key) != val {
+			t.Errorf("Get(%v) = %v, want %v", key, store.Get(key), val)
+		}
+	}
+}
+
+func TestDiskStore_SeparateValuesOpenReadsKeysOnly(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{SeparateValues: true}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Close()
+	os.Remove(hintFileName(fileName))
+
+	// with the values moved out of the way, opening still has to find every key
+	values := valuesFileName(fileName)
+	os.Rename(values, values+".bak")
+	os.WriteFile(values, nil, 0666)
+	store, result, err := NewDiskStoreWithResult(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	if result.Loaded != 2 || store.keyStore.Len() != 2 {
+		t.Errorf("Loaded = %v with %v keys, want 2 records and 2 keys", result.Loaded, store.keyStore.Len())
+	}
+	store.Close()
+
+	os.Rename(values+".bak", values)
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if store.Get("dune") != "frank herbert" {
+		t.Errorf("Get() = %v, want %v", store.Get("dune"), "frank herbert")
+	}
+}
+
+func TestDiskStore_Dedup(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{SeparateValues: true, Dedup: true}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	large := strings.Repeat("all work and no play makes jack a dull boy\n", 1000)
+	for i := 0; i < 50; i++ {
+		if err := store.Set(fmt.Sprintf("copy-%d", i), large); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	store.Set("hamlet", "shakespeare")
+	// overwriting and compacting must not lose the shared value
+	store.Set("copy-0", "gone")
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	store.Close()
+
+	valuesInfo, _ := os.Stat(valuesFileName(fileName))
+	if want := int64(len(large) + len("shakespeare") + len("gone")); valuesInfo.Size() != want {
+		t.Errorf("values file size = %v, want %v", valuesInfo.Size(), want)
+	}
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 1; i < 50; i++ {
+		if store.Get(fmt.Sprintf("copy-%d", i)) != large {
+			t.Errorf("Get(copy-%d) returned a different value", i)
+		}
+	}
+	if store.Get("copy-0") != "gone" {
+		t.Errorf("Get() = %v, want %v", store.Get("copy-0"), "gone")
+	}
+}
+
+func TestDiskStore_DedupRequiresSeparateValues(t *testing.T) {
+	if _, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{Dedup: true}); err == nil {
+		t.Errorf("NewDiskStoreWithOptions() error = nil, want Dedup rejected without SeparateValues")
+	}
+}
+
+func TestDiskStore_SeparateValuesFull(t *testing.T) {
+	defer func(size int64) { maxValuesSize = size }(maxValuesSize)
+	maxValuesSize = 64
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{SeparateValues: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if err := store.Set("hamlet", strings.Repeat("shakespeare", 5)); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	info, _ := os.Stat(valuesFileName(fileName))
+	if err := store.Set("dune", strings.Repeat("frank herbert", 5)); !errors.Is(err, ErrStoreFull) {
+		t.Errorf("Set() error = %v, want %v", err, ErrStoreFull)
+	}
+	if after, _ := os.Stat(valuesFileName(fileName)); after.Size() != info.Size() {
+		t.Errorf("values file size = %v, want %v left as it was", after.Size(), info.Size())
+	}
+	if _, ok := store.Lookup("dune"); ok {
+		t.Errorf("failed Set() must not update the keyStore")
+	}
+	if val := store.Get("hamlet"); val != strings.Repeat("shakespeare", 5) {
+		t.Errorf("Get() = %v, want %v", val, strings.Repeat("shakespeare", 5))
+	}
+}
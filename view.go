@@ -0,0 +1,78 @@
+package caskdb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// viewBuffers pools the buffers GetView reads records into, so that a released
+// buffer is reused by a later view instead of being allocated again
+var viewBuffers sync.Pool
+
+// GetView gets a value from the store like Lookup, without copying it into a
+// string: value aliases the buffer the record was read into, which goes back to
+// a pool when the caller calls release. release must be called exactly once,
+// after which value must no longer be used, as the next GetView may overwrite it;
+// copy the bytes first to keep them. Values which are compressed, cached in
+// memory or stored in the values file of Options.SeparateValues are copied once
+// into a fresh slice, for which release does nothing.
+//
+// The store has no memory mapped read path, so value aliases a read buffer rather
+// than the file itself; what GetView saves is the allocation and copy of each read.
+func (d *DiskStore) GetView(key string) (value []byte, release func(), ok bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	value, release, ok, err := d.getView(key)
+	if err != nil && !errors.Is(err, ErrIndexNotBuilt) {
+		log.Fatal("Error reading file", err)
+	}
+	return value, release, ok
+}
+
+// getView does the work of GetView. The caller must hold mu.
+func (d *DiskStore) getView(key string) ([]byte, func(), bool, error) {
+	noop := func() {}
+	key = d.normalizeKey(key)
+	keyEntry, ok := d.keyStore.Get(key)
+	if _, cached := d.cache.get(key); d.deferred || !ok || d.values != nil || cached {
+		_, value, ok, err := d.readRecord(key)
+		return []byte(value), noop, ok, err
+	}
+	if keyEntry.expired(d.now().Unix()) {
+		_, _, ok, err := d.readRecord(key)
+		return nil, noop, ok, err
+	}
+
+	bufp, _ := viewBuffers.Get().(*[]byte)
+	if bufp == nil || cap(*bufp) < int(keyEntry.totalSize) {
+		buf := make([]byte, keyEntry.totalSize)
+		bufp = &buf
+	}
+	buf := (*bufp)[:keyEntry.totalSize]
+	release := func() { viewBuffers.Put(bufp) }
+	version, err := d.readKeyRecord(key, keyEntry, buf)
+	if err != nil {
+		release()
+		return nil, noop, false, err
+	}
+	headerSize := uint32(recordHeaderSize(version))
+	h := decodeRecordHeader(version, buf[:headerSize])
+	recordKey := buf[headerSize : headerSize+h.keySize]
+	if d.opts.VerifyOnRead && !bytes.Equal(recordKey, []byte(key)) {
+		release()
+		return nil, noop, false, fmt.Errorf("%w: %q", ErrIndexCorrupt, key)
+	}
+	value := buf[headerSize+h.keySize:]
+	if h.flags&flagExpires != 0 && len(value) >= expirySize {
+		value = value[expirySize:]
+	}
+	if h.codec() != CodecNone {
+		decoded, err := h.codec().decode(string(value))
+		release()
+		return []byte(decoded), noop, err == nil, err
+	}
+	return value, release, true, nil
+}
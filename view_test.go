@@ -0,0 +1,42 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_GetView(t *testing.T) {
+	for name, opts := range map[string]Options{"plain": {}, "compressed": {Codec: CodecFlate}} {
+		t.Run(name, func(t *testing.T) {
+			store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), opts)
+			if err != nil {
+				t.Fatalf("failed to create disk store: %v", err)
+			}
+			defer store.Close()
+			long := strings.Repeat("to be or not to be ", 10)
+			store.Set("hamlet", long)
+			store.SetWithTTL("dune", "frank herbert", time.Hour)
+
+			for key, want := range map[string]string{"hamlet": long, "dune": "frank herbert"} {
+				value, release, ok := store.GetView(key)
+				if !ok || string(value) != want {
+					t.Errorf("GetView(%q) = %q, %v, want %q, %v", key, value, ok, want, true)
+				}
+				release()
+			}
+			store.Set("hamlet", "shakespeare")
+			value, release, ok := store.GetView("hamlet")
+			if !ok || string(value) != "shakespeare" {
+				t.Errorf("GetView() = %q, %v, want %q, %v", value, ok, "shakespeare", true)
+			}
+			release()
+			if _, release, ok := store.GetView("war and peace"); ok {
+				t.Errorf("GetView() ok = %v, want %v", ok, false)
+			} else {
+				release()
+			}
+		})
+	}
+}
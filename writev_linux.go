@@ -0,0 +1,75 @@
+package caskdb
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// iovMax is the most buffers a single writev accepts, IOV_MAX on Linux
+const iovMax = 1024
+
+// writeVectored writes bufs to file one after the other with writev, so that they
+// need not be concatenated into one buffer first. Files other than an *os.File,
+// such as those injected by tests, fall back to writeConcat.
+func writeVectored(file appendFile, bufs [][]byte) (int, error) {
+	f, ok := file.(*os.File)
+	if !ok || len(bufs) == 1 {
+		return writeConcat(file, bufs)
+	}
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	iovs := make([]syscall.Iovec, 0, min(len(bufs), iovMax))
+	for _, buf := range bufs {
+		if len(buf) > 0 {
+			iov := syscall.Iovec{Base: &buf[0]}
+			iov.SetLen(len(buf))
+			iovs = append(iovs, iov)
+		}
+	}
+	var written int
+	var writeErr error
+	err = conn.Write(func(fd uintptr) bool {
+		for len(iovs) > 0 {
+			batch := iovs[:min(len(iovs), iovMax)]
+			n, _, errno := syscall.Syscall(syscall.SYS_WRITEV, fd, uintptr(unsafe.Pointer(&batch[0])), uintptr(len(batch)))
+			if errno == syscall.EINTR {
+				continue
+			}
+			if errno == syscall.EAGAIN {
+				return false
+			}
+			if errno != 0 {
+				writeErr = errno
+				return true
+			}
+			if n == 0 {
+				writeErr = io.ErrShortWrite
+				return true
+			}
+			written += int(n)
+			iovs = advanceIovecs(iovs, int(n))
+		}
+		return true
+	})
+	if err == nil {
+		err = writeErr
+	}
+	return written, err
+}
+
+// advanceIovecs drops the first n bytes written from iovs
+func advanceIovecs(iovs []syscall.Iovec, n int) []syscall.Iovec {
+	for len(iovs) > 0 && n >= int(iovs[0].Len) {
+		n -= int(iovs[0].Len)
+		iovs = iovs[1:]
+	}
+	if n > 0 {
+		iovs[0].Base = (*byte)(unsafe.Add(unsafe.Pointer(iovs[0].Base), n))
+		iovs[0].SetLen(int(iovs[0].Len) - n)
+	}
+	return iovs
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package caskdb
+
+// writeVectored writes bufs to file one after the other. Without writev they are
+// concatenated and written at once.
+func writeVectored(file appendFile, bufs [][]byte) (int, error) {
+	return writeConcat(file, bufs)
+}
@@ -0,0 +1,65 @@
+package caskdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteVectored(t *testing.T) {
+	file, err := os.OpenFile(filepath.Join(t.TempDir(), "test.db"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("failed to create file: %v", err)
+	}
+	defer file.Close()
+	// more buffers than a single writev takes, some of them empty
+	var bufs [][]byte
+	for i := 0; i < 2500; i++ {
+		if i%100 == 0 {
+			bufs = append(bufs, nil)
+		}
+		bufs = append(bufs, []byte(fmt.Sprintf("record-%d;", i)))
+	}
+	want := bytes.Join(bufs, nil)
+	n, err := writeVectored(file, bufs)
+	if err != nil {
+		t.Fatalf("writeVectored() error = %v", err)
+	}
+	if n != len(want) {
+		t.Errorf("writeVectored() = %v, want %v", n, len(want))
+	}
+	if got, _ := os.ReadFile(file.Name()); !bytes.Equal(got, want) {
+		t.Errorf("file content differs from the concatenated buffers")
+	}
+}
+
+func BenchmarkWriteVectored(b *testing.B) {
+	bufs := make([][]byte, 256)
+	for i := range bufs {
+		bufs[i] = bytes.Repeat([]byte{byte(i)}, 1024)
+	}
+	for name, write := range map[string]func(appendFile, [][]byte) (int, error){
+		"writev": writeVectored,
+		"concat": func(file appendFile, bufs [][]byte) (int, error) { return writeConcat(file, bufs) },
+	} {
+		b.Run(name, func(b *testing.B) {
+			file, err := os.OpenFile(filepath.Join(b.TempDir(), "test.db"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+			if err != nil {
+				b.Fatalf("failed to create file: %v", err)
+			}
+			defer file.Close()
+			b.ReportAllocs()
+			b.SetBytes(256 * 1024)
+			for i := 0; i < b.N; i++ {
+				if _, err := write(file, bufs); err != nil {
+					b.Fatal(err)
+				}
+				if i%64 == 63 {
+					file.Truncate(0)
+				}
+			}
+		})
+	}
+}